@@ -0,0 +1,334 @@
+// Package audit keeps an append-only log of the writes made to the database and of
+// logins and logouts. Each record holds the hash of the one before it, so changing or
+// removing a record breaks the chain. Implement the handler interface for querying
+// and verifying the log, expect input urls to start with "/admin/audit."
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
+)
+
+// The hash the first record of a log chains from
+const GENESIS_HASH = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// ErrTornRecord reports a last record cut short, as a crash while appending leaves it.
+var ErrTornRecord = errors.New("torn record")
+
+// A Record describes one audited request.
+type Record struct {
+	Seq      int64     `json:"seq"`                // The position of the record in the log, from 1.
+	Time     time.Time `json:"time"`               // When the request finished.
+	User     string    `json:"user"`               // The authenticated user, if any.
+	Client   string    `json:"client"`             // The address the request came from.
+	Method   string    `json:"method"`             // The HTTP method.
+	Path     string    `json:"path"`               // The path and query of the request.
+	Status   int       `json:"status"`             // The status code of the response.
+	BodyHash string    `json:"bodyHash,omitempty"` // The hex SHA-256 hash of the request body, if it had one.
+	Prev     string    `json:"prev"`               // The hash of the record before.
+	Hash     string    `json:"hash"`               // The hash of this record.
+}
+
+// A Log appends records to a file.
+type Log struct {
+	path string           // The file of the log
+	file *os.File         // The file, open for appending
+	seq  int64            // The sequence number of the last record
+	last string           // The hash of the last record
+	torn error            // The torn record removed on opening, if any
+	now  func() time.Time // The clock
+	mu   sync.Mutex       // To protect access to above
+}
+
+// Open the log in the file at the given path, creating it if needed.
+// Records are appended after those already there. A torn last record is
+// removed, so that the next one starts on its own line, and reported by Verify.
+func Open(path string) (*Log, error) {
+	l := &Log{path: path, last: GENESIS_HASH, now: time.Now}
+
+	torn, err := l.scan(func(record Record) error {
+		l.seq = record.Seq
+		l.last = record.Hash
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if torn >= 0 {
+		slog.Warn("audit Open: removing torn record at the end of the log", "path", path, "after", l.seq)
+		err = os.Truncate(path, torn)
+		if err != nil {
+			return nil, err
+		}
+		l.torn = fmt.Errorf("record %d: %w removed when the log was opened", l.seq+1, ErrTornRecord)
+	}
+
+	l.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Close the file of the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Audit implements the auditor interface, recording a request made by the user, the status
+// of its response and a hash of its body. Errors are logged, as the request is already done.
+func (l *Log) Audit(r *http.Request, username string, status int, body []byte) {
+	record := Record{
+		User:   username,
+		Client: r.RemoteAddr,
+		Method: r.Method,
+		Path:   r.URL.RequestURI(),
+		Status: status,
+	}
+	if len(body) > 0 {
+		hash := sha256.Sum256(body)
+		record.BodyHash = hex.EncodeToString(hash[:])
+	}
+
+	err := l.Append(record)
+	if err != nil {
+		slog.Error("audit Audit: could not write audit record", "error", err, "method", r.Method, "path", r.URL.Path)
+	}
+}
+
+// Append a record to the log, filling in its time, sequence number and hashes.
+func (l *Log) Append(record Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record.Seq = l.seq + 1
+	record.Time = l.now().UTC()
+	record.Prev = l.last
+	record.Hash = hashRecord(record)
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	l.seq = record.Seq
+	l.last = record.Hash
+	return nil
+}
+
+// Check that every record in the log is intact and chains from the one before.
+// Returns the number of records, and an error naming the first bad one if any,
+// including a torn record removed when the log was opened.
+func (l *Log) Verify() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var count int64
+	prev := GENESIS_HASH
+	torn, err := l.scan(func(record Record) error {
+		count++
+		if record.Seq != count {
+			return fmt.Errorf("record %d: expected sequence number %d", record.Seq, count)
+		}
+		if record.Prev != prev {
+			return fmt.Errorf("record %d: does not chain from the record before", record.Seq)
+		}
+		if hashRecord(record) != record.Hash {
+			return fmt.Errorf("record %d: hash does not match its contents", record.Seq)
+		}
+		prev = record.Hash
+		return nil
+	})
+	if err == nil && torn >= 0 {
+		err = fmt.Errorf("record %d: %w", count+1, ErrTornRecord)
+	}
+	if err == nil && count != l.seq {
+		err = fmt.Errorf("log ends at record %d, expected %d", count, l.seq)
+	}
+	if err == nil {
+		err = l.torn
+	}
+	return count, err
+}
+
+// Find the records of a user, or of everyone if empty, made in the given time range.
+// A zero time leaves that end of the range open.
+func (l *Log) Query(username string, from, to time.Time) ([]Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	records := make([]Record, 0)
+	_, err := l.scan(func(record Record) error {
+		if username != "" && record.User != username {
+			return nil
+		}
+		if (!from.IsZero() && record.Time.Before(from)) || (!to.IsZero() && !record.Time.Before(to)) {
+			return nil
+		}
+		records = append(records, record)
+		return nil
+	})
+	return records, err
+}
+
+// Call visit with every record in the log file, in order, stopping at the first error.
+// A last line that is cut short is skipped, and its offset in the file returned; the
+// offset is -1 if there is none.
+func (l *Log) scan(visit func(record Record) error) (int64, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return -1, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for line := int64(1); ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			return -1, nil
+		}
+		if err != nil && err != io.EOF {
+			return -1, err
+		}
+
+		var record Record
+		jsonErr := json.Unmarshal(data, &record)
+		if jsonErr != nil && err == io.EOF {
+			// appends write whole lines, so only a crash leaves one without its newline
+			return offset, nil
+		}
+		if jsonErr != nil {
+			return -1, fmt.Errorf("line %d: %w", line, jsonErr)
+		}
+		err = visit(record)
+		if err != nil {
+			return -1, err
+		}
+		offset += int64(len(data))
+	}
+}
+
+// Hash a record, covering every field but the hash itself.
+func hashRecord(record Record) string {
+	record.Hash = ""
+	data, _ := json.Marshal(record)
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// A verifyOutput is the response to verifying the log.
+type verifyOutput struct {
+	Valid   bool   `json:"valid"`           // Whether the chain is intact.
+	Records int64  `json:"records"`         // The records checked.
+	Error   string `json:"error,omitempty"` // What is wrong, if anything.
+}
+
+// ServeHTTP implements the http.Handler interface for the log. GET "/admin/audit" returns
+// the records, limited by the "user", "from" and "to" query parameters, times being
+// RFC 3339. GET "/admin/audit/verify" checks the chain.
+func (l *Log) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		slog.Info("audit ServeHTTP: unsupported method", "method", r.Method)
+		errorMessage.ErrorResponse(w, "unsupported method: "+r.Method, http.StatusBadRequest)
+		return
+	}
+
+	var response any
+	if strings.TrimSuffix(r.URL.Path, "/") == "/admin/audit/verify" {
+		count, err := l.Verify()
+		output := verifyOutput{Valid: err == nil, Records: count}
+		if err != nil {
+			slog.Error("audit ServeHTTP: audit log failed verification", "error", err)
+			output.Error = err.Error()
+		}
+		response = output
+	} else {
+		var times [2]time.Time
+		for i, param := range []string{"from", "to"} {
+			value := r.URL.Query().Get(param)
+			if value == "" {
+				continue
+			}
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				errorMessage.ErrorResponse(w, fmt.Sprintf("invalid %s time, expected RFC 3339", param), http.StatusBadRequest)
+				return
+			}
+			times[i] = parsed
+		}
+
+		records, err := l.Query(r.URL.Query().Get("user"), times[0], times[1])
+		if err != nil {
+			slog.Error("audit ServeHTTP: error reading audit log", "error", err)
+			errorMessage.ErrorResponse(w, "error reading audit log", http.StatusInternalServerError)
+			return
+		}
+		response = records
+	}
+
+	jsonResponse, _ := json.Marshal(response)
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+// A StatusWriter is a response writer that remembers the status code written.
+type StatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// Wrap a response writer to remember its status code.
+func NewStatusWriter(w http.ResponseWriter) *StatusWriter {
+	return &StatusWriter{ResponseWriter: w}
+}
+
+// Remember the status code and write it.
+func (s *StatusWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Write the body, which implies status 200 if none was written.
+func (s *StatusWriter) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+// Flush the response, if the wrapped writer can.
+func (s *StatusWriter) Flush() {
+	if flusher, canFlush := s.ResponseWriter.(http.Flusher); canFlush {
+		flusher.Flush()
+	}
+}
+
+// The status code written, 200 if the response was left empty.
+func (s *StatusWriter) Status() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
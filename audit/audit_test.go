@@ -0,0 +1,163 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Open a log for testing in a temporary directory, with a clock that ticks a minute per record.
+func testLog(t *testing.T) (*Log, string) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected no error opening the log, got %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	current := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time {
+		current = current.Add(time.Minute)
+		return current
+	}
+	return l, path
+}
+
+// Record a request made by the user with the log.
+func record(l *Log, username, method, target, body string, status int) {
+	l.Audit(httptest.NewRequest(method, target, strings.NewReader(body)), username, status, []byte(body))
+}
+
+func TestAppendAndVerify(t *testing.T) {
+	l, path := testLog(t)
+	record(l, "rexle", http.MethodPut, "/v1/db/doc", "{\"a\":1}", http.StatusCreated)
+	record(l, "other", http.MethodDelete, "/v1/db/doc", "", http.StatusNoContent)
+	record(l, "rexle", http.MethodPost, "/auth", "", http.StatusOK)
+
+	count, err := l.Verify()
+	if count != 3 || err != nil {
+		t.Errorf("Expected 3 valid records, got %d %v", count, err)
+	}
+
+	// records survive reopening, and new ones continue the chain
+	l.Close()
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected no error reopening the log, got %v", err)
+	}
+	defer reopened.Close()
+	record(reopened, "rexle", http.MethodPatch, "/v1/db/doc", "[]", http.StatusOK)
+	count, err = reopened.Verify()
+	if count != 4 || err != nil {
+		t.Errorf("Expected 4 valid records after reopening, got %d %v", count, err)
+	}
+
+	records, _ := reopened.Query("", time.Time{}, time.Time{})
+	if records[0].BodyHash == "" || records[1].BodyHash != "" || records[3].Prev != records[2].Hash {
+		t.Errorf("Expected hashed bodies and a chain, got %+v", records)
+	}
+}
+
+func TestTamperDetection(t *testing.T) {
+	tampers := map[string]func(lines [][]byte) [][]byte{
+		"record 2: hash does not match its contents": func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte("\"status\":204"), []byte("\"status\":200"), 1)
+			return lines
+		},
+		"record 3: expected sequence number 2": func(lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		},
+		"log ends at record 2, expected 3": func(lines [][]byte) [][]byte {
+			return lines[:2]
+		},
+	}
+
+	for expected, tamper := range tampers {
+		l, path := testLog(t)
+		record(l, "rexle", http.MethodPut, "/v1/db/doc", "{}", http.StatusCreated)
+		record(l, "rexle", http.MethodDelete, "/v1/db/doc", "", http.StatusNoContent)
+		record(l, "rexle", http.MethodPut, "/v1/db/doc", "{}", http.StatusCreated)
+
+		data, _ := os.ReadFile(path)
+		lines := tamper(bytes.SplitAfter(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")))
+		os.WriteFile(path, bytes.Join(lines, nil), 0600)
+
+		_, err := l.Verify()
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected error %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestTornRecord(t *testing.T) {
+	l, path := testLog(t)
+	record(l, "rexle", http.MethodPut, "/v1/db/doc", "{}", http.StatusCreated)
+	record(l, "rexle", http.MethodDelete, "/v1/db/doc", "", http.StatusNoContent)
+	l.Close()
+
+	// a crash while appending leaves half a record
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, append(data, []byte("{\"seq\":3,\"time\":")...), 0600)
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected a torn record not to stop opening, got %v", err)
+	}
+	defer reopened.Close()
+	record(reopened, "rexle", http.MethodPut, "/v1/db/doc", "{}", http.StatusCreated)
+	count, err := reopened.Verify()
+	if count != 3 || !errors.Is(err, ErrTornRecord) {
+		t.Errorf("Expected 3 records and the torn one reported, got %d %v", count, err)
+	}
+
+	// the torn record is gone from the file
+	reopened.Close()
+	again, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected no error reopening the log, got %v", err)
+	}
+	defer again.Close()
+	if count, err := again.Verify(); count != 3 || err != nil {
+		t.Errorf("Expected 3 valid records after repairing, got %d %v", count, err)
+	}
+}
+
+func TestQueryEndpoint(t *testing.T) {
+	l, _ := testLog(t)
+	record(l, "rexle", http.MethodPut, "/v1/db/a", "{}", http.StatusCreated)    // 00:01
+	record(l, "other", http.MethodPut, "/v1/db/b", "{}", http.StatusCreated)    // 00:02
+	record(l, "rexle", http.MethodPut, "/v1/db/c", "{}", http.StatusCreated)    // 00:03
+	record(l, "rexle", http.MethodDelete, "/v1/db/a", "", http.StatusNoContent) // 00:04
+
+	query := func(target string) (int, []Record) {
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, http.NoBody))
+		var records []Record
+		json.Unmarshal(w.Body.Bytes(), &records)
+		return w.Code, records
+	}
+
+	if _, records := query("/admin/audit?user=rexle"); len(records) != 3 {
+		t.Errorf("Expected 3 records of rexle, got %d", len(records))
+	}
+	_, records := query("/admin/audit?user=rexle&from=2024-01-01T00:02:00Z&to=2024-01-01T00:04:00Z")
+	if len(records) != 1 || records[0].Path != "/v1/db/c" {
+		t.Errorf("Expected 1 record in the time range, got %+v", records)
+	}
+	if code, _ := query("/admin/audit?from=yesterday"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad time, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/audit/verify", http.NoBody))
+	if w.Body.String() != "{\"valid\":true,\"records\":4}" {
+		t.Errorf("Expected a valid log, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,300 @@
+package authentication
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
+)
+
+// A UserOutput describes a user to admins.
+type UserOutput struct {
+	Username string `json:"username"` // The username.
+	Disabled bool   `json:"disabled"` // Whether the user may not log in.
+	Sessions int    `json:"sessions"` // How many sessions the user has.
+}
+
+// A SessionOutput describes a session to admins, without its token.
+type SessionOutput struct {
+	ID       string    `json:"id"`       // Identifies the session for revoking it.
+	Username string    `json:"username"` // Who the session belongs to.
+	Expires  time.Time `json:"expires"`  // When the session expires.
+}
+
+// A userInput is the body of a request to create or change a user.
+type userInput struct {
+	Username string `json:"username"`           // The username, when creating a user.
+	Password string `json:"password,omitempty"` // The new password, if any.
+	Disabled *bool  `json:"disabled,omitempty"` // Whether to disable or enable the user, if given.
+}
+
+// Identify a session without revealing its token.
+func sessionID(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:8])
+}
+
+// Check whether a user may not log in.
+func (a *Authenticator) isDisabled(username string) bool {
+	a.mu.RLock()
+	disabled := a.disabled[username]
+	a.mu.RUnlock()
+	if !disabled && a.store != nil {
+		_, disabled = a.store.Lookup(username)
+	}
+	return disabled
+}
+
+// List the unexpired sessions, of one user or of everyone if empty, oldest expiry first.
+func (a *Authenticator) Sessions(username string) []SessionOutput {
+	now := a.now()
+	sessions := make([]SessionOutput, 0)
+	a.sessions.Range(func(token, value any) bool {
+		session := value.(sessionInfo)
+		if (username == "" || session.username == username) && session.expiration.After(now) {
+			sessions = append(sessions, SessionOutput{sessionID(token.(string)), session.username, session.expiration})
+		}
+		return true
+	})
+	slices.SortFunc(sessions, func(a, b SessionOutput) int {
+		return a.Expires.Compare(b.Expires)
+	})
+	return sessions
+}
+
+// Revoke the sessions with the given ID, or of the given user, along with their refresh tokens.
+// Returns how many were revoked.
+func (a *Authenticator) RevokeSessions(id, username string) int {
+	revoked := 0
+	a.sessions.Range(func(token, value any) bool {
+		session := value.(sessionInfo)
+		if (id != "" && sessionID(token.(string)) == id) || (username != "" && session.username == username) {
+			a.sessions.Delete(token)
+			if session.refreshToken != "" {
+				a.refreshTokens.Delete(session.refreshToken)
+			}
+			revoked++
+		}
+		return true
+	})
+
+	// refresh tokens whose sessions already ended could still start new ones
+	if username != "" {
+		a.refreshTokens.Range(func(token, value any) bool {
+			if value.(refreshInfo).username == username {
+				a.refreshTokens.Delete(token)
+			}
+			return true
+		})
+	}
+	slog.Info("authentication RevokeSessions: sessions revoked", "id", id, "username", username, "revoked", revoked)
+	return revoked
+}
+
+// Disable a user, ending their sessions, or enable them again.
+// Users in the user store stay disabled across restarts.
+func (a *Authenticator) SetDisabled(username string, disabled bool) error {
+	if a.store != nil {
+		if exists, _ := a.store.Lookup(username); exists {
+			err := a.store.SetDisabled(username, disabled)
+			if err == nil {
+				err = a.store.Save()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	a.mu.Lock()
+	if disabled {
+		a.disabled[username] = true
+	} else {
+		delete(a.disabled, username)
+	}
+	a.mu.Unlock()
+
+	if disabled {
+		a.RevokeSessions("", username)
+	}
+	return nil
+}
+
+// List every known user: those in the user store, those with installed tokens,
+// those disabled and those with sessions.
+func (a *Authenticator) Users() []UserOutput {
+	counts := make(map[string]int)
+	for _, session := range a.Sessions("") {
+		counts[session.Username]++
+	}
+
+	a.mu.RLock()
+	for username := range a.users {
+		counts[username] += 0
+	}
+	for username := range a.disabled {
+		counts[username] += 0
+	}
+	a.mu.RUnlock()
+	if a.store != nil {
+		for _, username := range a.store.Usernames() {
+			counts[username] += 0
+		}
+	}
+
+	users := make([]UserOutput, 0, len(counts))
+	for username, count := range counts {
+		users = append(users, UserOutput{username, a.isDisabled(username), count})
+	}
+	slices.SortFunc(users, func(a, b UserOutput) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+	return users
+}
+
+// Handle the admin API for users and sessions, expecting urls starting with "/auth/users" or "/auth/sessions".
+// The caller must check that the user is an admin.
+//
+//	GET    /auth/users              lists the users
+//	POST   /auth/users              creates a user in the user store, from {"username", "password"}
+//	PUT    /auth/users/<name>       changes the password or disables a user, from {"password", "disabled"}
+//	GET    /auth/sessions?user=     lists the sessions, of one user if given
+//	DELETE /auth/sessions/<id>      revokes a session
+//	DELETE /auth/sessions?user=     revokes every session of a user
+func (a *Authenticator) Admin() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		resource, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/auth/"), "/")
+		name = strings.TrimSuffix(name, "/")
+
+		switch {
+		case resource == "users" && r.Method == http.MethodGet && name == "":
+			writeJSON(w, http.StatusOK, a.Users())
+		case resource == "users" && r.Method == http.MethodPost && name == "":
+			a.createUser(w, r)
+		case resource == "users" && r.Method == http.MethodPut && name != "":
+			a.changeUser(w, r, name)
+		case resource == "sessions" && r.Method == http.MethodGet && name == "":
+			writeJSON(w, http.StatusOK, a.Sessions(r.URL.Query().Get("user")))
+		case resource == "sessions" && r.Method == http.MethodDelete && (name != "") != (r.URL.Query().Get("user") != ""):
+			revoked := a.RevokeSessions(name, r.URL.Query().Get("user"))
+			if name != "" && revoked == 0 {
+				errorMessage.ErrorResponse(w, "session not found", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			slog.Info("authentication Admin: unsupported request", "method", r.Method, "path", r.URL.Path)
+			errorMessage.ErrorResponse(w, fmt.Sprintf("unsupported method: %s", r.Method), http.StatusBadRequest)
+		}
+	})
+}
+
+// Create a user in the user store.
+func (a *Authenticator) createUser(w http.ResponseWriter, r *http.Request) {
+	input, ok := readUserInput(w, r)
+	if !ok {
+		return
+	}
+	if a.store == nil {
+		errorMessage.ErrorResponse(w, "no user file, users cannot be created", http.StatusBadRequest)
+		return
+	}
+	if exists, _ := a.store.Lookup(input.Username); exists {
+		errorMessage.ErrorResponse(w, "user already exists", http.StatusConflict)
+		return
+	}
+
+	err := a.store.SetPassword(input.Username, input.Password)
+	if err != nil {
+		errorMessage.ErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = a.store.Save()
+	if err != nil {
+		slog.Error("authentication createUser: could not save users", "error", err)
+		errorMessage.ErrorResponse(w, "could not save users", http.StatusInternalServerError)
+		return
+	}
+	if input.Disabled != nil && *input.Disabled {
+		a.SetDisabled(input.Username, true)
+	}
+
+	slog.Info("authentication createUser: user created", "username", input.Username)
+	writeJSON(w, http.StatusCreated, UserOutput{Username: input.Username, Disabled: a.isDisabled(input.Username)})
+}
+
+// Change the password of a user or disable them.
+func (a *Authenticator) changeUser(w http.ResponseWriter, r *http.Request, username string) {
+	input, ok := readUserInput(w, r)
+	if !ok {
+		return
+	}
+
+	if input.Password != "" {
+		if a.store == nil {
+			errorMessage.ErrorResponse(w, "no user file, passwords cannot be set", http.StatusBadRequest)
+			return
+		}
+		err := a.store.SetPassword(username, input.Password)
+		if err == nil {
+			err = a.store.Save()
+		}
+		if err != nil {
+			slog.Error("authentication changeUser: could not save users", "error", err)
+			errorMessage.ErrorResponse(w, "could not save users", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("authentication changeUser: password changed", "username", username)
+	}
+
+	if input.Disabled != nil {
+		err := a.SetDisabled(username, *input.Disabled)
+		if err != nil {
+			slog.Error("authentication changeUser: could not save users", "error", err)
+			errorMessage.ErrorResponse(w, "could not save users", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("authentication changeUser: user disabled", "username", username, "disabled", *input.Disabled)
+	}
+
+	writeJSON(w, http.StatusOK, UserOutput{username, a.isDisabled(username), len(a.Sessions(username))})
+}
+
+// Read the body of a request to create or change a user.
+// Returns false and writes an error if it is malformed.
+func readUserInput(w http.ResponseWriter, r *http.Request) (userInput, bool) {
+	var input userInput
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err == nil {
+		err = json.Unmarshal(body, &input)
+	}
+	if err != nil {
+		slog.Info("authentication readUserInput: invalid user", "error", err)
+		errorMessage.ErrorResponse(w, "invalid user format", http.StatusBadRequest)
+		return input, false
+	}
+	return input, true
+}
+
+// Write a value as the JSON body of a response.
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	jsonResponse, err := json.Marshal(value)
+	if err != nil {
+		// This should never happen
+		slog.Error("authentication writeJSON: error marshalling response", "error", err)
+		errorMessage.ErrorResponse(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
+}
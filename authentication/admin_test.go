@@ -0,0 +1,119 @@
+package authentication
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Send a request to the admin API and return the response.
+func adminRequest(authenticator *Authenticator, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	authenticator.Admin().ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+// test listing and revoking sessions
+func TestAdminSessions(t *testing.T) {
+	authenticator, _ := testAuthenticator(time.Hour, 0, false)
+	first := loginTokens(t, authenticator)["token"]
+	second := loginTokens(t, authenticator)["token"]
+	authenticator.InstallUsers(map[string]string{"other": "othertoken"})
+
+	w := adminRequest(authenticator, http.MethodGet, "/auth/sessions?user=rexle", "")
+	var sessions []SessionOutput
+	json.Unmarshal(w.Body.Bytes(), &sessions)
+	if w.Code != http.StatusOK || len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions for rexle, got %d %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), first) || strings.Contains(w.Body.String(), second) {
+		t.Errorf("Expected session tokens not to be listed, got %s", w.Body.String())
+	}
+
+	// revoke one session by its ID
+	w = adminRequest(authenticator, http.MethodDelete, "/auth/sessions/"+sessionID(first), "")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected revoking a session to give %d, got %d %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if validToken(authenticator, first) || !validToken(authenticator, second) {
+		t.Errorf("Expected only the revoked session to end")
+	}
+	w = adminRequest(authenticator, http.MethodDelete, "/auth/sessions/"+sessionID(first), "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected revoking a missing session to give %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// revoke every session of a user
+	w = adminRequest(authenticator, http.MethodDelete, "/auth/sessions?user=rexle", "")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected revoking sessions to give %d, got %d %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if validToken(authenticator, second) || !validToken(authenticator, "othertoken") {
+		t.Errorf("Expected only the sessions of rexle to end")
+	}
+}
+
+// test creating, listing and disabling users
+func TestAdminUsers(t *testing.T) {
+	authenticator, _ := testAuthenticator(time.Hour, time.Hour, false)
+	authenticator.SetUserStore(testUserStore(t))
+
+	w := adminRequest(authenticator, http.MethodPost, "/auth/users", "{\"username\":\"rexle\",\"password\":\"secret\"}")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected creating a user to give %d, got %d %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	w = adminRequest(authenticator, http.MethodPost, "/auth/users", "{\"username\":\"rexle\",\"password\":\"other\"}")
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected creating an existing user to give %d, got %d", http.StatusConflict, w.Code)
+	}
+
+	login := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		authenticator.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader("{\"username\":\"rexle\",\"password\":\"secret\"}")))
+		return w
+	}
+	var tokens map[string]string
+	w = login()
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the new user to log in, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = adminRequest(authenticator, http.MethodGet, "/auth/users", "")
+	expected := "[{\"username\":\"rexle\",\"disabled\":false,\"sessions\":1}]"
+	if w.Body.String() != expected {
+		t.Errorf("Expected users %s got %s", expected, w.Body.String())
+	}
+
+	// disabling a user ends their sessions and stops them logging in
+	w = adminRequest(authenticator, http.MethodPut, "/auth/users/rexle", "{\"disabled\":true}")
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected disabling a user to give %d, got %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if validToken(authenticator, tokens["token"]) {
+		t.Errorf("Expected the sessions of a disabled user to end")
+	}
+	if w, _ := refreshTokens(authenticator, tokens["refreshToken"]); w.Code == http.StatusOK {
+		t.Errorf("Expected the refresh tokens of a disabled user to be revoked")
+	}
+	if w = login(); w.Code != http.StatusUnauthorized || w.Body.String() != "\"account disabled\"" {
+		t.Errorf("Expected a disabled user not to log in, got %d %s", w.Code, w.Body.String())
+	}
+
+	// the user stays disabled after reloading the store
+	store, err := LoadUserStore(authenticator.store.path)
+	if err != nil {
+		t.Fatalf("Expected users to load, got %v", err)
+	}
+	if _, disabled := store.Lookup("rexle"); !disabled {
+		t.Errorf("Expected the user to be saved as disabled")
+	}
+
+	adminRequest(authenticator, http.MethodPut, "/auth/users/rexle", "{\"disabled\":false}")
+	if w = login(); w.Code != http.StatusOK {
+		t.Errorf("Expected an enabled user to log in, got %d %s", w.Code, w.Body.String())
+	}
+}
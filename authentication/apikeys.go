@@ -0,0 +1,397 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/rbac"
+)
+
+// The access an API key scope gives, and the prefix of every API key
+const (
+	ACCESS_READ    = "read"  // May only read
+	ACCESS_WRITE   = "write" // May read and write
+	API_KEY_PREFIX = "owk_"  // Starts every API key, telling them apart from other bearer tokens
+)
+
+// A Scope limits what an API key may do, to reading or writing a database, or the paths below a prefix in it.
+type Scope struct {
+	Access   string `json:"access"`           // "read" or "write".
+	Database string `json:"database"`         // The database, or "*" for every database.
+	Prefix   string `json:"prefix,omitempty"` // The path prefix within the database, such as "/doc/coll/", if any.
+}
+
+// An APIKey is a long-lived credential for a service account. Only the hash of the key is kept.
+type APIKey struct {
+	ID      string    `json:"id"`             // Identifies the key for revoking it.
+	Name    string    `json:"name"`           // What the key is for.
+	User    string    `json:"user"`           // The username requests made with the key act as.
+	Scopes  []Scope   `json:"scopes"`         // What the key may do; any one scope must allow a request.
+	Created time.Time `json:"created"`        // When the key was created.
+	Hash    string    `json:"hash,omitempty"` // The hex SHA-256 hash of the key.
+}
+
+// An APIKeys store holds the API keys, saving them to a file.
+type APIKeys struct {
+	path   string             // The file the keys are saved to, if any
+	keys   map[string]*APIKey // The keys by ID
+	byHash map[string]*APIKey // The keys by hash
+	mu     sync.RWMutex       // To protect access to above
+}
+
+// Create a new store without keys that saves to the file at the given path, if any.
+func NewAPIKeys(path string) *APIKeys {
+	return &APIKeys{path: path, keys: make(map[string]*APIKey), byHash: make(map[string]*APIKey)}
+}
+
+// Load the API keys from a file holding a JSON array of keys.
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*APIKey
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, err
+	}
+
+	store := NewAPIKeys(path)
+	for _, key := range keys {
+		err = checkAPIKey(key)
+		if err != nil {
+			return nil, err
+		}
+		store.keys[key.ID] = key
+		store.byHash[key.Hash] = key
+	}
+	return store, nil
+}
+
+// Create a new API key. Returns the key itself, which is not stored and cannot be shown again.
+func (k *APIKeys) Create(name, user string, scopes []Scope) (string, APIKey, error) {
+	if user == "" {
+		user = name
+	}
+	secret := make([]byte, 32)
+	id := make([]byte, 8)
+	_, err := rand.Read(secret)
+	if err == nil {
+		_, err = rand.Read(id)
+	}
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	token := API_KEY_PREFIX + base64.RawURLEncoding.EncodeToString(secret)
+	key := &APIKey{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		User:    user,
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+		Hash:    hashAPIKey(token),
+	}
+	err = checkAPIKey(key)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[key.ID] = key
+	k.byHash[key.Hash] = key
+	return token, *key, k.save()
+}
+
+// Revoke the API key with the given ID. Returns false if there is none.
+func (k *APIKeys) Revoke(id string) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, found := k.keys[id]
+	if !found {
+		return false, nil
+	}
+	delete(k.keys, id)
+	delete(k.byHash, key.Hash)
+	return true, k.save()
+}
+
+// List the API keys, without their hashes, oldest first.
+func (k *APIKeys) List() []APIKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make([]APIKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		listed := *key
+		listed.Hash = ""
+		keys = append(keys, listed)
+	}
+	slices.SortFunc(keys, func(a, b APIKey) int {
+		return a.Created.Compare(b.Created)
+	})
+	return keys
+}
+
+// Check whether the API key with the given ID acts as the user.
+func (k *APIKeys) actsAs(id, username string) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, found := k.keys[id]
+	return found && key.User == username
+}
+
+// Find the API key matching a key sent by a client.
+func (k *APIKeys) lookup(token string) (APIKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, found := k.byHash[hashAPIKey(token)]
+	if !found {
+		return APIKey{}, false
+	}
+	return *key, true
+}
+
+// Check whether one of the scopes of a key allows the request.
+// Copies and moves must also be allowed to write their destination.
+func (key APIKey) allows(r *http.Request) bool {
+	write := r.Method != http.MethodGet && r.Method != http.MethodOptions
+	if !key.allowsPath(rbac.TargetPath(r), write) {
+		return false
+	}
+	mode := r.URL.Query().Get("mode")
+	if r.Method == http.MethodPost && (mode == "copy" || mode == "move") {
+		return key.allowsPath(r.URL.Query().Get("to"), true)
+	}
+	return true
+}
+
+// Check whether one of the scopes of a key allows reading, or writing, the path.
+func (key APIKey) allowsPath(path string, write bool) bool {
+	for _, scope := range key.Scopes {
+		if write && scope.Access != ACCESS_WRITE {
+			continue
+		}
+		if rbac.Covers(path, scope.Database, scope.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate requests with API keys, sent as "Authorization: ApiKey <key>" or as
+// bearer tokens, and hand every other request to the given authenticator.
+func (k *APIKeys) Authenticate(next interfaces.Authenticator) interfaces.Authenticator {
+	return apiKeyAuthenticator{keys: k, next: next}
+}
+
+// An apiKeyAuthenticator validates API keys before falling back to another authenticator.
+type apiKeyAuthenticator struct {
+	keys *APIKeys                 // The API keys
+	next interfaces.Authenticator // Validates everything else
+}
+
+// Validate an API key and its scopes, and return the username of its service account.
+func (a apiKeyAuthenticator) ValidateToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	isKey := strings.EqualFold(scheme, "apikey") ||
+		(strings.EqualFold(scheme, "bearer") && strings.HasPrefix(token, API_KEY_PREFIX))
+	if !isKey {
+		return a.next.ValidateToken(w, r)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	key, found := a.keys.lookup(token)
+	if !found {
+		slog.Info("ValidateToken: API key not found")
+		errorMessage.ErrorResponse(w, "invalid API key", http.StatusUnauthorized)
+		return "", false
+	}
+	if !key.allows(r) {
+		slog.Info("ValidateToken: request outside API key scopes", "id", key.ID, "method", r.Method, "path", r.URL.Path)
+		errorMessage.ErrorResponse(w, "forbidden: request outside API key scopes", http.StatusForbidden)
+		return "", false
+	}
+	return key.User, true
+}
+
+// A apiKeyInput is the body of a request to create an API key.
+type apiKeyInput struct {
+	Name   string  `json:"name"`   // What the key is for.
+	User   string  `json:"user"`   // The username the key acts as; the name if empty.
+	Scopes []Scope `json:"scopes"` // What the key may do.
+}
+
+// ServeHTTP implements the http.Handler interface for managing API keys,
+// expecting urls "/auth/apikeys" and "/auth/apikeys/<id>". GET lists the keys,
+// POST creates one and returns it once, and DELETE on a key revokes it.
+// Every key may be managed, so the handler must only be reachable by admins.
+func (k *APIKeys) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.serve(w, r, "", true)
+}
+
+// Manage wraps the API key endpoints so that any authenticated user may use them.
+// Admins manage every key, everyone else only the keys acting as themselves.
+func (k *APIKeys) Manage(authenticator interfaces.Authenticator, isAdmin func(string) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, valid := authenticator.ValidateToken(w, r)
+		if !valid {
+			return
+		}
+		k.serve(w, r, username, isAdmin(username))
+	})
+}
+
+// Serve a request managing API keys for the caller. Keys created by
+// callers who are not admins act as the caller, whatever user they name.
+func (k *APIKeys) serve(w http.ResponseWriter, r *http.Request, caller string, admin bool) {
+	w.Header().Set("Content-Type", "application/json")
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/auth/apikeys"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		keys := k.List()
+		if !admin {
+			keys = slices.DeleteFunc(keys, func(key APIKey) bool { return key.User != caller })
+		}
+		jsonResponse, _ := json.Marshal(keys)
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResponse)
+	case r.Method == http.MethodPost && id == "":
+		var input apiKeyInput
+		body, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err == nil {
+			err = json.Unmarshal(body, &input)
+		}
+		if err != nil {
+			slog.Info("authentication ServeHTTP: invalid API key request", "error", err)
+			errorMessage.ErrorResponse(w, "invalid API key format", http.StatusBadRequest)
+			return
+		}
+
+		if !admin {
+			input.User = caller
+		}
+		token, key, err := k.Create(input.Name, input.User, input.Scopes)
+		if err != nil {
+			slog.Info("authentication ServeHTTP: could not create API key", "error", err)
+			errorMessage.ErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("authentication ServeHTTP: API key created", "id", key.ID, "name", key.Name, "user", key.User)
+
+		key.Hash = ""
+		jsonResponse, _ := json.Marshal(struct {
+			APIKey
+			Key string `json:"key"`
+		}{key, token})
+		w.WriteHeader(http.StatusCreated)
+		w.Write(jsonResponse)
+	case r.Method == http.MethodDelete && id != "":
+		if !admin && !k.actsAs(id, caller) {
+			errorMessage.ErrorResponse(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		found, err := k.Revoke(id)
+		if err != nil {
+			slog.Error("authentication ServeHTTP: could not save API keys", "error", err)
+			errorMessage.ErrorResponse(w, "could not save API keys", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			errorMessage.ErrorResponse(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		slog.Info("authentication ServeHTTP: API key revoked", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		slog.Info("authentication ServeHTTP: unsupported API key request", "method", r.Method, "path", r.URL.Path)
+		errorMessage.ErrorResponse(w, fmt.Sprintf("unsupported method: %s", r.Method), http.StatusBadRequest)
+	}
+}
+
+// Hash an API key for storing and looking it up.
+func hashAPIKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Check that an API key has a name, a hash and valid scopes.
+func checkAPIKey(key *APIKey) error {
+	if key.Name == "" || key.User == "" {
+		return errors.New("API key needs a name")
+	}
+	if key.ID == "" || key.Hash == "" {
+		return errors.New("malformed API key")
+	}
+	if len(key.Scopes) == 0 {
+		return errors.New("API key needs at least one scope")
+	}
+	for _, scope := range key.Scopes {
+		if scope.Access != ACCESS_READ && scope.Access != ACCESS_WRITE {
+			return fmt.Errorf("unknown access %s", scope.Access)
+		}
+		if scope.Database == "" {
+			return errors.New("API key scope needs a database")
+		}
+		if scope.Prefix != "" && !strings.HasPrefix(scope.Prefix, "/") {
+			return errors.New("API key scope prefix must start with /")
+		}
+	}
+	return nil
+}
+
+// Save the keys to the file of the store, if any, readable only by its owner.
+// The caller must hold the lock.
+func (k *APIKeys) save() error {
+	if k.path == "" {
+		return nil
+	}
+
+	keys := make([]*APIKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// replace the file at once so that readers never see partial keys
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), ".apikeys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tmp.Name(), k.path)
+}
@@ -0,0 +1,178 @@
+package authentication
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// An authenticator for testing that accepts every request as rexle.
+type acceptAll struct{}
+
+func (acceptAll) ValidateToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	return "rexle", true
+}
+
+// Validate a request made with the given Authorization header.
+func validateKey(authenticator interface {
+	ValidateToken(http.ResponseWriter, *http.Request) (string, bool)
+}, method, target, authorization string) (string, int) {
+	req := httptest.NewRequest(method, target, http.NoBody)
+	req.Header.Set("Authorization", authorization)
+	w := httptest.NewRecorder()
+	username, valid := authenticator.ValidateToken(w, req)
+	if !valid {
+		return "", w.Code
+	}
+	return username, http.StatusOK
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	keys := NewAPIKeys("")
+	key, _, err := keys.Create("indexer", "", []Scope{
+		{Access: ACCESS_READ, Database: "*"},
+		{Access: ACCESS_WRITE, Database: "db1", Prefix: "/doc/coll/"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error creating a key, got %v", err)
+	}
+	authenticator := keys.Authenticate(acceptAll{})
+
+	data := []struct {
+		method, target, authorization string
+		username                      string
+		code                          int
+	}{
+		{http.MethodGet, "/v1/db2/doc", "ApiKey " + key, "indexer", http.StatusOK},
+		{http.MethodGet, "/v1/db2/doc", "Bearer " + key, "indexer", http.StatusOK},
+		{http.MethodPut, "/v1/db2/doc", "ApiKey " + key, "", http.StatusForbidden},
+		{http.MethodPut, "/v1/db1/doc", "ApiKey " + key, "", http.StatusForbidden},
+		{http.MethodPut, "/v1/db1/doc/coll/a", "ApiKey " + key, "indexer", http.StatusOK},
+		{http.MethodPost, "/v1/db1/doc/coll/a?mode=copy&to=/v1/db1/doc/coll/b", "ApiKey " + key, "indexer", http.StatusOK},
+		{http.MethodPost, "/v1/db1/doc/coll/a?mode=copy&to=/v1/db2/b", "ApiKey " + key, "", http.StatusForbidden},
+		{http.MethodGet, "/v1/db1/doc", "ApiKey owk_wrong", "", http.StatusUnauthorized},
+		// other tokens go to the other authenticator
+		{http.MethodPut, "/v1/db1/doc", "Bearer session", "rexle", http.StatusOK},
+	}
+	for i, d := range data {
+		username, code := validateKey(authenticator, d.method, d.target, d.authorization)
+		if username != d.username || code != d.code {
+			t.Errorf("Test %d: Expected %q %d got %q %d", i, d.username, d.code, username, code)
+		}
+	}
+}
+
+// test that the legacy subscribe endpoint is scoped by the database it names
+func TestAPIKeyLegacySubscribe(t *testing.T) {
+	keys := NewAPIKeys("")
+	key, _, _ := keys.Create("reader", "", []Scope{{Access: ACCESS_READ, Database: "db1"}})
+	authenticator := keys.Authenticate(acceptAll{})
+
+	if _, code := validateKey(authenticator, http.MethodGet, "/v1/subscribe?collection=db1", "ApiKey "+key); code != http.StatusOK {
+		t.Errorf("Expected subscribing to db1 to be allowed, got %d", code)
+	}
+	if _, code := validateKey(authenticator, http.MethodGet, "/v1/subscribe?collection=db2", "ApiKey "+key); code != http.StatusForbidden {
+		t.Errorf("Expected subscribing to db2 to be forbidden, got %d", code)
+	}
+}
+
+func TestAPIKeyEndpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.json")
+	keys := NewAPIKeys(path)
+
+	w := httptest.NewRecorder()
+	keys.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth/apikeys",
+		strings.NewReader("{\"name\":\"backup\",\"scopes\":[{\"access\":\"read\",\"database\":\"db1\"}]}")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 creating a key, got %d %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		ID   string `json:"id"`
+		User string `json:"user"`
+		Key  string `json:"key"`
+		Hash string `json:"hash"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.User != "backup" || !strings.HasPrefix(created.Key, API_KEY_PREFIX) || created.Hash != "" {
+		t.Errorf("Expected the new key without its hash, got %s", w.Body.String())
+	}
+
+	bad := []string{
+		"{\"name\":\"backup\",\"scopes\":[]}",
+		"{\"name\":\"backup\",\"scopes\":[{\"access\":\"all\",\"database\":\"db1\"}]}",
+		"{\"scopes\":[{\"access\":\"read\",\"database\":\"db1\"}]}",
+		"not json",
+	}
+	for i, body := range bad {
+		w = httptest.NewRecorder()
+		keys.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth/apikeys", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Test %d: Expected 400 for an invalid key, got %d", i, w.Code)
+		}
+	}
+
+	// the key is saved hashed and works after loading
+	loaded, err := LoadAPIKeys(path)
+	if err != nil {
+		t.Fatalf("Expected no error loading keys, got %v", err)
+	}
+	if username, _ := validateKey(loaded.Authenticate(acceptAll{}), http.MethodGet, "/v1/db1/", "ApiKey "+created.Key); username != "backup" {
+		t.Errorf("Expected the loaded key to work, got %q", username)
+	}
+
+	w = httptest.NewRecorder()
+	keys.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/apikeys", http.NoBody))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "hash") || !strings.Contains(w.Body.String(), created.ID) {
+		t.Errorf("Expected the key to be listed without its hash, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	keys.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/auth/apikeys/"+created.ID, http.NoBody))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 revoking the key, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	keys.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/auth/apikeys/"+created.ID, http.NoBody))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 revoking a missing key, got %d", w.Code)
+	}
+	if _, code := validateKey(keys.Authenticate(acceptAll{}), http.MethodGet, "/v1/db1/", "ApiKey "+created.Key); code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked key to be rejected, got %d", code)
+	}
+}
+
+func TestAPIKeyManage(t *testing.T) {
+	keys := NewAPIKeys("")
+	_, other, _ := keys.Create("backup", "root", []Scope{{Access: ACCESS_WRITE, Database: "*"}})
+	manage := keys.Manage(acceptAll{}, func(username string) bool { return username == "root" })
+
+	// callers who are not admins only get keys acting as themselves
+	w := httptest.NewRecorder()
+	manage.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth/apikeys",
+		strings.NewReader("{\"name\":\"indexer\",\"user\":\"root\",\"scopes\":[{\"access\":\"write\",\"database\":\"*\"}]}")))
+	var created APIKey
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if w.Code != http.StatusCreated || created.User != "rexle" {
+		t.Errorf("Expected a key acting as the caller, got %d %s", w.Code, w.Body.String())
+	}
+
+	// and only see and revoke their own keys
+	w = httptest.NewRecorder()
+	manage.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/apikeys", http.NoBody))
+	if !strings.Contains(w.Body.String(), created.ID) || strings.Contains(w.Body.String(), other.ID) {
+		t.Errorf("Expected only the caller's keys, got %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	manage.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/auth/apikeys/"+other.ID, http.NoBody))
+	if w.Code != http.StatusNotFound || len(keys.List()) != 2 {
+		t.Errorf("Expected 404 revoking another user's key, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	manage.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/auth/apikeys/"+created.ID, http.NoBody))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 revoking the caller's key, got %d", w.Code)
+	}
+}
@@ -14,47 +14,101 @@ import (
 	"sync"
 	"time"
 
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/audit"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/handlers"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
 )
 
 // A concurrency-safe map to store for user sessions
 type Authenticator struct {
-	sessions *sync.Map
-	users    map[string]string //mapping username to pw
+	sessions      *sync.Map
+	refreshTokens *sync.Map          // The refresh tokens, mapped to their refreshInfo
+	users         map[string]string  //mapping username to pw
+	disabled      map[string]bool    // The users who may not log in
+	mu            *sync.RWMutex      // To protect access to users and disabled
+	store         *UserStore         // The password hashes logins are checked against, if any
+	ttl           time.Duration      // How long a session lasts
+	refreshTTL    time.Duration      // How long a refresh token lasts, or 0 if they are disabled
+	auditor       interfaces.Auditor // Records logins and logouts, if set
+	sliding       bool               // Whether using a session extends it
+	now           func() time.Time   // The clock, for expirations
 }
 
 // A struct to represent a user session
 type sessionInfo struct {
-	username   string
-	expiration time.Time
+	username     string
+	expiration   time.Time
+	refreshToken string // The refresh token issued with the session, if any
 }
 
 // Initialize a new Authenticator
 func NewAuthenticator() Authenticator {
 	return Authenticator{
-		sessions: &sync.Map{},
-		users:    make(map[string]string), //initializing users map
+		sessions:      &sync.Map{},
+		refreshTokens: &sync.Map{},
+		users:         make(map[string]string), //initializing users map
+		disabled:      make(map[string]bool),
+		mu:            &sync.RWMutex{},
+		ttl:           DEFAULT_SESSION_TTL,
+		now:           time.Now,
 	}
 }
 
 // Install a map from username to login tokens in the Authenticator.
-// The users' sessions will last for 24 hours.
+// The users' sessions will last for the session lifetime.
 func (a *Authenticator) InstallUsers(users map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	// Iterate over the users map and store each user and their token in the sessions map
 	for user, token := range users {
-		a.sessions.Store(token, sessionInfo{user, time.Now().Add(24 * time.Hour)})
+		a.sessions.Store(token, sessionInfo{username: user, expiration: a.now().Add(a.ttl)})
 		a.users[user] = token
 	}
 }
 
+// Replace the installed login tokens with those in the given map, such as after the token
+// file is reloaded. Tokens no longer in the map are revoked, and new ones are installed.
+func (a *Authenticator) ReloadUsers(users map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for user, token := range a.users {
+		if users[user] != token {
+			a.sessions.Delete(token)
+			slog.Info("ReloadUsers: token revoked", "username", user)
+		}
+	}
+	installed := make(map[string]string, len(users))
+	for user, token := range users {
+		if a.users[user] != token {
+			a.sessions.Store(token, sessionInfo{username: user, expiration: a.now().Add(a.ttl)})
+			slog.Info("ReloadUsers: token installed", "username", user)
+		}
+		installed[user] = token
+	}
+	a.users = installed
+}
+
+// Check logins against the passwords in the given user store.
+// Without a store, anyone may log in under any username.
+func (a *Authenticator) SetUserStore(store *UserStore) {
+	a.store = store
+}
+
 // ServeHTTP implements the http.Handler interface for the Authenticator
 func (a *Authenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/auth/refresh" && r.Method == http.MethodPost {
+		a.refresh(w, r)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodPost:
-		a.login(w, r)
+		auditRequest(a.auditor, w, r, a.login)
 	case http.MethodDelete:
-		a.logout(w, r)
+		auditRequest(a.auditor, w, r, a.logout)
 	case http.MethodOptions:
 		handlers.Options(w, r)
 	default:
@@ -65,6 +119,23 @@ func (a *Authenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Record logins and logouts with the given auditor.
+func (a *Authenticator) SetAuditor(auditor interfaces.Auditor) {
+	a.auditor = auditor
+}
+
+// Handle a login or logout, recording it with the auditor if there is one.
+// Bodies are not recorded, not even hashed, as they hold passwords.
+func auditRequest(auditor interfaces.Auditor, w http.ResponseWriter, r *http.Request, handle func(w http.ResponseWriter, r *http.Request) string) {
+	if auditor == nil {
+		handle(w, r)
+		return
+	}
+	recorder := audit.NewStatusWriter(w)
+	username := handle(recorder, r)
+	auditor.Audit(r, username, recorder.Status(), nil)
+}
+
 // Generate a pseudo-random token for a user
 func generateToken() (string, error) {
 	// Generate a random 32-byte token
@@ -83,32 +154,31 @@ func generateToken() (string, error) {
 func (a *Authenticator) ValidateToken(w http.ResponseWriter, r *http.Request) (string, bool) {
 	w.Header().Set("Content-Type", "application/json")
 
-	// Check if the token is missing
-	inputAuth := r.Header.Get("Authorization")
-	components := strings.SplitN(inputAuth, " ", 2)
-	slog.Info("Validating request", "components", components)
-
-	if len(components) != 2 || strings.ToLower(components[0]) != "bearer" || components[1] == "" {
-		// Missing, or the invalid token format
-		slog.Info("ValidateToken: missing or invalid bearer token format", "token", inputAuth)
-		errorMessage.ErrorResponse(w, "missing or invalid bearer token format", http.StatusUnauthorized)
+	token, ok := bearerToken(w, r)
+	if !ok {
 		return "", false
 	}
 
-	token := components[1]
-
 	// Validate the token and check the expiration date
 	userInfo, ok := a.sessions.Load(token)
 	if ok {
-		if !userInfo.(sessionInfo).expiration.After(time.Now()) {
+		session := userInfo.(sessionInfo)
+		if !session.expiration.After(a.now()) {
 			// Token has expired
 			slog.Info("ValidateToken: token expired", "token", token)
+			a.sessions.Delete(token)
 			errorMessage.ErrorResponse(w, "token expired", http.StatusUnauthorized)
 			return "", false
 		} else {
 			// Token is valid
 			slog.Info("ValidateToken: token valid", "token", token)
-			return userInfo.(sessionInfo).username, true
+			if a.sliding {
+				// extend the session, unless it was just logged out or refreshed
+				extended := session
+				extended.expiration = a.now().Add(a.ttl)
+				a.sessions.CompareAndSwap(token, session, extended)
+			}
+			return session.username, true
 		}
 	} else {
 		// Token not found
@@ -118,79 +188,130 @@ func (a *Authenticator) ValidateToken(w http.ResponseWriter, r *http.Request) (s
 	}
 }
 
+// Get the bearer token from the Authorization header of a request.
+// Returns false after writing an error if it is missing.
+func bearerToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	// Check if the token is missing
+	inputAuth := r.Header.Get("Authorization")
+	components := strings.SplitN(inputAuth, " ", 2)
+	slog.Info("Validating request", "components", components)
+
+	if len(components) != 2 || strings.ToLower(components[0]) != "bearer" || components[1] == "" {
+		// Missing, or the invalid token format
+		slog.Info("ValidateToken: missing or invalid bearer token format", "token", inputAuth)
+		errorMessage.ErrorResponse(w, "missing or invalid bearer token format", http.StatusUnauthorized)
+		return "", false
+	}
+	return components[1], true
+}
+
 // Login the user and return a token
-func (a *Authenticator) login(w http.ResponseWriter, r *http.Request) {
+func (a *Authenticator) login(w http.ResponseWriter, r *http.Request) string {
 	// Set the header for JSON response
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	// Read the request body
-	body, err := io.ReadAll(r.Body)
-	defer r.Body.Close()
-	if err != nil {
-		slog.Error("Login: error reading request body", "error", err)
-		errorMessage.ErrorResponse(w, "error reading request body", http.StatusBadRequest)
-		return
-	}
-
-	// Parse the request body to get username and password
-	var credentials map[string]string
-	if err := json.Unmarshal(body, &credentials); err != nil {
-		slog.Error("Login: error unmarshalling request body", "error", err)
-		errorMessage.ErrorResponse(w, "error unmarshalling request body", http.StatusBadRequest)
-		return
+	username, ok := checkCredentials(w, r, a.store)
+	if !ok {
+		return username
 	}
-
-	username := credentials["username"]
-	if username == "" {
-		slog.Error("Login: missing username")
-		errorMessage.ErrorResponse(w, "missing username", http.StatusBadRequest)
-		return
+	if a.isDisabled(username) {
+		slog.Info("Login: account disabled", "username", username)
+		errorMessage.ErrorResponse(w, "account disabled", http.StatusUnauthorized)
+		return username
 	}
 
-	// Generate a token for the user
-	token, err := generateToken()
+	// Start a session for the user
+	tokens, err := a.startSession(username)
 	if err != nil {
 		// This should not happen, but handle it just in case
 		slog.Error("Login: error generating token", "error", err)
 		errorMessage.ErrorResponse(w, "error generating token", http.StatusInternalServerError)
-		return
+		return username
 	}
 
-	// Add the user session to the Authenticator
-	a.sessions.Store(token, sessionInfo{username, time.Now().Add(24 * time.Hour)})
-
 	// Return the token in the response
-	jsonToken, err := json.Marshal(map[string]string{"token": token})
+	jsonToken, err := json.Marshal(tokens)
 	if err != nil {
 		slog.Error("Login: error marshalling token response", "error", err)
 		errorMessage.ErrorResponse(w, "error marshalling token response", http.StatusInternalServerError)
-		return
+		return username
 	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonToken)
 	slog.Info("Login: successful", "username", username)
+	return username
 }
 
 // Logout the user by invalidating the token
-func (a *Authenticator) logout(w http.ResponseWriter, r *http.Request) {
+func (a *Authenticator) logout(w http.ResponseWriter, r *http.Request) string {
 	// Set the header for JSON response
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	slog.Info("Logout: request received")
 
-	_, isValidToken := a.ValidateToken(w, r)
+	username, isValidToken := a.ValidateToken(w, r)
 	if isValidToken {
 		// If the token is valid, remove it from the sessions
 		inputAuth := r.Header.Get("Authorization")
 		components := strings.SplitN(inputAuth, " ", 2)
 		token := components[1]
-		a.sessions.Delete(token)
+		session, found := a.sessions.LoadAndDelete(token)
+		if found && session.(sessionInfo).refreshToken != "" {
+			a.refreshTokens.Delete(session.(sessionInfo).refreshToken)
+		}
 		slog.Info("Logout: successful", "token", token)
 		w.WriteHeader(http.StatusNoContent)
 		w.Write([]byte(`{"message": "Logout successful"}`))
 	} else {
 		slog.Info("Logout: invalid token")
 	}
+	return username
+}
+
+// Read the credentials of a login request and check the password if there is a user store.
+// Returns the username, and false after writing an error if the login fails.
+func checkCredentials(w http.ResponseWriter, r *http.Request, store *UserStore) (string, bool) {
+	// Read the request body
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		slog.Error("Login: error reading request body", "error", err)
+		errorMessage.ErrorResponse(w, "error reading request body", http.StatusBadRequest)
+		return "", false
+	}
+
+	// Parse the request body to get username and password
+	var credentials map[string]string
+	if err := json.Unmarshal(body, &credentials); err != nil {
+		slog.Error("Login: error unmarshalling request body", "error", err)
+		errorMessage.ErrorResponse(w, "error unmarshalling request body", http.StatusBadRequest)
+		return "", false
+	}
+
+	username := credentials["username"]
+	if username == "" {
+		slog.Error("Login: missing username")
+		errorMessage.ErrorResponse(w, "missing username", http.StatusBadRequest)
+		return "", false
+	}
+
+	// Check the password if there is a user store
+	if store != nil {
+		err := store.Verify(username, credentials["password"])
+		if err != nil {
+			slog.Info("Login: failed", "username", username, "error", err)
+			switch err.Error() {
+			case "account locked":
+				errorMessage.ErrorResponse(w, "account locked, try again later", http.StatusUnauthorized)
+			case "account disabled":
+				errorMessage.ErrorResponse(w, "account disabled", http.StatusUnauthorized)
+			default:
+				errorMessage.ErrorResponse(w, "invalid username or password", http.StatusUnauthorized)
+			}
+			return username, false
+		}
+	}
+	return username, true
 }
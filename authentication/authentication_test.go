@@ -2,6 +2,7 @@ package authentication
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -229,3 +230,37 @@ func TestLogoutInvalidToken(t *testing.T) {
 		t.Errorf("Expected error code %d got %d", http.StatusUnauthorized, res.StatusCode)
 	}
 }
+
+// An auditor for testing that remembers what it was told.
+type recordingAuditor struct {
+	records []string
+}
+
+func (a *recordingAuditor) Audit(r *http.Request, username string, status int, body []byte) {
+	a.records = append(a.records, fmt.Sprintf("%s %s %d %d", r.Method, username, status, len(body)))
+}
+
+// test that logins, failed logins and logouts are audited without their bodies
+func TestLoginAndLogoutAudited(t *testing.T) {
+	store := testUserStore(t)
+	store.SetPassword("rexle", "secret")
+	auditor := &recordingAuditor{}
+	testAuthenticator := NewAuthenticator()
+	testAuthenticator.SetUserStore(store)
+	testAuthenticator.SetAuditor(auditor)
+
+	testAuthenticator.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader("{\"username\":\"rexle\",\"password\":\"wrong\"}")))
+	w := httptest.NewRecorder()
+	testAuthenticator.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader("{\"username\":\"rexle\",\"password\":\"secret\"}")))
+	var tokenMap map[string]string
+	json.Unmarshal(w.Body.Bytes(), &tokenMap)
+
+	req := httptest.NewRequest(http.MethodDelete, "/auth", http.NoBody)
+	req.Header.Set("Authorization", "Bearer "+tokenMap["token"])
+	testAuthenticator.ServeHTTP(httptest.NewRecorder(), req)
+
+	expected := []string{"POST rexle 401 0", "POST rexle 200 0", "DELETE rexle 204 0"}
+	if fmt.Sprint(auditor.records) != fmt.Sprint(expected) {
+		t.Errorf("Expected audit records %v, got %v", expected, auditor.records)
+	}
+}
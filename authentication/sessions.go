@@ -0,0 +1,148 @@
+package authentication
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
+)
+
+// Default session settings
+const (
+	DEFAULT_SESSION_TTL    = 24 * time.Hour // How long a session lasts by default
+	DEFAULT_SWEEP_INTERVAL = time.Minute    // How often expired sessions are removed by default
+)
+
+// A refreshInfo records who a refresh token was issued to and the session it belongs to.
+type refreshInfo struct {
+	username    string
+	expiration  time.Time
+	accessToken string // The session token issued with the refresh token
+}
+
+// Set how long sessions last and how long refresh tokens last, 0 disabling refresh tokens.
+// With sliding expiration, every request made with a session extends it by its lifetime.
+func (a *Authenticator) SetSessionLifetime(ttl, refreshTTL time.Duration, sliding bool) {
+	a.ttl = ttl
+	a.refreshTTL = refreshTTL
+	a.sliding = sliding
+}
+
+// Start a new session for the user, with a refresh token if they are enabled.
+// Returns the tokens to send to the user.
+func (a *Authenticator) startSession(username string) (map[string]string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	tokens := map[string]string{"token": token}
+
+	session := sessionInfo{username: username, expiration: a.now().Add(a.ttl)}
+	if a.refreshTTL > 0 {
+		refreshToken, err := generateToken()
+		if err != nil {
+			return nil, err
+		}
+		a.refreshTokens.Store(refreshToken, refreshInfo{username, a.now().Add(a.refreshTTL), token})
+		session.refreshToken = refreshToken
+		tokens["refreshToken"] = refreshToken
+	}
+
+	// Add the user session to the Authenticator
+	a.sessions.Store(token, session)
+	return tokens, nil
+}
+
+// Trade a refresh token, given as {"refreshToken": ...}, for a new session and refresh token.
+// The old refresh token and its session stop working, so a stolen refresh token is only good once.
+func (a *Authenticator) refresh(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	var request map[string]string
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil || request["refreshToken"] == "" {
+		slog.Info("Refresh: invalid request body", "error", err)
+		errorMessage.ErrorResponse(w, "missing refresh token", http.StatusBadRequest)
+		return
+	}
+
+	// Take the refresh token so that concurrent refreshes cannot both use it
+	value, found := a.refreshTokens.LoadAndDelete(request["refreshToken"])
+	if !found {
+		slog.Info("Refresh: refresh token not found")
+		errorMessage.ErrorResponse(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	info := value.(refreshInfo)
+	a.sessions.Delete(info.accessToken)
+	if !info.expiration.After(a.now()) {
+		slog.Info("Refresh: refresh token expired", "username", info.username)
+		errorMessage.ErrorResponse(w, "refresh token expired", http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := a.startSession(info.username)
+	if err != nil {
+		// This should not happen, but handle it just in case
+		slog.Error("Refresh: error generating token", "error", err)
+		errorMessage.ErrorResponse(w, "error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	jsonTokens, _ := json.Marshal(tokens)
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonTokens)
+	slog.Info("Refresh: successful", "username", info.username)
+}
+
+// Remove every expired session and refresh token.
+func (a *Authenticator) sweep() {
+	now := a.now()
+	removed := 0
+	a.sessions.Range(func(token, value any) bool {
+		session := value.(sessionInfo)
+		if !session.expiration.After(now) && a.sessions.CompareAndDelete(token, session) {
+			removed++
+		}
+		return true
+	})
+	a.refreshTokens.Range(func(token, value any) bool {
+		if !value.(refreshInfo).expiration.After(now) {
+			a.refreshTokens.Delete(token)
+			removed++
+		}
+		return true
+	})
+	if removed > 0 {
+		slog.Debug("authentication sweep: removed expired sessions", "removed", removed)
+	}
+}
+
+// Start removing expired sessions and refresh tokens at the given interval.
+// Returns a function that stops it.
+func (a *Authenticator) StartSweeper(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				a.sweep()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,181 @@
+package authentication
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A clock for testing that only moves when told to.
+type fakeClock struct {
+	current time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.current
+}
+
+// Create an authenticator with the given session lifetime and a fake clock.
+func testAuthenticator(ttl, refreshTTL time.Duration, sliding bool) (*Authenticator, *fakeClock) {
+	clock := &fakeClock{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	authenticator := NewAuthenticator()
+	authenticator.SetSessionLifetime(ttl, refreshTTL, sliding)
+	authenticator.now = clock.now
+	return &authenticator, clock
+}
+
+// Log in as rexle and return the tokens.
+func loginTokens(t *testing.T, authenticator *Authenticator) map[string]string {
+	w := httptest.NewRecorder()
+	authenticator.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader("{\"username\":\"rexle\"}")))
+	var tokens map[string]string
+	err := json.Unmarshal(w.Body.Bytes(), &tokens)
+	if w.Code != http.StatusOK || err != nil {
+		t.Fatalf("Expected login to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	return tokens
+}
+
+// Check whether a token is accepted.
+func validToken(authenticator *Authenticator, token string) bool {
+	req := httptest.NewRequest(http.MethodGet, "/v1/db", http.NoBody)
+	req.Header.Set("Authorization", "Bearer "+token)
+	_, valid := authenticator.ValidateToken(httptest.NewRecorder(), req)
+	return valid
+}
+
+// Trade a refresh token for new tokens.
+func refreshTokens(authenticator *Authenticator, refreshToken string) (*httptest.ResponseRecorder, map[string]string) {
+	w := httptest.NewRecorder()
+	body, _ := json.Marshal(map[string]string{"refreshToken": refreshToken})
+	authenticator.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth/refresh", strings.NewReader(string(body))))
+	var tokens map[string]string
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	return w, tokens
+}
+
+func TestSessionExpiry(t *testing.T) {
+	authenticator, clock := testAuthenticator(time.Hour, 0, false)
+	tokens := loginTokens(t, authenticator)
+	if _, hasRefresh := tokens["refreshToken"]; hasRefresh {
+		t.Errorf("Expected no refresh token when they are disabled, got %v", tokens)
+	}
+
+	clock.current = clock.current.Add(59 * time.Minute)
+	if !validToken(authenticator, tokens["token"]) {
+		t.Errorf("Expected the token to be valid before it expires")
+	}
+	clock.current = clock.current.Add(time.Minute)
+	if validToken(authenticator, tokens["token"]) {
+		t.Errorf("Expected the token to expire after its lifetime")
+	}
+}
+
+func TestSlidingSessions(t *testing.T) {
+	authenticator, clock := testAuthenticator(time.Hour, 0, true)
+	token := loginTokens(t, authenticator)["token"]
+
+	for i := 0; i < 3; i++ {
+		clock.current = clock.current.Add(50 * time.Minute)
+		if !validToken(authenticator, token) {
+			t.Fatalf("Expected using the token to extend it, failed after %d uses", i)
+		}
+	}
+	clock.current = clock.current.Add(time.Hour)
+	if validToken(authenticator, token) {
+		t.Errorf("Expected an unused token to expire")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	authenticator, clock := testAuthenticator(time.Hour, 24*time.Hour, false)
+	tokens := loginTokens(t, authenticator)
+
+	clock.current = clock.current.Add(2 * time.Hour)
+	w, refreshed := refreshTokens(authenticator, tokens["refreshToken"])
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected refresh to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	if !validToken(authenticator, refreshed["token"]) {
+		t.Errorf("Expected the refreshed token to be valid")
+	}
+
+	// refresh tokens are rotated, so the old one no longer works
+	w, _ = refreshTokens(authenticator, tokens["refreshToken"])
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a used refresh token to be rejected, got %d", w.Code)
+	}
+
+	// refreshing ends the session the refresh token was issued with
+	w, again := refreshTokens(authenticator, refreshed["refreshToken"])
+	if w.Code != http.StatusOK || validToken(authenticator, refreshed["token"]) {
+		t.Errorf("Expected refreshing to end the old session, got %d", w.Code)
+	}
+
+	// logging out also revokes the refresh token
+	req := httptest.NewRequest(http.MethodDelete, "/auth", http.NoBody)
+	req.Header.Set("Authorization", "Bearer "+again["token"])
+	authenticator.ServeHTTP(httptest.NewRecorder(), req)
+	w, _ = refreshTokens(authenticator, again["refreshToken"])
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the refresh token of a logged out session to be rejected, got %d", w.Code)
+	}
+
+	// expired refresh tokens are rejected
+	tokens = loginTokens(t, authenticator)
+	clock.current = clock.current.Add(24 * time.Hour)
+	w, _ = refreshTokens(authenticator, tokens["refreshToken"])
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an expired refresh token to be rejected, got %d", w.Code)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	authenticator, clock := testAuthenticator(time.Hour, 2*time.Hour, false)
+	loginTokens(t, authenticator)
+	clock.current = clock.current.Add(90 * time.Minute)
+	kept := loginTokens(t, authenticator)
+
+	count := func(m interface{ Range(func(any, any) bool) }) int {
+		n := 0
+		m.Range(func(any, any) bool {
+			n++
+			return true
+		})
+		return n
+	}
+
+	authenticator.sweep()
+	if n := count(authenticator.sessions); n != 1 {
+		t.Errorf("Expected 1 session after sweeping, got %d", n)
+	}
+	if n := count(authenticator.refreshTokens); n != 2 {
+		t.Errorf("Expected 2 refresh tokens after sweeping, got %d", n)
+	}
+
+	clock.current = clock.current.Add(2 * time.Hour)
+	authenticator.sweep()
+	if n := count(authenticator.sessions) + count(authenticator.refreshTokens); n != 0 {
+		t.Errorf("Expected everything to be swept, got %d", n)
+	}
+	if validToken(authenticator, kept["token"]) {
+		t.Errorf("Expected a swept token to be invalid")
+	}
+}
+
+// test that reloading the token file revokes removed tokens and installs new ones
+func TestReloadUsers(t *testing.T) {
+	authenticator, _ := testAuthenticator(time.Hour, 0, false)
+	authenticator.InstallUsers(map[string]string{"rexle": "token1", "other": "token2"})
+	login := loginTokens(t, authenticator)["token"]
+
+	authenticator.ReloadUsers(map[string]string{"rexle": "token1", "other": "token3", "new": "token4"})
+	for token, valid := range map[string]bool{"token1": true, "token2": false, "token3": true, "token4": true, login: true} {
+		if validToken(authenticator, token) != valid {
+			t.Errorf("Expected token %s valid to be %t", token, valid)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/handlers"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
+)
+
+// The smallest signing key accepted, in bytes
+const MIN_KEY_LENGTH = 32
+
+// A KeyRing holds the keys tokens are signed with, by key ID.
+// New tokens are signed with the current key; tokens signed with
+// any key in the ring are accepted, so keys can be rotated.
+type KeyRing struct {
+	Current string            `json:"current"` // The ID of the key new tokens are signed with.
+	Keys    map[string][]byte `json:"keys"`    // The keys by ID, base64 encoded in the file.
+}
+
+// Load a key ring from a JSON file such as {"current": "k2", "keys": {"k1": "<base64>", "k2": "<base64>"}}.
+func LoadKeyRing(path string) (*KeyRing, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ring KeyRing
+	err = json.Unmarshal(data, &ring)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := ring.Keys[ring.Current]; !found {
+		return nil, fmt.Errorf("current key %q not in key file", ring.Current)
+	}
+	for id, key := range ring.Keys {
+		if len(key) < MIN_KEY_LENGTH {
+			return nil, fmt.Errorf("key %q shorter than %d bytes", id, MIN_KEY_LENGTH)
+		}
+	}
+	return &ring, nil
+}
+
+// The header of a signed token
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// The claims carried by a signed token
+type tokenClaims struct {
+	Subject   string   `json:"sub"`             // The username.
+	Roles     []string `json:"roles,omitempty"` // The roles of the user when the token was issued.
+	IssuedAt  int64    `json:"iat"`             // When the token was issued, in Unix seconds.
+	ExpiresAt int64    `json:"exp"`             // When the token expires, in Unix seconds.
+}
+
+// A TokenAuthenticator issues and validates HMAC-SHA256 signed JSON Web Tokens.
+// It keeps no sessions, so any server sharing its keys accepts its tokens.
+type TokenAuthenticator struct {
+	keys    *atomic.Pointer[KeyRing]       // The signing keys
+	ttl     time.Duration                  // How long tokens last
+	store   *UserStore                     // The password hashes logins are checked against, if any
+	roles   func(username string) []string // Lists the roles put into tokens, if set
+	now     func() time.Time               // The clock, for expirations
+	auditor interfaces.Auditor             // Records logins and logouts, if set
+}
+
+// Create a new token authenticator signing with the given keys, issuing tokens that last for ttl.
+func NewTokenAuthenticator(keys *KeyRing, ttl time.Duration) *TokenAuthenticator {
+	a := &TokenAuthenticator{keys: &atomic.Pointer[KeyRing]{}, ttl: ttl, now: time.Now}
+	a.keys.Store(keys)
+	return a
+}
+
+// Replace the signing keys. Tokens signed with keys no longer in the ring stop being accepted.
+func (a *TokenAuthenticator) SetKeys(keys *KeyRing) {
+	a.keys.Store(keys)
+}
+
+// Check logins against the passwords in the given user store.
+// Without a store, anyone may log in under any username.
+func (a *TokenAuthenticator) SetUserStore(store *UserStore) {
+	a.store = store
+}
+
+// Put the roles the given function lists for a user into their tokens.
+func (a *TokenAuthenticator) SetRoleSource(roles func(username string) []string) {
+	a.roles = roles
+}
+
+// Record logins and logouts with the given auditor.
+func (a *TokenAuthenticator) SetAuditor(auditor interfaces.Auditor) {
+	a.auditor = auditor
+}
+
+// ServeHTTP implements the http.Handler interface for the TokenAuthenticator
+func (a *TokenAuthenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		auditRequest(a.auditor, w, r, a.login)
+	case http.MethodDelete:
+		auditRequest(a.auditor, w, r, a.logout)
+	case http.MethodOptions:
+		handlers.Options(w, r)
+	default:
+		// if user used method we do not support
+		slog.Info("User used unsupported method", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method: %s", r.Method)
+		errorMessage.ErrorResponse(w, msg, http.StatusBadRequest)
+	}
+}
+
+// Validate a signed token and return the username it was issued to if valid
+func (a *TokenAuthenticator) ValidateToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return "", false
+	}
+
+	claims, err := a.parse(token)
+	if err != nil {
+		slog.Info("ValidateToken: invalid signed token", "error", err)
+		errorMessage.ErrorResponse(w, err.Error(), http.StatusUnauthorized)
+		return "", false
+	}
+	return claims.Subject, true
+}
+
+// Login the user and return a signed token
+func (a *TokenAuthenticator) login(w http.ResponseWriter, r *http.Request) string {
+	// Set the header for JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	username, ok := checkCredentials(w, r, a.store)
+	if !ok {
+		return username
+	}
+
+	now := a.now()
+	claims := tokenClaims{Subject: username, IssuedAt: now.Unix(), ExpiresAt: now.Add(a.ttl).Unix()}
+	if a.roles != nil {
+		claims.Roles = a.roles(username)
+	}
+	token, err := a.sign(claims)
+	if err != nil {
+		// This should not happen, but handle it just in case
+		slog.Error("Login: error signing token", "error", err)
+		errorMessage.ErrorResponse(w, "error generating token", http.StatusInternalServerError)
+		return username
+	}
+
+	jsonToken, _ := json.Marshal(map[string]string{"token": token})
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonToken)
+	slog.Info("Login: successful", "username", username)
+	return username
+}
+
+// Logout the user. Signed tokens cannot be revoked, so this only checks
+// the token; clients must discard it, and it stays valid until it expires.
+func (a *TokenAuthenticator) logout(w http.ResponseWriter, r *http.Request) string {
+	// Set the header for JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	username, isValidToken := a.ValidateToken(w, r)
+	if isValidToken {
+		slog.Info("Logout: successful", "username", username)
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return username
+}
+
+// Sign the claims with the current key, giving a token "header.claims.signature."
+func (a *TokenAuthenticator) sign(claims tokenClaims) (string, error) {
+	keys := a.keys.Load()
+	header, err := json.Marshal(tokenHeader{Alg: "HS256", Typ: "JWT", Kid: keys.Current})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature(keys.Keys[keys.Current], signed)), nil
+}
+
+// Check the signature and expiry of a token and return its claims.
+func (a *TokenAuthenticator) parse(token string) (tokenClaims, error) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed token")
+	}
+
+	var header tokenHeader
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(headerJSON, &header)
+	}
+	if err != nil {
+		return claims, errors.New("malformed token")
+	}
+	// only accept the algorithm we sign with, so tokens cannot pick a weaker one
+	if header.Alg != "HS256" {
+		return claims, errors.New("unsupported token algorithm")
+	}
+	key, found := a.keys.Load().Keys[header.Kid]
+	if !found {
+		return claims, errors.New("unknown token key")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, signature(key, parts[0]+"."+parts[1])) {
+		return claims, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err == nil {
+		err = json.Unmarshal(payload, &claims)
+	}
+	if err != nil || claims.Subject == "" {
+		return claims, errors.New("malformed token")
+	}
+	if a.now().Unix() >= claims.ExpiresAt {
+		return claims, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+// Compute the HMAC-SHA256 signature of a message.
+func signature(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,136 @@
+package authentication
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a key ring for testing with the given key IDs, the last being current.
+func testKeyRing(ids ...string) *KeyRing {
+	ring := &KeyRing{Current: ids[len(ids)-1], Keys: make(map[string][]byte)}
+	for _, id := range ids {
+		ring.Keys[id] = bytes.Repeat([]byte(id), MIN_KEY_LENGTH)
+	}
+	return ring
+}
+
+// Log in to a token authenticator as rexle and return the token.
+func signedLogin(t *testing.T, authenticator *TokenAuthenticator) string {
+	w := httptest.NewRecorder()
+	authenticator.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader("{\"username\":\"rexle\"}")))
+	var tokens map[string]string
+	err := json.Unmarshal(w.Body.Bytes(), &tokens)
+	if w.Code != http.StatusOK || err != nil {
+		t.Fatalf("Expected login to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	return tokens["token"]
+}
+
+// Check a token against a token authenticator, returning the username and the error written if any.
+func validateSigned(authenticator *TokenAuthenticator, token string) (string, string) {
+	req := httptest.NewRequest(http.MethodGet, "/v1/db", http.NoBody)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	username, _ := authenticator.ValidateToken(w, req)
+	return username, w.Body.String()
+}
+
+func TestSignedTokens(t *testing.T) {
+	clock := &fakeClock{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	authenticator := NewTokenAuthenticator(testKeyRing("k1"), time.Hour)
+	authenticator.now = clock.now
+	authenticator.SetRoleSource(func(username string) []string { return []string{"writer:db1"} })
+
+	token := signedLogin(t, authenticator)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Expected a token with 3 parts, got %s", token)
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	expected := "{\"sub\":\"rexle\",\"roles\":[\"writer:db1\"],\"iat\":1704067200,\"exp\":1704070800}"
+	if string(payload) != expected {
+		t.Errorf("Expected claims %s got %s", expected, payload)
+	}
+
+	if username, _ := validateSigned(authenticator, token); username != "rexle" {
+		t.Errorf("Expected username rexle, got %q", username)
+	}
+
+	// another server with the same keys accepts the token
+	other := NewTokenAuthenticator(testKeyRing("k1"), time.Hour)
+	other.now = clock.now
+	if username, _ := validateSigned(other, token); username != "rexle" {
+		t.Errorf("Expected another server to accept the token, got %q", username)
+	}
+
+	// tampering with the claims breaks the signature
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte("{\"sub\":\"admin\",\"exp\":9999999999}")) + "." + parts[2]
+	if _, body := validateSigned(authenticator, forged); body != "\"invalid token signature\"" {
+		t.Errorf("Expected a forged token to be rejected, got %s", body)
+	}
+
+	// unsigned tokens are rejected
+	header := base64.RawURLEncoding.EncodeToString([]byte("{\"alg\":\"none\",\"kid\":\"k1\"}"))
+	if _, body := validateSigned(authenticator, header+"."+parts[1]+"."); body != "\"unsupported token algorithm\"" {
+		t.Errorf("Expected an unsigned token to be rejected, got %s", body)
+	}
+
+	clock.current = clock.current.Add(time.Hour)
+	if _, body := validateSigned(authenticator, token); body != "\"token expired\"" {
+		t.Errorf("Expected an expired token to be rejected, got %s", body)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	authenticator := NewTokenAuthenticator(testKeyRing("k1"), time.Hour)
+	oldToken := signedLogin(t, authenticator)
+
+	// tokens signed with the old key still work while it stays in the ring
+	authenticator.SetKeys(testKeyRing("k1", "k2"))
+	newToken := signedLogin(t, authenticator)
+	if !strings.HasPrefix(newToken, base64.RawURLEncoding.EncodeToString([]byte("{\"alg\":\"HS256\",\"typ\":\"JWT\",\"kid\":\"k2\"}"))) {
+		t.Errorf("Expected new tokens to be signed with the current key, got %s", newToken)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if username, body := validateSigned(authenticator, token); username != "rexle" {
+			t.Errorf("Expected token to be valid, got %s", body)
+		}
+	}
+
+	// and stop working once it is removed
+	authenticator.SetKeys(testKeyRing("k2"))
+	if _, body := validateSigned(authenticator, oldToken); body != "\"unknown token key\"" {
+		t.Errorf("Expected a token signed with a removed key to be rejected, got %s", body)
+	}
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	dir := t.TempDir()
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), MIN_KEY_LENGTH))
+	files := map[string]string{
+		"good.json":    "{\"current\":\"k1\",\"keys\":{\"k1\":\"" + key + "\"}}",
+		"missing.json": "{\"current\":\"k2\",\"keys\":{\"k1\":\"" + key + "\"}}",
+		"short.json":   "{\"current\":\"k1\",\"keys\":{\"k1\":\"c2hvcnQ=\"}}",
+	}
+	for name, contents := range files {
+		os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600)
+	}
+
+	ring, err := LoadKeyRing(filepath.Join(dir, "good.json"))
+	if err != nil || len(ring.Keys["k1"]) != MIN_KEY_LENGTH {
+		t.Errorf("Expected the key file to load, got %v", err)
+	}
+	for _, name := range []string{"missing.json", "short.json", "absent.json"} {
+		if _, err := LoadKeyRing(filepath.Join(dir, name)); err == nil {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+	}
+}
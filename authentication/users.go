@@ -0,0 +1,279 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Settings for password hashing and account lockout
+const (
+	PBKDF2_ITERATIONS = 600000           // The iterations of PBKDF2-HMAC-SHA256 for new passwords
+	SALT_LENGTH       = 16               // The length of a password salt in bytes
+	HASH_LENGTH       = 32               // The length of a password hash in bytes
+	MAX_FAILURES      = 5                // Failed logins in a row before an account is locked
+	LOCKOUT_DURATION  = 15 * time.Minute // How long a locked account stays locked
+)
+
+// A UserStore holds the salted password hashes of the users who may log in.
+// It is read from and saved to a JSON file mapping usernames to their records.
+type UserStore struct {
+	path       string                // The file the store is saved to
+	users      map[string]userRecord // The password records, by username
+	failures   map[string]*lockout   // The failed logins of each account
+	iterations int                   // The iterations used to hash new passwords
+	now        func() time.Time      // The clock, for lockouts
+	mu         sync.Mutex            // To protect access to above
+}
+
+// A userRecord stores the salted hash of a user's password.
+type userRecord struct {
+	Salt       string `json:"salt"`               // The base64 salt.
+	Hash       string `json:"hash"`               // The base64 PBKDF2-HMAC-SHA256 hash of the password.
+	Iterations int    `json:"iterations"`         // The iterations used to compute the hash.
+	Disabled   bool   `json:"disabled,omitempty"` // Whether the user may no longer log in.
+}
+
+// A lockout tracks the failed logins of an account.
+type lockout struct {
+	failures    int       // Failed logins in a row
+	lockedUntil time.Time // When the account unlocks, if it is locked
+}
+
+// Create a new empty user store that saves to the file at the given path.
+func NewUserStore(path string) *UserStore {
+	return &UserStore{
+		path:       path,
+		users:      make(map[string]userRecord),
+		failures:   make(map[string]*lockout),
+		iterations: PBKDF2_ITERATIONS,
+		now:        time.Now,
+	}
+}
+
+// Load the user store from the file at the given path.
+func LoadUserStore(path string) (*UserStore, error) {
+	store := NewUserStore(path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &store.users)
+	if err != nil {
+		return nil, err
+	}
+	if store.users == nil {
+		store.users = make(map[string]userRecord)
+	}
+	return store, nil
+}
+
+// Set the password of a user, adding the user if new. The store must be saved afterwards.
+func (s *UserStore) SetPassword(username, password string) error {
+	if username == "" || password == "" {
+		return errors.New("empty username or password")
+	}
+
+	salt := make([]byte, SALT_LENGTH)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+
+	hash := pbkdf2SHA256([]byte(password), salt, s.iterations, HASH_LENGTH)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[username] = userRecord{
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Hash:       base64.StdEncoding.EncodeToString(hash),
+		Iterations: s.iterations,
+		Disabled:   s.users[username].Disabled,
+	}
+	delete(s.failures, username)
+	return nil
+}
+
+// Disable a user, so that they may no longer log in, or enable them again.
+// The store must be saved afterwards.
+func (s *UserStore) SetDisabled(username string, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, exists := s.users[username]
+	if !exists {
+		return errors.New("unknown user")
+	}
+	record.Disabled = disabled
+	s.users[username] = record
+	return nil
+}
+
+// Check whether a user exists, and whether they are disabled.
+func (s *UserStore) Lookup(username string) (exists bool, disabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, exists := s.users[username]
+	return exists, record.Disabled
+}
+
+// List the usernames in the store.
+func (s *UserStore) Usernames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usernames := make([]string, 0, len(s.users))
+	for username := range s.users {
+		usernames = append(usernames, username)
+	}
+	return usernames
+}
+
+// Replace the password records with those of another store, such as one reloaded from the file.
+// Failed logins are still counted against accounts that remain.
+func (s *UserStore) Replace(other *UserStore) {
+	other.mu.Lock()
+	users := make(map[string]userRecord, len(other.users))
+	for username, record := range other.users {
+		users[username] = record
+	}
+	other.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = users
+	for username := range s.failures {
+		if _, exists := users[username]; !exists {
+			delete(s.failures, username)
+		}
+	}
+}
+
+// Save the user store to its file, readable only by its owner.
+// The file is replaced at once so that readers never see a partial store.
+func (s *UserStore) Save() error {
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".users-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Check the password of a user. Returns an error if the account is locked or the
+// credentials are wrong. Repeated failures lock the account for a while.
+func (s *UserStore) Verify(username, password string) error {
+	s.mu.Lock()
+	record, exists := s.users[username]
+	failed := s.failures[username]
+	locked := failed != nil && s.now().Before(failed.lockedUntil)
+	iterations := s.iterations
+	s.mu.Unlock()
+
+	if exists && locked {
+		slog.Info("authentication Verify: account locked", "username", username)
+		return errors.New("account locked")
+	}
+
+	if !exists {
+		// hash anyway so that unknown users take as long as known ones
+		pbkdf2SHA256([]byte(password), make([]byte, SALT_LENGTH), iterations, HASH_LENGTH)
+		return errors.New("invalid credentials")
+	}
+
+	salt, saltErr := base64.StdEncoding.DecodeString(record.Salt)
+	hash, hashErr := base64.StdEncoding.DecodeString(record.Hash)
+	if saltErr != nil || hashErr != nil {
+		slog.Error("authentication Verify: corrupt user record", "username", username)
+		return errors.New("invalid credentials")
+	}
+
+	// the hashing is slow on purpose, so it happens without holding the lock
+	computed := pbkdf2SHA256([]byte(password), salt, record.Iterations, len(hash))
+	matches := subtle.ConstantTimeCompare(computed, hash) == 1
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if matches {
+		delete(s.failures, username)
+		if s.users[username].Disabled {
+			// only told to those who know the password
+			return errors.New("account disabled")
+		}
+		return nil
+	}
+
+	failed = s.failures[username]
+	if failed == nil {
+		failed = &lockout{}
+		s.failures[username] = failed
+	}
+	failed.failures++
+	if failed.failures >= MAX_FAILURES {
+		slog.Info("authentication Verify: locking account", "username", username)
+		failed.failures = 0
+		failed.lockedUntil = s.now().Add(LOCKOUT_DURATION)
+	}
+	return errors.New("invalid credentials")
+}
+
+// Derive a key from a password with PBKDF2 (RFC 8018) using HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	key := make([]byte, 0, numBlocks*hashLen)
+	var blockIndex [4]byte
+	u := make([]byte, 0, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		// U1 = PRF(password, salt || INT(block))
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(blockIndex[:], uint32(block))
+		prf.Write(blockIndex[:])
+		u = prf.Sum(u[:0])
+
+		// T = U1 ^ U2 ^ ... ^ Uc
+		t := make([]byte, hashLen)
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,137 @@
+package authentication
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a user store with cheap hashing for tests
+func testUserStore(t *testing.T) *UserStore {
+	store := NewUserStore(filepath.Join(t.TempDir(), "users.json"))
+	store.iterations = 1000
+	return store
+}
+
+// test the key derivation against the PBKDF2-HMAC-SHA256 vectors of RFC 7914
+func TestPBKDF2SHA256(t *testing.T) {
+	key := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if hex.EncodeToString(key) != expected {
+		t.Errorf("Expected %s got %x", expected, key)
+	}
+
+	key = pbkdf2SHA256([]byte("Password"), []byte("NaCl"), 80000, 64)
+	expected = "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"
+	if hex.EncodeToString(key) != expected {
+		t.Errorf("Expected %s got %x", expected, key)
+	}
+}
+
+// test that passwords survive saving and loading, and are not stored in the clear
+func TestUserStoreSaveAndLoad(t *testing.T) {
+	store := testUserStore(t)
+	if err := store.SetPassword("rexle", "secret"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := store.SetPassword("", "secret"); err == nil {
+		t.Errorf("Expected an error for an empty username")
+	}
+	if err := store.Save(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	loaded, err := LoadUserStore(store.path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := loaded.Verify("rexle", "secret"); err != nil {
+		t.Errorf("Expected password to verify, got %v", err)
+	}
+	if err := loaded.Verify("rexle", "wrong"); err == nil {
+		t.Errorf("Expected wrong password to fail")
+	}
+	if err := loaded.Verify("nobody", "secret"); err == nil {
+		t.Errorf("Expected unknown user to fail")
+	}
+	if strings.Contains(loaded.users["rexle"].Hash, "secret") {
+		t.Errorf("Expected password to be hashed")
+	}
+
+	if _, err := LoadUserStore(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
+
+// test that repeated failures lock an account until the lockout ends
+func TestUserStoreLockout(t *testing.T) {
+	store := testUserStore(t)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	store.SetPassword("rexle", "secret")
+
+	for i := 0; i < MAX_FAILURES; i++ {
+		if err := store.Verify("rexle", "wrong"); err == nil || err.Error() != "invalid credentials" {
+			t.Fatalf("Attempt %d: expected invalid credentials, got %v", i, err)
+		}
+	}
+	if err := store.Verify("rexle", "secret"); err == nil || err.Error() != "account locked" {
+		t.Errorf("Expected account locked, got %v", err)
+	}
+
+	now = now.Add(LOCKOUT_DURATION)
+	if err := store.Verify("rexle", "secret"); err != nil {
+		t.Errorf("Expected account to unlock, got %v", err)
+	}
+}
+
+// test login against a user store
+func TestLoginWithUserStore(t *testing.T) {
+	store := testUserStore(t)
+	store.SetPassword("rexle", "secret")
+	testAuthenticator := NewAuthenticator()
+	testAuthenticator.SetUserStore(store)
+
+	data := []test{
+		{httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader("{\"username\":\"rexle\"}")),
+			httptest.NewRecorder(),
+			"\"invalid username or password\"", http.StatusUnauthorized},
+		{httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader("{\"username\":\"rexle\",\"password\":\"wrong\"}")),
+			httptest.NewRecorder(),
+			"\"invalid username or password\"", http.StatusUnauthorized},
+		{httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader("{\"username\":\"other\",\"password\":\"secret\"}")),
+			httptest.NewRecorder(),
+			"\"invalid username or password\"", http.StatusUnauthorized},
+		{httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader("{\"username\":\"rexle\",\"password\":\"secret\"}")),
+			httptest.NewRecorder(),
+			"", http.StatusOK},
+	}
+
+	for i, d := range data {
+		testAuthenticator.ServeHTTP(d.w, d.r)
+		if d.w.Code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d", i, d.code, d.w.Code)
+		}
+		if d.expected != "" && d.w.Body.String() != d.expected {
+			t.Errorf("Test %d: Expected response %s got %s", i, d.expected, d.w.Body.String())
+		}
+	}
+}
+
+// test that replacing a store swaps in the reloaded passwords
+func TestUserStoreReplace(t *testing.T) {
+	store := testUserStore(t)
+	store.SetPassword("rexle", "secret")
+	reloaded := testUserStore(t)
+	reloaded.SetPassword("rexle", "changed")
+	reloaded.SetPassword("other", "secret")
+
+	store.Replace(reloaded)
+	if store.Verify("rexle", "secret") == nil || store.Verify("rexle", "changed") != nil || store.Verify("other", "secret") != nil {
+		t.Errorf("Expected the reloaded passwords to replace the old ones")
+	}
+}
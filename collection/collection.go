@@ -5,8 +5,7 @@
 package collection
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -14,10 +13,14 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/filter"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/idgen"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/patcher"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/schemas"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/skiplist"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/structs"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/subscribe"
@@ -27,6 +30,10 @@ import (
 type Collection struct {
 	documents         *skiplist.SkipList[string, interfaces.IDocument] // The documents in this collection
 	subscriberManager *subscribe.SubscriberManager                     // The subscriber manager for this collection
+	ids               *idgen.Generators                                // The generators for names of posted documents
+	schema            *schemas.Holder                                  // The schema of this collection, if it has its own
+	ownership         *atomic.Value                                    // The ownership policy of this collection, if it has its own
+	creator           string                                           // The user who created this collection, if known
 }
 
 // Create a new collection
@@ -37,36 +44,79 @@ func New() Collection {
 	// the subscriber manager
 	subscriberManager := subscribe.NewSubscriberManager()
 
-	return Collection{&newSkipList, subscriberManager}
+	return Collection{documents: &newSkipList, subscriberManager: subscriberManager, ids: idgen.New(), schema: schemas.NewHolder(nil, nil), ownership: &atomic.Value{}}
+}
+
+// Get the schema of this collection and its JSON text, or nil if it has none of its own.
+func (c *Collection) GetSchema() (*jsonschema.Schema, []byte) {
+	return c.schema.Get()
+}
+
+// Get the ownership policy of this collection, or "" if it has none of its own.
+func (c *Collection) GetOwnership() string {
+	policy, _ := c.ownership.Load().(string)
+	return policy
+}
+
+// Set the ownership policy of this collection.
+// An empty policy makes the collection inherit the policy of its ancestors.
+func (c *Collection) SetOwnership(policy string) {
+	c.ownership.Store(policy)
+}
+
+// Get the user who created this collection, or "" if unknown.
+func (c *Collection) GetCreator() string {
+	return c.creator
+}
+
+// Set the user who created this collection, before it is stored.
+func (c *Collection) SetCreator(user string) {
+	c.creator = user
+}
+
+// Set the schema of this collection and its JSON text.
+// A nil schema makes the collection inherit the schema of its ancestors.
+func (c *Collection) SetSchema(schema *jsonschema.Schema, source []byte) {
+	c.schema.Set(schema, source)
+}
+
+// Set the strategy used to name documents posted to this collection.
+func (c *Collection) SetIDStrategy(strategy string) error {
+	return c.ids.SetStrategy(strategy)
 }
 
 // Handle a get request pointing to this collection
 func (c *Collection) GetDoc(w http.ResponseWriter, r *http.Request) {
+	c.GetDocFiltered(w, r, nil)
+}
+
+// Handle a get request pointing to this collection, listing only the documents
+// for which keep returns true. A nil keep lists every document. With "?filter=",
+// only the documents whose fields match the predicate are listed or subscribed to.
+func (c *Collection) GetDocFiltered(w http.ResponseWriter, r *http.Request, keep func(doc interfaces.IDocument) bool) {
 	// Get queries from the URL, as well as the mode and interval
 	queries := r.URL.Query()
 	mode := queries.Get("mode")
-	interval := getInterval(queries.Get("interval"))
+	interval := GetInterval(queries.Get("interval"))
 
 	if len(interval) < 2 {
 		errorMessage.ErrorResponse(w, "Invalid interval parameters", http.StatusBadRequest)
 		return
 	}
 
-	if mode == "subscribe" {
-		intervalStart := interval[0]
-		intervalEnd := interval[1]
+	match, err := ParseFilter(queries.Get("filter"))
+	if err != nil {
+		slog.Info("collection GetDoc: invalid filter", "filter", queries.Get("filter"), "error", err)
+		errorMessage.ErrorResponse(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		if intervalStart == "" || intervalEnd == "" {
-			errorMessage.ErrorResponse(w, "Missing interval params", http.StatusBadRequest)
-			return
+	if mode == "subscribe" {
+		// hear about the documents a GET with the same interval would list
+		err := c.SubscribeFiltered(w, r, interval[0], interval[1], keep, match)
+		if err != nil {
+			errorMessage.ErrorResponse(w, "Subscription failed: "+err.Error(), http.StatusInternalServerError)
 		}
-
-		//let me comment it out for now
-		//subscription stuff
-		//err := c.Subscribe(w, r, intervalStart, intervalEnd)
-		//if err != nil {
-		//	errorMessage.ErrorResponse(w, "Subscription failed: "+err.Error(), http.StatusInternalServerError)
-		//}
 		return
 	}
 
@@ -84,6 +134,13 @@ func (c *Collection) GetDoc(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, pair := range pairs {
+		if keep != nil && !keep(pair.Value) {
+			continue
+		}
+		if match != nil && !match(pair.Value) {
+			continue
+		}
+
 		// Collect the document output
 		docOutput = append(docOutput, pair.Value.GetRawDoc())
 	}
@@ -105,15 +162,6 @@ func (c *Collection) GetDoc(w http.ResponseWriter, r *http.Request) {
 
 // Handle a put request pointing to this collection
 func (c *Collection) PutDoc(w http.ResponseWriter, r *http.Request, path string, newDoc interfaces.IDocument) {
-	// Marshal
-	jsonResponse, err := json.Marshal(structs.PutOutput{Uri: r.URL.Path})
-	if err != nil {
-		// This should never happen
-		slog.Error("collection PutDoc: error marshalling json", "error", err)
-		errorMessage.ErrorResponse(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
 	// Conditional put on timestamp
 	timeStampString := r.URL.Query().Get("timestamp")
 	var timeStamp int64 = -1
@@ -123,17 +171,26 @@ func (c *Collection) PutDoc(w http.ResponseWriter, r *http.Request, path string,
 		if err != nil {
 			slog.Error("collection PutDoc: bad timestamp", "error", err)
 			errorMessage.ErrorResponse(w, "Bad timestamp", http.StatusBadRequest)
+			return
 		}
 		timeStamp = int64(val)
 	}
 
+	// keep the collections of an overwritten document only if asked to
+	preserveChildren := r.URL.Query().Get("preserveChildren") == "true"
+
+	// the document that ends up stored in the collection
+	var stored interfaces.IDocument
+	var overwritten interfaces.Overwriteable
+
 	// upsert document; update if found, create if not
 	docUpsert := func(key string, currentValue interfaces.IDocument, exists bool) (interfaces.IDocument, error) {
 		if exists { // the document exists, update it
-			docMeta, hasMeta := interface{}(newDoc).(interfaces.HasMetadata)
-			docOverwrite, hasOverwrite := interface{}(newDoc).(interfaces.Overwriteable)
+			docMeta, hasMeta := interface{}(currentValue).(interfaces.HasMetadata)
+			docOverwrite, hasOverwrite := interface{}(currentValue).(interfaces.Overwriteable)
+			newMeta, newHasMeta := interface{}(newDoc).(interfaces.HasMetadata)
 
-			if !hasMeta || !hasOverwrite {
+			if !hasMeta || !hasOverwrite || !newHasMeta {
 				return nil, errors.New("Bad overwrite")
 			}
 
@@ -143,8 +200,8 @@ func (c *Collection) PutDoc(w http.ResponseWriter, r *http.Request, path string,
 				return nil, errors.New("Bad timestamp")
 			}
 
-			// modify the metadata
-			docOverwrite.OverwriteBody(newDoc.GetJSONDoc(), docMeta.GetOriginalAuthor())
+			// modify the metadata; the author of the new document is the modifier
+			docOverwrite.OverwriteBody(newDoc.GetJSONDoc(), newMeta.GetOriginalAuthor())
 
 			_, err := json.Marshal(currentValue.GetRawDoc())
 			if err != nil {
@@ -152,6 +209,8 @@ func (c *Collection) PutDoc(w http.ResponseWriter, r *http.Request, path string,
 				return nil, err
 			}
 
+			stored = currentValue
+			overwritten = docOverwrite
 			return currentValue, nil
 		} else {
 			// create the document
@@ -161,6 +220,8 @@ func (c *Collection) PutDoc(w http.ResponseWriter, r *http.Request, path string,
 				return nil, errors.New("marshalling error")
 			}
 
+			stored = newDoc
+			c.adopt(key, newDoc)
 			return newDoc, nil
 		}
 	}
@@ -181,10 +242,28 @@ func (c *Collection) PutDoc(w http.ResponseWriter, r *http.Request, path string,
 		return
 	}
 
+	// Drop the collections of the overwritten document, outside of the upsert
+	childrenDropped := false
+	if updated && !preserveChildren {
+		childrenDropped = overwritten.DropChildren(r.URL.Path)
+	}
+
+	// Marshal
+	output := structs.PutOutput{Uri: r.URL.Path, ChildrenDropped: childrenDropped}
+	if wantsRepresentation(r) {
+		output.Document = stored.GetRawDoc()
+		w.Header().Set("Preference-Applied", "return=representation")
+	}
+	jsonResponse, err := json.Marshal(output)
+	if err != nil {
+		// This should never happen
+		slog.Error("collection PutDoc: error marshalling json", "error", err)
+		errorMessage.ErrorResponse(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
 	// PUT success
 	w.Header().Set("Location", r.URL.Path)
-	slog.Info("collection PutDoc: document created", "path", r.URL.Path)
-	// if updated {
 	if updated {
 		slog.Info("collection PutDoc: document updated", "path", r.URL.Path)
 		w.WriteHeader(http.StatusOK)
@@ -194,10 +273,9 @@ func (c *Collection) PutDoc(w http.ResponseWriter, r *http.Request, path string,
 	}
 
 	// notify subscribers
-	updateMsg, err := createUpdateMessage("update", newDoc)
+	updateMsg, err := createUpdateMessage("update", stored)
 	if err == nil {
-		intervalVal := determineInterval(newDoc)
-		c.NotifySubscribersUpdate(updateMsg, intervalVal)
+		c.notifyDocument(updateMsg, path, stored)
 	}
 
 	w.Write(jsonResponse)
@@ -205,25 +283,221 @@ func (c *Collection) PutDoc(w http.ResponseWriter, r *http.Request, path string,
 
 func (c *Collection) DeleteDoc(w http.ResponseWriter, r *http.Request, docPath string) {
 	// request to delete a document
-	_, removed := c.documents.Remove(docPath)
+	_, removed := c.RemoveDoc(docPath)
 	if !removed {
 		// document not found
 		slog.Info("collection DeleteDoc: document not found", "path", docPath)
 		errorMessage.ErrorResponse(w, "Document not found", http.StatusNotFound)
-		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
+	slog.Info("collection DeleteDoc: document deleted", "path", docPath)
+	w.Header().Set("Location", r.URL.Path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Remove a document from this collection, notifying subscribers of the
+// collection and of the document itself.
+func (c *Collection) RemoveDoc(docPath string) (interfaces.IDocument, bool) {
+	doc, removed := c.documents.Remove(docPath)
+	if !removed {
+		return nil, false
+	}
+
+	c.notifyRemoved(docPath, doc)
+	return doc, true
+}
+
+// Take a document out of this collection to move it, if it is still the given one, and hand
+// it to place, which puts a copy elsewhere. Nobody hears about the document leaving until
+// place succeeds; if it fails, the document is put back and its error returned.
+func (c *Collection) MoveDoc(docPath string, doc interfaces.IDocument, place func() error) error {
+	_, claimed := c.documents.RemoveIf(docPath, func(current interfaces.IDocument) bool {
+		return current == doc
+	})
+	if !claimed {
+		return errors.New("Source document was removed or replaced during the move")
+	}
+
+	err := place()
+	if err != nil {
+		// nobody has heard about the move, so the document goes back quietly
+		restoreErr := c.storeDoc(docPath, doc)
+		if restoreErr != nil {
+			slog.Error("collection MoveDoc: could not put back document", "path", docPath, "error", restoreErr)
+			c.notifyRemoved(docPath, doc)
+		}
+		return err
+	}
+
+	c.notifyRemoved(docPath, doc)
+	return nil
+}
+
+// Notify subscribers of the collection and of the document itself that the
+// document was removed, and detach it.
+func (c *Collection) notifyRemoved(docPath string, doc interfaces.IDocument) {
 	// notify subscribers
 	deleteMsg, err := createDeleteMessage(docPath)
 	if err == nil {
-		intervalVal := determineIntervalForDeletion(docPath)
-		c.NotifySubscribersDelete(deleteMsg, intervalVal)
+		c.subscriberManager.NotifyDocument([]byte(deleteMsg), docPath, doc)
+
+		if subscribable, ok := doc.(interfaces.Subscribable); ok {
+			subscribable.NotifyResourceDeleted(deleteMsg)
+		}
+		if attachable, ok := doc.(interfaces.Attachable); ok {
+			attachable.NotifyTree([]byte(deleteMsg))
+		}
+	}
+	if attachable, ok := doc.(interfaces.Attachable); ok {
+		attachable.Detach()
 	}
+}
 
-	slog.Info("collection DeleteDoc: document deleted", "path", docPath)
-	w.Header().Set("Location", r.URL.Path)
-	w.WriteHeader(http.StatusNoContent)
+// Remove every document of this collection, whose URI is given, and the collections
+// below them, notifying their subscribers. Used when the collection itself is dropped.
+func (c *Collection) DropDocs(uri string) {
+	pairs, err := c.documents.Query(context.Background(), skiplist.STRINGMIN, skiplist.STRINGMAX)
+	if err != nil {
+		slog.Error("collection DropDocs: error querying documents", "error", err)
+		return
+	}
+
+	for _, pair := range pairs {
+		// the deepest resources go first, while the ones above them are still attached
+		if overwriteable, ok := pair.Value.(interfaces.Overwriteable); ok {
+			overwriteable.DropChildren(uri + pair.Key)
+		}
+		c.RemoveDoc(pair.Key)
+	}
+}
+
+// Insert a document under a name that is not yet taken, notifying subscribers.
+// The document must already hold its full path.
+func (c *Collection) InsertDoc(name string, newDoc interfaces.IDocument) error {
+	err := c.storeDoc(name, newDoc)
+	if err != nil {
+		return err
+	}
+
+	// notify subscribers
+	updateMsg, err := createUpdateMessage("create", newDoc)
+	if err == nil {
+		c.notifyDocument(updateMsg, name, newDoc)
+	}
+	return nil
+}
+
+// Deep-copy this collection and its documents to a new relative path,
+// validating every copied document against the schema.
+func (c *Collection) DeepCopy(path string, user string, resetMeta bool, schema *jsonschema.Schema) (interfaces.ICollection, error) {
+	newColl := New()
+	newColl.SetIDStrategy(c.ids.Strategy())
+	newColl.SetOwnership(c.GetOwnership())
+
+	// documents below a collection with its own schema are validated against it
+	ownSchema, source := c.GetSchema()
+	if ownSchema != nil {
+		schema = ownSchema
+		newColl.SetSchema(ownSchema, source)
+	}
+
+	pairs, err := c.documents.Query(context.Background(), skiplist.STRINGMIN, skiplist.STRINGMAX)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pair := range pairs {
+		copyable, ok := pair.Value.(interfaces.Copyable)
+		if !ok {
+			return nil, errors.New("document cannot be copied")
+		}
+
+		docCopy, err := copyable.DeepCopy(path+pair.Key, user, resetMeta, schema)
+		if err != nil {
+			return nil, err
+		}
+
+		// the new collection is not shared yet, so there is nobody to notify
+		err = newColl.storeDoc(pair.Key, docCopy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &newColl, nil
+}
+
+// Check every document of this collection, whose URI is given, and of the collections below it
+// that inherit its schema, against a new schema after applying the migration patches.
+// When apply is set, the migrated documents are stored and subscribers notified.
+func (c *Collection) Migrate(uri string, schema *jsonschema.Schema, migration []patcher.Patch, user string, apply bool, report *structs.SchemaReport) {
+	pairs, err := c.documents.Query(context.Background(), skiplist.STRINGMIN, skiplist.STRINGMAX)
+	if err != nil {
+		slog.Error("collection Migrate: error querying documents", "error", err)
+		return
+	}
+
+	for _, pair := range pairs {
+		migratable, ok := pair.Value.(interfaces.Migratable)
+		if !ok {
+			continue
+		}
+
+		c.migrateDoc(uri+pair.Key, pair.Key, migratable, schema, migration, user, apply, report)
+		migratable.MigrateChildren(uri+pair.Key, schema, migration, user, apply, report)
+	}
+}
+
+// Check a document of this collection, whose URI is given, against a new schema after applying
+// the migration patches, adding a failure to the report if it does not conform. When apply is set,
+// the document is checked again and its migrated body stored under the lock of its node, like PUT
+// does, so that writes made since the first check are migrated too. Documents that do not conform
+// are left unchanged.
+func (c *Collection) migrateDoc(uri string, name string, migratable interfaces.Migratable, schema *jsonschema.Schema, migration []patcher.Patch, user string, apply bool, report *structs.SchemaReport) {
+	var err error
+	if !apply {
+		report.Checked++
+		_, err = migratable.MigrateBody(schema, migration)
+	} else {
+		var stored interfaces.IDocument
+		migrateUpsert := func(key string, currentValue interfaces.IDocument, exists bool) (interfaces.IDocument, error) {
+			if !exists {
+				// removed since the query; there is nothing left to migrate
+				return nil, errors.New("Document not found")
+			}
+			current, canMigrate := currentValue.(interfaces.Migratable)
+			docOverwrite, canOverwrite := currentValue.(interfaces.Overwriteable)
+			if !canMigrate || !canOverwrite {
+				return nil, errors.New("Document cannot be migrated")
+			}
+
+			report.Checked++
+			var body interface{}
+			body, err = current.MigrateBody(schema, migration)
+			if err != nil || len(migration) == 0 {
+				return currentValue, nil
+			}
+
+			docOverwrite.OverwriteBody(body, user)
+			stored = currentValue
+			return currentValue, nil
+		}
+		c.documents.Upsert(name, migrateUpsert)
+
+		if stored != nil {
+			// notify subscribers
+			updateMsg, err := createUpdateMessage("update", stored)
+			if err == nil {
+				c.notifyDocument(updateMsg, name, stored)
+			}
+		}
+	}
+
+	if err != nil {
+		slog.Info("collection migrateDoc: document does not conform", "path", uri, "error", err)
+		report.Failures = append(report.Failures, structs.SchemaFailure{Path: uri, Error: err.Error(), Validation: schemas.DescribeError(err)})
+	}
 }
 
 // Handle a patch request to a document in this collection
@@ -269,14 +543,6 @@ func (c *Collection) PatchDoc(w http.ResponseWriter, r *http.Request, docPath st
 	patchResponse, newDoc := patcher.ApplyPatches(patchData, schema)
 	patchResponse.Uri = r.URL.Path
 
-	// marshal the response
-	jsonResponse, err := json.Marshal(patchResponse)
-	if err != nil {
-		slog.Error("collection PatchDoc: error marshalling json", "error", err)
-		errorMessage.ErrorResponse(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
 	// patch success
 	if !patchResponse.PatchFailed {
 		// modify the metadata
@@ -310,20 +576,42 @@ func (c *Collection) PatchDoc(w http.ResponseWriter, r *http.Request, docPath st
 		// notify subscribers
 		updateMsg, err := createUpdateMessage("update", doc)
 		if err == nil {
-			intervalVal := determineInterval(doc)
-			c.NotifySubscribersUpdate(updateMsg, intervalVal)
+			c.notifyDocument(updateMsg, docPath, doc)
+		}
+
+		// include the patched document if the client asked for it
+		if wantsRepresentation(r) {
+			patchResponse.Document = doc.GetRawDoc()
+			w.Header().Set("Preference-Applied", "return=representation")
+		}
+
+		// marshal the response
+		jsonResponse, err := json.Marshal(patchResponse)
+		if err != nil {
+			slog.Error("collection PatchDoc: error marshalling json", "error", err)
+			errorMessage.ErrorResponse(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
 
 		// success
 		slog.Info("collection PatchDoc: document patched", "path", docPath)
+		w.Header().Set("Location", r.URL.Path)
 		w.WriteHeader(http.StatusOK)
-		w.Header().Set("location", r.URL.Path)
-	} else {
-		// failure
-		slog.Info("collection PatchDoc: patch failed", "path", docPath)
-		w.WriteHeader(http.StatusBadRequest)
+		w.Write(jsonResponse)
+		return
+	}
+
+	// marshal the response
+	jsonResponse, err := json.Marshal(patchResponse)
+	if err != nil {
+		slog.Error("collection PatchDoc: error marshalling json", "error", err)
+		errorMessage.ErrorResponse(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
+	// failure
+	slog.Info("collection PatchDoc: patch failed", "path", docPath)
+	w.WriteHeader(http.StatusBadRequest)
 	w.Write(jsonResponse)
 }
 
@@ -331,11 +619,171 @@ func (c *Collection) PatchDoc(w http.ResponseWriter, r *http.Request, docPath st
 func (c *Collection) PostDoc(w http.ResponseWriter, r *http.Request, newDoc interfaces.IDocument) {
 	slog.Info("collection PostDoc: posting document", "path", r.URL.Path)
 
+	strategy := r.URL.Query().Get("idgen")
+	if strategy != "" && !idgen.Valid(strategy) {
+		slog.Info("collection PostDoc: unknown id strategy", "idgen", strategy)
+		errorMessage.ErrorResponse(w, "Unknown id strategy "+strategy, http.StatusBadRequest)
+		return
+	}
+
+	path, err := c.insertDoc("", strategy, newDoc)
+	if err != nil {
+		switch err.Error() {
+		case "Document cant be posted":
+			slog.Error("collection PostDoc: document cant be posted")
+			errorMessage.ErrorResponse(w, "Document cant be posted", http.StatusBadRequest)
+		case "Could not generate document name":
+			errorMessage.ErrorResponse(w, "Could not generate document name", http.StatusInternalServerError)
+		default:
+			slog.Error(err.Error())
+			errorMessage.ErrorResponse(w, "collection PostDoc: error"+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// marshal the response
+	output := structs.PutOutput{Uri: r.URL.Path + path}
+	if wantsRepresentation(r) {
+		output.Document = newDoc.GetRawDoc()
+		w.Header().Set("Preference-Applied", "return=representation")
+	}
+	jsonResponse, err := json.Marshal(output)
+	if err != nil {
+		slog.Error("PostDoc: error marshalling json", "error", err)
+		errorMessage.ErrorResponse(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// notify subscribers
+	updateMsg, err := createUpdateMessage("create", newDoc)
+	if err == nil {
+		c.notifyDocument(updateMsg, path, newDoc)
+	}
+
+	// success
+	slog.Info("PostDoc: document created", "path", r.URL.Path+path)
+	w.Header().Set("Location", r.URL.Path+path)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonResponse)
+}
+
+// Handle a bulk post of many documents to this collection.
+// Invalid entries either abort the whole batch or are skipped, depending on abortOnError.
+func (c *Collection) PostDocs(w http.ResponseWriter, r *http.Request, entries []interfaces.BulkEntry, abortOnError bool) {
+	slog.Info("collection PostDocs: posting documents", "path", r.URL.Path, "count", len(entries))
+
+	strategy := r.URL.Query().Get("idgen")
+	if strategy != "" && !idgen.Valid(strategy) {
+		slog.Info("collection PostDocs: unknown id strategy", "idgen", strategy)
+		errorMessage.ErrorResponse(w, "Unknown id strategy "+strategy, http.StatusBadRequest)
+		return
+	}
+
+	output := structs.BulkOutput{Results: make([]structs.BulkResult, len(entries))}
+	failed := false
+	for i, entry := range entries {
+		output.Results[i].Line = entry.Line
+		if entry.Doc == nil {
+			output.Results[i].Error = entry.Error
+			output.Results[i].Validation = entry.Validation
+			failed = true
+		}
+	}
+
+	// nothing is inserted if a line is invalid and the batch must be aborted
+	if failed && abortOnError {
+		output.Aborted = true
+		writeBulkOutput(w, output, http.StatusBadRequest)
+		return
+	}
+
+	// insert each valid document, remembering its name and when it was last modified
+	names := make([]string, len(entries))
+	stamps := make([]int64, len(entries))
+	for i, entry := range entries {
+		if entry.Doc == nil {
+			continue
+		}
+
+		name, err := c.insertDoc(entry.Key, strategy, entry.Doc)
+		if err != nil {
+			slog.Info("collection PostDocs: could not insert document", "line", entry.Line, "error", err)
+			output.Results[i].Error = err.Error()
+			failed = true
+
+			if abortOnError {
+				// roll back the documents inserted so far, which nobody has heard about
+				for j := range names[:i] {
+					if names[j] != "" {
+						c.rollBack(names[j], entries[j].Doc, stamps[j])
+						output.Results[j].Uri = ""
+					}
+				}
+				output.Aborted = true
+				writeBulkOutput(w, output, http.StatusBadRequest)
+				return
+			}
+			continue
+		}
+
+		names[i] = name
+		stamps[i] = lastModified(entry.Doc)
+		output.Results[i].Uri = r.URL.Path + name
+	}
+
+	// notify subscribers once the batch is in
+	for i, entry := range entries {
+		if names[i] == "" {
+			continue
+		}
+		updateMsg, err := createUpdateMessage("create", entry.Doc)
+		if err == nil {
+			c.notifyDocument(updateMsg, names[i], entry.Doc)
+		}
+	}
+
+	// success
+	slog.Info("collection PostDocs: batch inserted", "path", r.URL.Path, "failed", failed)
+	if failed {
+		writeBulkOutput(w, output, http.StatusOK)
+	} else {
+		writeBulkOutput(w, output, http.StatusCreated)
+	}
+}
+
+// Remove a document inserted by an aborted batch, unless it has been replaced or
+// written to since it was inserted at the given last modified time, and detach it.
+func (c *Collection) rollBack(name string, doc interfaces.IDocument, stamp int64) {
+	unchanged := func(current interfaces.IDocument) bool {
+		return current == doc && lastModified(current) == stamp
+	}
+	_, removed := c.documents.RemoveIf(name, unchanged)
+	if !removed {
+		slog.Info("collection rollBack: document changed since it was inserted", "name", name)
+		return
+	}
+	if attachable, ok := doc.(interfaces.Attachable); ok {
+		attachable.Detach()
+	}
+}
+
+// The last time a document was modified, or -1 if it has no metadata.
+func lastModified(doc interfaces.IDocument) int64 {
+	docMeta, hasMeta := doc.(interfaces.HasMetadata)
+	if !hasMeta {
+		return -1
+	}
+	return docMeta.GetLastModified()
+}
+
+// Insert a new document into this collection under the given name, or under
+// a generated name if the given name is empty. Names are generated with the given
+// strategy, or the collection's default strategy if that is empty.
+// Returns the name the document was stored under.
+func (c *Collection) insertDoc(name string, strategy string, newDoc interfaces.IDocument) (string, error) {
 	postDoc, canPost := interface{}(newDoc).(interfaces.Postable)
 	if !canPost {
-		slog.Error("collection PostDoc: document cant be posted")
-		errorMessage.ErrorResponse(w, "Document cant be posted", http.StatusBadRequest)
-		return
+		return "", errors.New("Document cant be posted")
 	}
 
 	// upsert the document
@@ -345,71 +793,76 @@ func (c *Collection) PostDoc(w http.ResponseWriter, r *http.Request, newDoc inte
 		} else {
 			_, err := json.Marshal(newDoc.GetRawDoc())
 			if err != nil {
-				errorMessage.ErrorResponse(w, "Internal server error", http.StatusInternalServerError)
 				return nil, errors.New("Marshalling error")
 			}
 
 			// concatenate the key
 			postDoc.ConcatPath(key)
+			c.adopt(key, newDoc)
 			return newDoc, nil
 		}
 	}
 
-	var path string
-	for {
-		// same as authentication generateToken
-		// generate a 16-byte or 128-bit random token
-		token := make([]byte, 16)
+	// the caller chose the name
+	if name != "" {
+		_, err := c.documents.Upsert(name, docUpsert)
+		if err != nil {
+			if err.Error() == "Document exists" {
+				return "", errors.New("document already exists")
+			}
+			return "", err
+		}
+		return name, nil
+	}
 
-		// fill the slice with random bytes
-		_, err := rand.Read(token)
+	for {
+		newName, err := c.ids.Next(strategy)
 		if err != nil {
-			slog.Error("collection PostDoc: error generating token", "error", err)
-			errorMessage.ErrorResponse(w, "Could not generate random token", http.StatusInternalServerError)
-			return
+			slog.Error("collection insertDoc: error generating name", "error", err)
+			return "", errors.New("Could not generate document name")
 		}
 
-		// convert the token to a hexadecimal string
-		randomName := hex.EncodeToString(token)
-		_, upsertError := c.documents.Upsert(randomName, docUpsert)
-		slog.Info("collection PostDoc: Upsert complete", "randomName", randomName)
+		_, upsertError := c.documents.Upsert(newName, docUpsert)
+		slog.Info("collection insertDoc: Upsert complete", "newName", newName)
 		if upsertError != nil {
-			switch upsertError.Error() {
-			case "Document exists":
-				slog.Info("collection PostDoc: document exists", "randomName", randomName)
-			default:
-				slog.Error(upsertError.Error())
-				errorMessage.ErrorResponse(w, "collection PostDoc: error"+upsertError.Error(), http.StatusInternalServerError)
+			if upsertError.Error() == "Document exists" {
+				// if exists, try again
+				slog.Info("collection insertDoc: document exists", "newName", newName)
+				continue
 			}
-
-			// if exists, try again
-			continue
+			return "", upsertError
 		}
 
 		// no error, success
-		path = randomName
-		break
+		return newName, nil
 	}
+}
 
-	// marshal the response
-	jsonResponse, err := json.Marshal(structs.PutOutput{Uri: r.URL.Path + path})
+// Store a document that already holds its full path under a name that is not yet taken.
+func (c *Collection) storeDoc(name string, newDoc interfaces.IDocument) error {
+	docUpsert := func(key string, currentValue interfaces.IDocument, exists bool) (interfaces.IDocument, error) {
+		if exists {
+			return nil, errors.New("document already exists")
+		}
+		c.adopt(key, newDoc)
+		return newDoc, nil
+	}
+
+	_, err := c.documents.Upsert(name, docUpsert)
+	return err
+}
+
+// Write the response to a bulk post.
+func writeBulkOutput(w http.ResponseWriter, output structs.BulkOutput, statusCode int) {
+	jsonResponse, err := json.Marshal(output)
 	if err != nil {
-		slog.Error("PostDoc: error marshalling json", "error", err)
+		// This should never happen
+		slog.Error("collection PostDocs: error marshalling json", "error", err)
 		errorMessage.ErrorResponse(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// notify subscribers
-	updateMsg, err := createUpdateMessage("create", newDoc)
-	if err == nil {
-		intervalVal := determineInterval(newDoc)
-		c.NotifySubscribersUpdate(updateMsg, intervalVal)
-	}
-
-	// success
-	slog.Info("PostDoc: document created", "path", r.URL.Path+path)
-	w.Header().Set("Location", r.URL.Path+path)
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(statusCode)
 	w.Write(jsonResponse)
 }
 
@@ -418,12 +871,29 @@ func (c *Collection) FindDoc(resource string) (interfaces.IDocument, bool) {
 	return c.documents.Find(resource)
 }
 
+// Check whether the client asked for the stored document in the response,
+// either with a "Prefer: return=representation" header or with "?return=doc".
+func wantsRepresentation(r *http.Request) bool {
+	if r.URL.Query().Get("return") == "doc" {
+		return true
+	}
+
+	for _, header := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "return=representation") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Convert a string representing string intervals into the elements inside the interval
-func getInterval(intervalStr string) [2]string {
+func GetInterval(intervalStr string) [2]string {
 	interval := [2]string{skiplist.STRINGMIN, skiplist.STRINGMAX}
 	// Must be in array form
 	if !(len(intervalStr) > 2 && intervalStr[0] == '[' && intervalStr[len(intervalStr)-1] == ']') {
-		slog.Info("collection getInterval: Bad interval, non-array", "interval", intervalStr)
+		slog.Info("collection GetInterval: Bad interval, non-array", "interval", intervalStr)
 		return interval
 	}
 
@@ -450,16 +920,74 @@ func getInterval(intervalStr string) [2]string {
 }
 
 // implement subscribable interface
-// subscribe to the collection
+// subscribe to the collection, hearing about the documents whose names are in the interval
 func (c *Collection) Subscribe(w http.ResponseWriter, r *http.Request, intervalStart, intervalEnd string) error {
+	return c.SubscribeFiltered(w, r, intervalStart, intervalEnd, nil, nil)
+}
+
+// Subscribe to the collection, hearing only about the documents in the interval
+// for which keep returns true. A nil keep hears about every document. Documents
+// starting or stopping to match are sent as enter or leave events; a nil match matches all.
+func (c *Collection) SubscribeFiltered(w http.ResponseWriter, r *http.Request, intervalStart, intervalEnd string, keep func(doc interfaces.IDocument) bool, match func(doc interfaces.IDocument) bool) error {
 	// create a new subscriber
 	subscriber, err := subscribe.NewSubscriber(w, r, intervalStart, intervalEnd)
 	if err != nil {
 		return err
 	}
+	subscriber.Recursive = r.URL.Query().Get("recursive") == "true"
+	if keep != nil {
+		subscriber.Keep = func(doc any) bool {
+			document, ok := doc.(interfaces.IDocument)
+			return ok && keep(document)
+		}
+	}
+	if match != nil {
+		c.FilterSubscriber(subscriber, match)
+	}
+
+	return c.Stream(subscriber, r.Header.Get("Last-Event-ID"))
+}
+
+// Filter the events of a subscriber that is yet to stream to the documents in its interval
+// that match, starting from those that match now.
+func (c *Collection) FilterSubscriber(subscriber *subscribe.Subscriber, match func(doc interfaces.IDocument) bool) {
+	matching := make([]string, 0)
+	pairs, err := c.documents.Query(context.Background(), subscriber.IntervalStart, subscriber.IntervalEnd)
+	if err != nil {
+		slog.Error("collection FilterSubscriber: error querying collection", "error", err)
+	}
+	for _, pair := range pairs {
+		if match(pair.Value) {
+			matching = append(matching, pair.Key)
+		}
+	}
 
-	// add the subscriber to the subscriber manager
-	c.subscriberManager.AddSubscriber(subscriber)
+	subscriber.Filter(func(doc any) bool {
+		document, ok := doc.(interfaces.IDocument)
+		return ok && match(document)
+	}, matching)
+}
+
+// Parse a predicate over the fields of documents, such as `status == "open" && priority >= 3`,
+// into a function telling whether a document matches it. An empty predicate gives nil.
+func ParseFilter(source string) (func(doc interfaces.IDocument) bool, error) {
+	if source == "" {
+		return nil, nil
+	}
+	f, err := filter.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	return func(doc interfaces.IDocument) bool {
+		return f.Match(doc.GetJSONDoc())
+	}, nil
+}
+
+// Send the updates about the documents in the subscriber's interval to it until it closes,
+// first replaying the events after lastEventID that it missed, if given.
+func (c *Collection) Stream(subscriber *subscribe.Subscriber, lastEventID string) error {
+	// add the subscriber to the subscriber manager, replaying the events it missed if it is resuming
+	c.subscriberManager.Resume(subscriber, lastEventID)
 
 	//added new
 	defer c.subscriberManager.RemoveSubscriber(subscriber)
@@ -470,26 +998,54 @@ func (c *Collection) Subscribe(w http.ResponseWriter, r *http.Request, intervalS
 	return nil
 }
 
-// notify subscribers of update messages
-func (c *Collection) NotifySubscribersUpdate(msg []byte, intervalVal string) {
-	c.subscriberManager.NotifySubscribersUpdate(msg, intervalVal)
+// notify subscribers of update messages about the document with the given name
+func (c *Collection) NotifySubscribersUpdate(msg []byte, key string) {
+	c.subscriberManager.NotifySubscribersUpdate(msg, key)
+}
+
+// notify subscribers of delete messages about the document with the given name
+func (c *Collection) NotifySubscribersDelete(msg string, key string) {
+	c.subscriberManager.NotifySubscribersDelete(msg, key)
 }
 
-// notify subscribers of delete messages
-func (c *Collection) NotifySubscribersDelete(msg string, intervalVal string) {
-	c.subscriberManager.NotifySubscribersDelete(msg, intervalVal)
+// notify every subscriber that this collection was deleted
+func (c *Collection) NotifyResourceDeleted(msg string) {
+	c.subscriberManager.NotifyAll([]byte(msg))
 }
 
-// determine the interval
-func determineInterval(doc interfaces.IDocument) string {
-	docData, ok := doc.GetJSONDoc().(map[string]interface{})
-	if !ok {
-		return "general"
+// notify the subscribers whose interval holds the name of a document, and who may see it,
+// the subscribers of the document itself, and the recursive subscribers above it
+func (c *Collection) notifyDocument(msg []byte, key string, doc interfaces.IDocument) {
+	c.subscriberManager.NotifyDocument(msg, key, doc)
+	if watchable, ok := doc.(interfaces.Watchable); ok {
+		watchable.NotifyChanged()
 	}
-	if category, exists := docData["category"].(string); exists {
-		return category
+	if attachable, ok := doc.(interfaces.Attachable); ok {
+		attachable.NotifyTree(msg)
 	}
-	return "general"
+}
+
+// attach a document stored under the given name below this collection, for recursive subscribers
+func (c *Collection) adopt(name string, doc interfaces.IDocument) {
+	if attachable, ok := doc.(interfaces.Attachable); ok {
+		attachable.Attach(c.subscriberManager, name)
+	}
+}
+
+// implement attachable interface
+// attach this collection below the resource holding it
+func (c *Collection) Attach(parent *subscribe.SubscriberManager, name string) {
+	c.subscriberManager.Attach(parent, name)
+}
+
+// stop telling the resource that held this collection about changes
+func (c *Collection) Detach() {
+	c.subscriberManager.Detach()
+}
+
+// notify the recursive subscribers of this collection and of those above it
+func (c *Collection) NotifyTree(msg []byte) {
+	c.subscriberManager.NotifyTree(msg, nil)
 }
 
 // create an update message
@@ -523,14 +1079,3 @@ func createDeleteMessage(docPath string) (string, error) {
 	}
 	return string(msgBytes), nil
 }
-
-// determine the interval for deletion
-func determineIntervalForDeletion(docPath string) string {
-	parts := strings.Split(docPath, "/")
-	for i, part := range parts {
-		if part == "categories" && i+1 < len(parts) {
-			return parts[i+1]
-		}
-	}
-	return "general"
-}
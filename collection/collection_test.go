@@ -2,14 +2,22 @@ package collection
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/document"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/patcher"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/schemas"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/structs"
 	"github.com/santhosh-tekuri/jsonschema/v5"
 	"github.com/stretchr/testify/assert"
 )
@@ -99,3 +107,274 @@ func TestPostDoc(t *testing.T) {
 	assert.Equal(t, http.StatusCreated, resp.StatusCode)
 	assert.Contains(t, string(body), `"uri":"/documents/`)
 }
+
+// TestPutDocReturnRepresentation tests that an overwriting PUT returns the stored document when asked
+func TestPutDocReturnRepresentation(t *testing.T) {
+	c := New()
+	doc := document.New("/1", "user", map[string]interface{}{"key": "value"})
+	c.PutDoc(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/documents/1", nil), "1", &doc)
+
+	newDoc := document.New("/1", "other", map[string]interface{}{"key": "new"})
+	req := httptest.NewRequest(http.MethodPut, "/documents/1", nil)
+	req.Header.Set("Prefer", "return=representation")
+	w := httptest.NewRecorder()
+
+	c.PutDoc(w, req, "1", &newDoc)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	var output struct {
+		Uri      string `json:"uri"`
+		Document struct {
+			Doc  map[string]interface{} `json:"doc"`
+			Meta map[string]interface{} `json:"meta"`
+		} `json:"document"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &output))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "return=representation", resp.Header.Get("Preference-Applied"))
+	assert.Equal(t, "new", output.Document.Doc["key"])
+	assert.Equal(t, "user", output.Document.Meta["createdBy"])
+	assert.Equal(t, "other", output.Document.Meta["lastModifiedBy"])
+}
+
+// TestPostDocReturnRepresentation tests that a POST returns the stored document with ?return=doc
+func TestPostDocReturnRepresentation(t *testing.T) {
+	c := New()
+	doc := document.New("/", "user", map[string]interface{}{"key": "value"})
+	req := httptest.NewRequest(http.MethodPost, "/documents/?return=doc", nil)
+	w := httptest.NewRecorder()
+
+	c.PostDoc(w, req, &doc)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Contains(t, string(body), `"document":{"path":"/`)
+	assert.Contains(t, string(body), `"doc":{"key":"value"}`)
+}
+
+// A response writer for subscriptions that passes on every write.
+type eventWriter struct {
+	header http.Header
+	writes chan string
+}
+
+func (e *eventWriter) Header() http.Header         { return e.header }
+func (e *eventWriter) WriteHeader(statusCode int)  {}
+func (e *eventWriter) Flush()                      {}
+func (e *eventWriter) Write(p []byte) (int, error) { e.writes <- string(p); return len(p), nil }
+
+// Wait for the data of the next event written.
+func nextData(t *testing.T, e *eventWriter) string {
+	for {
+		select {
+		case write := <-e.writes:
+			if strings.Contains(write, "data: ") {
+				return write
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected an event")
+			return ""
+		}
+	}
+}
+
+// TestSubscribeInterval tests that a subscription hears about the documents whose names are in its interval
+func TestSubscribeInterval(t *testing.T) {
+	c := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &eventWriter{header: make(http.Header), writes: make(chan string, 10)}
+	req := httptest.NewRequest(http.MethodGet, "/documents/?mode=subscribe&interval=[b,m]", nil).WithContext(ctx)
+	go c.GetDoc(w, req)
+	for c.subscriberManager.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, name := range []string{"a", "b", "x", "m", "ma"} {
+		doc := document.New("/"+name, "user", map[string]interface{}{"key": "value"})
+		c.PutDoc(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/documents/"+name, nil), name, &doc)
+	}
+	c.RemoveDoc("x")
+	c.RemoveDoc("b")
+
+	assert.Contains(t, nextData(t, w), "\"path\":\"/b\"")
+	assert.Contains(t, nextData(t, w), "\"path\":\"/m\"")
+	assert.Contains(t, nextData(t, w), "{\"action\":\"delete\",\"document\":\"b\"}")
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+	// reconnecting replays the events after the last one seen
+	cancel()
+	for c.subscriberManager.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	w = &eventWriter{header: make(http.Header), writes: make(chan string, 10)}
+	req = httptest.NewRequest(http.MethodGet, "/documents/?mode=subscribe&interval=[b,m]", nil).WithContext(ctx)
+	req.Header.Set("Last-Event-ID", "2")
+	go c.GetDoc(w, req)
+
+	assert.Contains(t, nextData(t, w), "id: 4\nevent: update\n")
+	assert.Contains(t, nextData(t, w), "id: 7\nevent: delete\n")
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	c := New()
+	put := func(name string, body map[string]interface{}) {
+		doc := document.New("/"+name, "user", body)
+		c.PutDoc(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/documents/"+name, nil), name, &doc)
+	}
+	put("a", map[string]interface{}{"status": "open", "priority": 5.0})
+
+	// invalid filters are refused
+	w := httptest.NewRecorder()
+	c.GetDoc(w, httptest.NewRequest(http.MethodGet, "/documents/?filter="+url.QueryEscape("status = 1"), nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	filter := url.QueryEscape(`status == "open" && priority >= 3`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e := &eventWriter{header: make(http.Header), writes: make(chan string, 10)}
+	go c.GetDoc(e, httptest.NewRequest(http.MethodGet, "/documents/?mode=subscribe&filter="+filter, nil).WithContext(ctx))
+	for c.subscriberManager.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	put("b", map[string]interface{}{"status": "closed"})
+	put("b", map[string]interface{}{"status": "open", "priority": 4.0})
+	put("a", map[string]interface{}{"status": "closed", "priority": 5.0})
+	put("b", map[string]interface{}{"status": "open", "priority": 9.0})
+	c.RemoveDoc("a")
+	c.RemoveDoc("b")
+
+	// only documents that match, or just stopped matching, are heard about
+	assert.Contains(t, nextData(t, e), "id: 3\nevent: enter\n")
+	assert.Contains(t, nextData(t, e), "id: 4\nevent: leave\n")
+	assert.Contains(t, nextData(t, e), "id: 5\nevent: update\n")
+	assert.Contains(t, nextData(t, e), "id: 7\nevent: delete\n")
+
+	// listings are filtered the same way
+	put("c", map[string]interface{}{"status": "open", "priority": 3.0})
+	put("d", map[string]interface{}{"status": "open", "priority": 2.0})
+	w = httptest.NewRecorder()
+	c.GetDoc(w, httptest.NewRequest(http.MethodGet, "/documents/?filter="+filter, nil))
+	assert.Contains(t, w.Body.String(), "\"path\":\"/c\"")
+	assert.NotContains(t, w.Body.String(), "\"path\":\"/d\"")
+}
+
+// TestDropDocs tests that dropping a collection tells the subscribers of the resources below it
+func TestDropDocs(t *testing.T) {
+	c := New()
+	doc := document.New("/a", "user", map[string]interface{}{"key": "value"})
+	c.PutDoc(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db/a", nil), "a", &doc)
+	sub := New()
+	doc.PutColl(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db/a/sub/", nil), "sub", &sub)
+	inner := document.New("/a/sub/x", "user", map[string]interface{}{"key": "value"})
+	sub.PutDoc(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db/a/sub/x", nil), "x", &inner)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &eventWriter{header: make(http.Header), writes: make(chan string, 10)}
+	go sub.GetDoc(w, httptest.NewRequest(http.MethodGet, "/v1/db/a/sub/?mode=subscribe", nil).WithContext(ctx))
+	for sub.subscriberManager.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	c.DropDocs("/v1/db/")
+
+	_, found := c.FindDoc("a")
+	assert.False(t, found)
+	_, found = sub.FindDoc("x")
+	assert.False(t, found)
+	assert.Contains(t, nextData(t, w), "{\"action\":\"delete\",\"document\":\"x\"}")
+	assert.Contains(t, nextData(t, w), "{\"action\":\"delete\",\"collection\":\"/v1/db/a/sub/\"}")
+}
+
+// TestMigrate tests that applying a migration stores only the documents that conform afterwards
+func TestMigrate(t *testing.T) {
+	c := New()
+	for name, body := range map[string]map[string]interface{}{"a": {"x": 1.0}, "b": {"y": 1.0}} {
+		doc := document.New("/"+name, "user", body)
+		c.PutDoc(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db/"+name, nil), name, &doc)
+	}
+	schema, err := schemas.Compile([]byte(`{"required":["x","z"]}`))
+	assert.NoError(t, err)
+	migration := []patcher.Patch{{Operation: "ObjectAdd", Path: "/z", Value: true}}
+
+	report := structs.SchemaReport{}
+	c.Migrate("/v1/db/", schema, migration, "admin", true, &report)
+
+	assert.Equal(t, 2, report.Checked)
+	assert.Len(t, report.Failures, 1)
+	assert.Equal(t, "/v1/db/b", report.Failures[0].Path)
+	a, _ := c.FindDoc("a")
+	assert.Equal(t, map[string]interface{}{"x": 1.0, "z": true}, a.GetJSONDoc())
+	b, _ := c.FindDoc("b")
+	assert.Equal(t, map[string]interface{}{"y": 1.0}, b.GetJSONDoc())
+}
+
+// TestRollBack tests that an aborted batch only removes the documents nobody has written to since
+func TestRollBack(t *testing.T) {
+	c := New()
+	put := func(name string, body map[string]interface{}) interfaces.IDocument {
+		doc := document.New("/"+name, "user", body)
+		c.PutDoc(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db/"+name, nil), name, &doc)
+		stored, _ := c.FindDoc(name)
+		return stored
+	}
+	a := put("a", map[string]interface{}{"batch": true})
+	b := put("b", map[string]interface{}{"batch": true})
+	stampA, stampB := lastModified(a), lastModified(b)
+
+	// b is overwritten in place after the batch inserted it
+	time.Sleep(2 * time.Millisecond)
+	put("b", map[string]interface{}{"batch": false})
+
+	c.rollBack("a", a, stampA)
+	c.rollBack("b", b, stampB)
+
+	_, found := c.FindDoc("a")
+	assert.False(t, found)
+	assert.Equal(t, "", a.(*document.Document).SubscriberManager.Path())
+	stored, found := c.FindDoc("b")
+	assert.True(t, found)
+	assert.Equal(t, map[string]interface{}{"batch": false}, stored.GetJSONDoc())
+}
+
+// TestMoveDoc tests that a moved document leaves only once its copy is placed, and only once
+func TestMoveDoc(t *testing.T) {
+	c := New()
+	doc := document.New("/a", "user", map[string]interface{}{"key": "value"})
+	c.PutDoc(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db/a", nil), "a", &doc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &eventWriter{header: make(http.Header), writes: make(chan string, 10)}
+	go c.GetDoc(w, httptest.NewRequest(http.MethodGet, "/v1/db/?mode=subscribe", nil).WithContext(ctx))
+	for c.subscriberManager.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a failed placement puts the document back without anyone hearing
+	err := c.MoveDoc("a", &doc, func() error {
+		_, found := c.FindDoc("a")
+		assert.False(t, found)
+		return errors.New("destination taken")
+	})
+	assert.EqualError(t, err, "destination taken")
+	_, found := c.FindDoc("a")
+	assert.True(t, found)
+
+	// another document cannot be moved in its place
+	other := document.New("/a", "user", map[string]interface{}{})
+	assert.Error(t, c.MoveDoc("a", &other, func() error { return nil }))
+
+	assert.NoError(t, c.MoveDoc("a", &doc, func() error { return nil }))
+	_, found = c.FindDoc("a")
+	assert.False(t, found)
+	assert.Contains(t, nextData(t, w), "{\"action\":\"delete\",\"document\":\"a\"}")
+}
@@ -3,20 +3,25 @@
 package collectionholder
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
 
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/patcher"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/skiplist"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/structs"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/subscribe"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
 type CollectionHolder struct {
 	collections *skiplist.SkipList[string, interfaces.ICollection]
+	owner       *subscribe.SubscriberManager // The subscriber manager of the document holding the collections, if any
 }
 
 // A PutOutput stores the response to a put request.
@@ -30,6 +35,60 @@ func New() CollectionHolder {
 	return CollectionHolder{collections: &newSkipList}
 }
 
+// Attach the collections of this holder, and those put in it later, below the subscriber
+// manager of the document holding them, so that its recursive subscribers hear about them.
+func (ch *CollectionHolder) SetOwner(owner *subscribe.SubscriberManager) {
+	ch.owner = owner
+
+	pairs, err := ch.collections.Query(context.Background(), skiplist.STRINGMIN, skiplist.STRINGMAX)
+	if err != nil {
+		slog.Error("collectionholder SetOwner: error querying collections", "error", err)
+		return
+	}
+	for _, pair := range pairs {
+		attach(pair.Value, owner, "/"+pair.Key+"/")
+	}
+}
+
+// Attach a collection below a subscriber manager, if it can be.
+func attach(coll interfaces.ICollection, owner *subscribe.SubscriberManager, name string) {
+	if attachable, ok := coll.(interfaces.Attachable); ok {
+		attachable.Attach(owner, name)
+	}
+}
+
+// Tell the recursive subscribers of a collection and of those above it about a message,
+// then stop it telling them more, if it was deleted.
+func notifyTree(coll interfaces.ICollection, msg string, deleted bool) {
+	attachable, ok := coll.(interfaces.Attachable)
+	if !ok {
+		return
+	}
+	attachable.NotifyTree([]byte(msg))
+	if deleted {
+		attachable.Detach()
+	}
+}
+
+// Check every collection, below the document whose URI is given, that inherits
+// its schema against a new schema after applying the migration patches.
+// Collections with a schema of their own are left alone.
+func (ch *CollectionHolder) Migrate(uri string, schema *jsonschema.Schema, migration []patcher.Patch, user string, apply bool, report *structs.SchemaReport) {
+	pairs, err := ch.collections.Query(context.Background(), skiplist.STRINGMIN, skiplist.STRINGMAX)
+	if err != nil {
+		slog.Error("collectionholder Migrate: error querying collections", "error", err)
+		return
+	}
+
+	for _, pair := range pairs {
+		ownSchema, _ := pair.Value.GetSchema()
+		if ownSchema != nil {
+			continue
+		}
+		pair.Value.Migrate(uri+"/"+pair.Key+"/", schema, migration, user, apply, report)
+	}
+}
+
 // Create a new collection inside the collection holder
 func (ch *CollectionHolder) PutColl(w http.ResponseWriter, r *http.Request, dbpath string, newColl interfaces.ICollection) {
 	// Update and insert a new database to the databse-handler if it's not already there
@@ -42,6 +101,12 @@ func (ch *CollectionHolder) PutColl(w http.ResponseWriter, r *http.Request, dbpa
 			// If the collection already exists, return an error
 			return nil, errors.New("db exists")
 		}
+		// a database is named by its full path, a collection by its name below the document
+		if ch.owner == nil {
+			attach(newColl, nil, strings.TrimSuffix(r.URL.Path, "/")+"/")
+		} else {
+			attach(newColl, ch.owner, "/"+key+"/")
+		}
 		return newColl, nil
 	}
 
@@ -72,6 +137,7 @@ func (ch *CollectionHolder) PutColl(w http.ResponseWriter, r *http.Request, dbpa
 		return
 	}
 	slog.Info("collectionholder PutColl: database/collection created", "path", r.URL.Path)
+	notifyTree(newColl, collectionMessage("create", r.URL.Path), false)
 	w.Header().Set("Location", r.URL.Path)
 	w.WriteHeader(http.StatusCreated)
 	w.Write(jsonResponse)
@@ -97,12 +163,85 @@ func (ch *CollectionHolder) DeleteColl(w http.ResponseWriter, r *http.Request, d
 	}
 
 	// notify subscribers
-	deleteMsg := fmt.Sprintf(`"%"`, r.URL.Path)
-	if subscribableColl, ok := coll.(interfaces.Subscribable); ok {
-		subscribableColl.NotifySubscribersDelete(deleteMsg, "general")
-	}
+	coll.NotifyResourceDeleted(deleteMessage(r.URL.Path))
+	notifyTree(coll, deleteMessage(r.URL.Path), true)
 
 	slog.Info("collectionholder DeleteColl: collection deleted", "path", r.URL.Path)
 	w.Header().Set("Location", r.URL.Path)
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// Delete every collection in this collection holder, and everything below them,
+// notifying their subscribers. The URI is that of the document holding the collections.
+// Returns whether there were any collections.
+func (ch *CollectionHolder) DropAll(uri string) bool {
+	pairs, err := ch.collections.Query(context.Background(), skiplist.STRINGMIN, skiplist.STRINGMAX)
+	if err != nil {
+		slog.Error("collectionholder DropAll: error querying collections", "error", err)
+		return false
+	}
+
+	dropped := false
+	for _, pair := range pairs {
+		coll, removed := ch.collections.Remove(pair.Key)
+		if !removed {
+			continue
+		}
+
+		slog.Info("collectionholder DropAll: collection dropped", "path", uri+"/"+pair.Key+"/")
+		coll.DropDocs(uri + "/" + pair.Key + "/")
+		coll.NotifyResourceDeleted(deleteMessage(uri + "/" + pair.Key + "/"))
+		notifyTree(coll, deleteMessage(uri+"/"+pair.Key+"/"), true)
+		dropped = true
+	}
+	return dropped
+}
+
+// Create the message sent to subscribers of a deleted collection.
+func deleteMessage(path string) string {
+	return collectionMessage("delete", path)
+}
+
+// Create the message sent to subscribers about an action on a collection.
+func collectionMessage(action string, path string) string {
+	message := map[string]interface{}{
+		"action":     action,
+		"collection": path,
+	}
+
+	msgBytes, err := json.Marshal(message)
+	if err != nil {
+		// This should never happen
+		slog.Error("collectionholder collectionMessage: error marshalling message", "error", err)
+		return ""
+	}
+	return string(msgBytes)
+}
+
+// Deep-copy every collection in this collection holder. The path is the
+// relative path of the document holding the copies.
+func (ch *CollectionHolder) DeepCopy(path string, user string, resetMeta bool, schema *jsonschema.Schema) (*CollectionHolder, error) {
+	newHolder := New()
+
+	pairs, err := ch.collections.Query(context.Background(), skiplist.STRINGMIN, skiplist.STRINGMAX)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pair := range pairs {
+		collCopy, err := pair.Value.DeepCopy(path+"/"+pair.Key+"/", user, resetMeta, schema)
+		if err != nil {
+			return nil, err
+		}
+
+		upsert := func(key string, currentValue interfaces.ICollection, exists bool) (interfaces.ICollection, error) {
+			return collCopy, nil
+		}
+		_, err = newHolder.collections.Upsert(pair.Key, upsert)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &newHolder, nil
+}
@@ -107,3 +107,22 @@ func TestDeleteColl_NotFound(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 	assert.Contains(t, string(body), "Collection not found")
 }
+
+// TestDropAll tests that DropAll removes every collection and notifies their subscribers
+func TestDropAll(t *testing.T) {
+	ch := New()
+	assert.False(t, ch.DropAll("/v1/db/doc"))
+
+	coll1 := collection.New()
+	coll2 := collection.New()
+	ch.PutColl(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db/doc/a/", nil), "a", &coll1)
+	ch.PutColl(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db/doc/b/", nil), "b", &coll2)
+
+	assert.True(t, ch.DropAll("/v1/db/doc"))
+
+	_, found := ch.GetColl("a")
+	assert.False(t, found)
+	_, found = ch.GetColl("b")
+	assert.False(t, found)
+	assert.Equal(t, `{"action":"delete","collection":"/v1/db/doc/a/"}`, deleteMessage("/v1/db/doc/a/"))
+}
@@ -14,6 +14,8 @@ import (
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/patcher"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/schemas"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/structs"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/subscribe"
 	"github.com/santhosh-tekuri/jsonschema/v5"
 )
@@ -24,6 +26,9 @@ type meta struct {
 	CreatedAt      int64  `json:"createdAt"`      // The time this JSON document was created.
 	LastModifiedBy string `json:"lastModifiedBy"` // The last user who modified this JSON document.
 	LastModifiedAt int64  `json:"lastModifiedAt"` // The last time that this JSON document was modified.
+
+	// The users besides the creator who may change this document under an ownership policy.
+	Collaborators []string `json:"collaborators,omitempty"`
 }
 
 // A docoutput is a struct which represents the data to be output when a user requests a given document.
@@ -44,6 +49,7 @@ type Document struct {
 func New(path, user string, docBody interface{}) Document {
 	newH := collectionholder.New()
 	subscriberManager := subscribe.NewSubscriberManager()
+	newH.SetOwner(subscriberManager)
 	return Document{newOutput(path, user, docBody), &newH, subscriberManager} // make([]subscribe.Subscriber, 0)}
 }
 
@@ -54,7 +60,8 @@ func newOutput(path, user string, docBody interface{}) docOutput {
 
 // Create a new metadata.
 func newMeta(user string) meta {
-	return meta{user, time.Now().UnixMilli(), user, time.Now().UnixMilli()}
+	now := time.Now().UnixMilli()
+	return meta{CreatedBy: user, CreatedAt: now, LastModifiedBy: user, LastModifiedAt: now}
 }
 
 // Handle a GET request on this document.
@@ -116,10 +123,79 @@ func (d *Document) OverwriteBody(docBody interface{}, name string) {
 
 	// Modify it again in the doc
 	d.output = existingDocOutput
+}
+
+// Delete every collection held by this document, whose URI is given,
+// notifying their subscribers. Returns whether there were any collections.
+func (d *Document) DropChildren(uri string) bool {
+	return d.children.DropAll(uri)
+}
+
+// Copy this document and its collections to a new relative path, validating
+// every copied document against the schema. When resetMeta is set,
+// the copies are recorded as created by the user now.
+func (d *Document) DeepCopy(path string, user string, resetMeta bool, schema *jsonschema.Schema) (interfaces.IDocument, error) {
+	// copy the body so that nothing is shared
+	body, err := copyBody(d.output.Doc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = schema.Validate(body)
+	if err != nil {
+		slog.Info("document DeepCopy: copy does not conform to schema", "path", path, "error", err)
+		return nil, fmt.Errorf("document %s does not conform to schema", path)
+	}
+
+	newDoc := New(path, user, body)
+	if !resetMeta {
+		newDoc.output.Meta = d.output.Meta
+	}
+
+	children, err := d.children.DeepCopy(path, user, resetMeta, schema)
+	if err != nil {
+		return nil, err
+	}
+	children.SetOwner(newDoc.SubscriberManager)
+	newDoc.children = children
 
-	// Wipes the children of this document
-	newChildren := collectionholder.New()
-	d.children = &newChildren
+	return &newDoc, nil
+}
+
+// Apply the migration patches to a copy of the body of this document and check the result
+// against the schema. Returns the migrated body, or why it does not conform.
+func (d *Document) MigrateBody(schema *jsonschema.Schema, migration []patcher.Patch) (interface{}, error) {
+	// migrate a copy of the body, so that nothing changes unless the caller stores it
+	body, err := copyBody(d.output.Doc)
+	if err != nil {
+		return nil, err
+	}
+	for i, patch := range migration {
+		body, err = patcher.ApplyPatch(body, patch)
+		if err != nil {
+			return nil, fmt.Errorf("migration patch %d: %s", i, err.Error())
+		}
+	}
+
+	return body, schema.Validate(body)
+}
+
+// Check the collections of this document, whose URI is given, against a new schema after
+// applying the migration patches, adding failures to the report. When apply is set, the
+// migrated documents are stored.
+func (d *Document) MigrateChildren(uri string, schema *jsonschema.Schema, migration []patcher.Patch, user string, apply bool, report *structs.SchemaReport) {
+	d.children.Migrate(uri, schema, migration, user, apply, report)
+}
+
+// Copy a JSON document body through JSON so that nothing is shared.
+func copyBody(docBody interface{}) (interface{}, error) {
+	jsonBody, err := json.Marshal(docBody)
+	if err != nil {
+		return nil, err
+	}
+	var body interface{}
+	err = json.Unmarshal(jsonBody, &body)
+	return body, err
 }
 
 // Concatenate the path of this document with the input path.
@@ -152,6 +228,7 @@ func (d *Document) ApplyPatches(patchData []patcher.Patch, schema *jsonschema.Sc
 	if err != nil {
 		slog.Error("patched document does not conform to the schema", "error", err)
 		result.Message = fmt.Sprintf("Patched document does not conform to the schema: %s", err.Error())
+		result.Validation = schemas.DescribeError(err)
 		result.PatchFailed = true
 		return result, nil
 	}
@@ -172,6 +249,16 @@ func (d *Document) GetOriginalAuthor() string {
 	return d.output.Meta.CreatedBy
 }
 
+// Get the users besides the creator who may change this document.
+func (d *Document) GetCollaborators() []string {
+	return d.output.Meta.Collaborators
+}
+
+// Set the users besides the creator who may change this document.
+func (d *Document) SetCollaborators(users []string) {
+	d.output.Meta.Collaborators = users
+}
+
 // Get the JSON Object that this document stores.
 func (d *Document) GetJSONBody() ([]byte, error) {
 	jsonBody, err := json.Marshal(d.output)
@@ -195,7 +282,8 @@ func (d *Document) GetJSONDoc() interface{} {
 }
 
 // implement subscribable interface
-// Subscribe to this document.
+// Subscribe to this document. A client resuming with "Last-Event-ID" is sent the
+// changes it missed; any other is sent the document first.
 func (d *Document) Subscribe(w http.ResponseWriter, r *http.Request, intervalStart, intervalEnd string) error {
 	// Create a new subscriber
 	subscriber, err := subscribe.NewSubscriber(w, r, intervalStart, intervalEnd)
@@ -203,38 +291,85 @@ func (d *Document) Subscribe(w http.ResponseWriter, r *http.Request, intervalSta
 		return err
 	}
 
-	d.SubscriberManager.AddSubscriber(subscriber) // Add the subscriber to the manager
+	subscriber.Recursive = r.URL.Query().Get("recursive") == "true"
+	return d.Stream(subscriber, r.Header.Get("Last-Event-ID"))
+}
+
+// Send the changes of this document, or with a recursive subscriber also of everything below it,
+// to the subscriber until it closes. A subscriber resuming after lastEventID is sent the changes
+// it missed; any other is sent the document first.
+func (d *Document) Stream(subscriber *subscribe.Subscriber, lastEventID string) error {
+	resumed := d.SubscriberManager.Resume(subscriber, lastEventID) // Add the subscriber to the manager
 
 	defer d.SubscriberManager.RemoveSubscriber(subscriber)
 
-	slog.Info("document Subscribe: Subscriber added", "ID", subscriber.ID)
+	slog.Info("document Stream: Subscriber added", "ID", subscriber.ID, "resumed", resumed)
+
+	if !resumed {
+		update, err := d.updateMessage()
+		if err != nil {
+			slog.Error("document Stream: Error marshalling update message", "error", err)
+			return err
+		}
+		if subscriber.Recursive {
+			update = d.SubscriberManager.WithPath(update)
+		}
+		subscriber.SendUpdate(subscribe.Event{ID: d.SubscriberManager.LastEventIDFor(subscriber), Type: "update", Data: update})
+	}
+
+	// Start the subscriber
+	subscriber.Start()
+
+	return nil
+}
 
+// Create the message sending the document to its subscribers.
+func (d *Document) updateMessage() ([]byte, error) {
 	message := map[string]interface{}{
 		// the messsage to send to the subscriber
 		"action":  "update",
 		"content": d.GetRawDoc(),
 	}
+	return json.Marshal(message)
+}
 
-	update, err := json.Marshal(message)
+// Send the document to its subscribers after it changed.
+func (d *Document) NotifyChanged() {
+	update, err := d.updateMessage()
 	if err != nil {
-		slog.Error("document Subscribe: Error marshalling update message", "error", err)
-		return err
+		slog.Error("document NotifyChanged: Error marshalling update message", "error", err)
+		return
 	}
+	d.SubscriberManager.NotifyAll(update)
+}
 
-	subscriber.SendUpdate(update)
+// Notify subscribers of update messages. Every subscriber of a document hears about it.
+func (d *Document) NotifySubscribersUpdate(msg []byte, intervalVal string) {
+	d.SubscriberManager.NotifyAll(msg)
+}
 
-	// Start the subscriber
-	subscriber.Start()
+// Notify subscribers of delete messages. Every subscriber of a document hears about it.
+func (d *Document) NotifySubscribersDelete(msg string, intervalVal string) {
+	d.SubscriberManager.NotifyAll([]byte(msg))
+}
 
-	return nil
+// implement attachable interface
+// Attach this document below the collection holding it.
+func (d *Document) Attach(parent *subscribe.SubscriberManager, name string) {
+	d.SubscriberManager.Attach(parent, name)
 }
 
-// Notify subscribers of update messages.
-func (d *Document) NotifySubscribersUpdate(msg []byte, intervalVal string) {
-	d.SubscriberManager.NotifySubscribersUpdate(msg, intervalVal)
+// Stop telling the collection that held this document about changes.
+func (d *Document) Detach() {
+	d.SubscriberManager.Detach()
 }
 
-// Notify subscribers of delete messages.
-func (d *Document) NotifySubscribersDelete(msg string, intervalVal string) {
-	d.SubscriberManager.NotifySubscribersDelete(msg, intervalVal)
+// Notify the recursive subscribers of this document and of those above it.
+func (d *Document) NotifyTree(msg []byte) {
+	d.SubscriberManager.NotifyTree(msg, d)
+}
+
+// Notify every subscriber that this document was deleted.
+func (d *Document) NotifyResourceDeleted(msg string) {
+	d.SubscriberManager.NotifyAll([]byte(msg))
 }
@@ -1,12 +1,15 @@
 package document
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/collection"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/patcher"
 	"github.com/santhosh-tekuri/jsonschema/v5"
 	"github.com/stretchr/testify/assert"
@@ -96,6 +99,13 @@ func TestApplyPatches(t *testing.T) {
 	assert.NotNil(t, newDoc)
 }
 
+// Test that collections can patch documents through the Patchable interface
+func TestPatchable(t *testing.T) {
+	doc := createTestDocument()
+	_, canPatch := interface{}(&doc).(interfaces.Patchable)
+	assert.True(t, canPatch)
+}
+
 // Test GetLastModified function
 func TestGetLastModified(t *testing.T) {
 	doc := createTestDocument()
@@ -140,3 +150,54 @@ func TestGetJSONDoc(t *testing.T) {
 
 	assert.Equal(t, doc.output.Doc, jsonDoc)
 }
+
+// Test that OverwriteBody keeps the collections of the document and DropChildren removes them
+func TestOverwriteBodyKeepsChildren(t *testing.T) {
+	doc := createTestDocument()
+	newColl := collection.New()
+	doc.PutColl(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db/test/newColl/", nil), "newColl", &newColl)
+
+	doc.OverwriteBody(map[string]interface{}{"newKey": "newValue"}, "newUser")
+	_, exists := doc.GetColl("newColl")
+	assert.True(t, exists)
+
+	assert.True(t, doc.DropChildren("/v1/db/test"))
+	_, exists = doc.GetColl("newColl")
+	assert.False(t, exists)
+	assert.False(t, doc.DropChildren("/v1/db/test"))
+}
+
+// A response writer for subscriptions that passes on every write.
+type eventWriter struct {
+	header http.Header
+	writes chan string
+}
+
+func (e *eventWriter) Header() http.Header         { return e.header }
+func (e *eventWriter) WriteHeader(statusCode int)  {}
+func (e *eventWriter) Flush()                      {}
+func (e *eventWriter) Write(p []byte) (int, error) { e.writes <- string(p); return len(p), nil }
+
+// Test that subscribers get the document, then each change, numbered
+func TestSubscribeChanges(t *testing.T) {
+	doc := createTestDocument()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &eventWriter{header: make(http.Header), writes: make(chan string, 10)}
+	go doc.GetDoc(w, httptest.NewRequest(http.MethodGet, "/test/path?mode=subscribe", nil).WithContext(ctx))
+
+	next := func() string {
+		select {
+		case write := <-w.writes:
+			return write
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected an event")
+			return ""
+		}
+	}
+	assert.Contains(t, next(), "id: 0\nevent: update\ndata: {\"action\":\"update\",\"content\":{\"path\":\"/test/path\",\"doc\":{\"key\":\"value\"}")
+
+	doc.OverwriteBody(map[string]interface{}{"key": "new"}, "otherUser")
+	doc.NotifyChanged()
+	assert.Contains(t, next(), "id: 1\nevent: update\ndata: {\"action\":\"update\",\"content\":{\"path\":\"/test/path\",\"doc\":{\"key\":\"new\"}")
+}
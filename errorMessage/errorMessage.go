@@ -1,11 +1,14 @@
-// Package errorMessage has a helper function that writes error response
-// of JSON strings with the given input string and http code.
+// Package errorMessage has helper functions that write error responses:
+// JSON strings with the given input string and http code, and
+// the failing schema keywords of documents that do not conform.
 package errorMessage
 
 import (
 	"encoding/json"
 	"log/slog"
 	"net/http"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/structs"
 )
 
 // Write error response of JSON strings with the given input string and http statusCode.
@@ -24,3 +27,23 @@ func ErrorResponse(w http.ResponseWriter, str string, statusCode int) {
 	w.WriteHeader(statusCode)
 	w.Write(jsonData)
 }
+
+// Write a 400 response with the message and the failing schema keywords of a document that does not conform.
+// Falls back to a JSON string if there are no failing keywords to report.
+func ValidationResponse(w http.ResponseWriter, str string, validation *structs.ValidationError) {
+	if validation == nil {
+		ErrorResponse(w, str, http.StatusBadRequest)
+		return
+	}
+
+	jsonData, err := json.Marshal(structs.ValidationOutput{Message: str, Validation: validation})
+	if err != nil {
+		// This should never happen.
+		slog.Error("error marshaling validation response", "error", err)
+		http.Error(w, `"error marshaling validation response"`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(jsonData)
+}
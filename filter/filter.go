@@ -0,0 +1,440 @@
+// Package filter parses predicates over the fields of documents, such as
+// `status == "open" && priority >= 3`, and checks documents against them.
+//
+// A predicate compares fields, named by their keys joined with dots, with strings,
+// numbers, true, false, null or other fields using ==, !=, <, <=, > and >=, and
+// combines comparisons with &&, || and !, grouped by parentheses. A field the document
+// does not have compares as null. Only numbers with numbers and strings with strings
+// are ordered; any other ordering comparison is false.
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/patcher"
+)
+
+// A Filter is a parsed predicate.
+type Filter struct {
+	source string // The predicate as written
+	root   node   // The parsed predicate
+}
+
+// A node of a parsed predicate.
+type node interface {
+	// Check the body of a document against the node.
+	match(doc any) bool
+}
+
+// Both sides must match.
+type and struct {
+	left, right node
+}
+
+// Either side must match.
+type or struct {
+	left, right node
+}
+
+// The inner node must not match.
+type not struct {
+	inner node
+}
+
+// A comparison of two operands.
+type comparison struct {
+	op          string
+	left, right operand
+}
+
+// An operand is a field of the document, or a literal value if field is nil.
+type operand struct {
+	field []string
+	value any
+}
+
+// Returned by the field visitor when the document does not have the field
+var errMissing = errors.New("missing field")
+
+// Parse a predicate.
+func Parse(source string) (*Filter, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return &Filter{source: source, root: root}, nil
+}
+
+// The predicate as written.
+func (f *Filter) String() string {
+	return f.source
+}
+
+// Check the body of a document against the predicate.
+func (f *Filter) Match(doc any) bool {
+	return f.root.match(doc)
+}
+
+func (n and) match(doc any) bool {
+	return n.left.match(doc) && n.right.match(doc)
+}
+
+func (n or) match(doc any) bool {
+	return n.left.match(doc) || n.right.match(doc)
+}
+
+func (n not) match(doc any) bool {
+	return !n.inner.match(doc)
+}
+
+func (n comparison) match(doc any) bool {
+	left := n.left.resolve(doc)
+	right := n.right.resolve(doc)
+
+	switch n.op {
+	case "==":
+		return patcher.Equal(left, right)
+	case "!=":
+		return !patcher.Equal(left, right)
+	}
+
+	order, err := patcher.Accept[int](left, &orderVisitor{other: right})
+	if err != nil {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+// The value of the operand for a document; null if it is a field the document does not have.
+func (o operand) resolve(doc any) any {
+	if o.field == nil {
+		return o.value
+	}
+	value, err := patcher.Accept[any](doc, &fieldVisitor{path: o.field})
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// A fieldVisitor finds the value of a field below a JSON value.
+type fieldVisitor struct {
+	path []string // The keys left to follow
+}
+
+func (v *fieldVisitor) Map(m map[string]any) (any, error) {
+	if len(v.path) == 0 {
+		return m, nil
+	}
+	value, found := m[v.path[0]]
+	if !found {
+		return nil, errMissing
+	}
+	return patcher.Accept[any](value, &fieldVisitor{path: v.path[1:]})
+}
+
+func (v *fieldVisitor) Slice(s []any) (any, error) {
+	if len(v.path) == 0 {
+		return s, nil
+	}
+	index, err := strconv.Atoi(v.path[0])
+	if err != nil || index < 0 || index >= len(s) {
+		return nil, errMissing
+	}
+	return patcher.Accept[any](s[index], &fieldVisitor{path: v.path[1:]})
+}
+
+func (v *fieldVisitor) Bool(b bool) (any, error) {
+	return v.leaf(b)
+}
+
+func (v *fieldVisitor) Number(n float64) (any, error) {
+	return v.leaf(n)
+}
+
+func (v *fieldVisitor) String(s string) (any, error) {
+	return v.leaf(s)
+}
+
+func (v *fieldVisitor) Null() (any, error) {
+	return v.leaf(nil)
+}
+
+// A value without fields is the field only if no keys are left.
+func (v *fieldVisitor) leaf(value any) (any, error) {
+	if len(v.path) != 0 {
+		return nil, errMissing
+	}
+	return value, nil
+}
+
+// An orderVisitor orders a JSON value against another: negative if it is smaller,
+// zero if equal and positive if larger. Values that are not both numbers or both
+// strings are not ordered.
+type orderVisitor struct {
+	other any // The value to order against
+}
+
+// Returned by the order visitor for values that are not ordered
+var errUnordered = errors.New("values are not ordered")
+
+func (v *orderVisitor) Map(m map[string]any) (int, error) {
+	return 0, errUnordered
+}
+
+func (v *orderVisitor) Slice(s []any) (int, error) {
+	return 0, errUnordered
+}
+
+func (v *orderVisitor) Bool(b bool) (int, error) {
+	return 0, errUnordered
+}
+
+func (v *orderVisitor) Number(n float64) (int, error) {
+	other, ok := v.other.(float64)
+	if !ok {
+		return 0, errUnordered
+	}
+	switch {
+	case n < other:
+		return -1, nil
+	case n > other:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+func (v *orderVisitor) String(s string) (int, error) {
+	other, ok := v.other.(string)
+	if !ok {
+		return 0, errUnordered
+	}
+	return strings.Compare(s, other), nil
+}
+
+func (v *orderVisitor) Null() (int, error) {
+	return 0, errUnordered
+}
+
+// The kinds of tokens
+const (
+	TOKEN_FIELD   = iota // A field name, with dots
+	TOKEN_LITERAL        // A string, number, true, false or null
+	TOKEN_SYMBOL         // An operator or parenthesis
+)
+
+// A token of a predicate.
+type token struct {
+	kind  int
+	text  string // The token as written
+	value any    // The value of a literal
+}
+
+// The operators and parentheses, longest first so that "<=" is not read as "<"
+var symbols = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"}
+
+// Split a predicate into tokens.
+func tokenize(source string) ([]token, error) {
+	tokens := make([]token, 0)
+	for i := 0; i < len(source); {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			// find the closing quote, skipping escaped characters
+			end := i + 1
+			for end < len(source) && source[end] != '"' {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			value, err := strconv.Unquote(source[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d: %s", i, source[i:end+1])
+			}
+			tokens = append(tokens, token{kind: TOKEN_LITERAL, text: source[i : end+1], value: value})
+			i = end + 1
+		case c == '-' || c == '.' || unicode.IsDigit(c):
+			end := i + 1
+			for end < len(source) && strings.ContainsRune("0123456789.eE+-", rune(source[end])) {
+				end++
+			}
+			value, err := strconv.ParseFloat(source[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number at %d: %s", i, source[i:end])
+			}
+			tokens = append(tokens, token{kind: TOKEN_LITERAL, text: source[i:end], value: value})
+			i = end
+		case c == '_' || unicode.IsLetter(c):
+			end := i + 1
+			for end < len(source) && (source[end] == '_' || source[end] == '.' ||
+				unicode.IsLetter(rune(source[end])) || unicode.IsDigit(rune(source[end]))) {
+				end++
+			}
+			word := source[i:end]
+			switch word {
+			case "true":
+				tokens = append(tokens, token{kind: TOKEN_LITERAL, text: word, value: true})
+			case "false":
+				tokens = append(tokens, token{kind: TOKEN_LITERAL, text: word, value: false})
+			case "null":
+				tokens = append(tokens, token{kind: TOKEN_LITERAL, text: word, value: nil})
+			default:
+				tokens = append(tokens, token{kind: TOKEN_FIELD, text: word})
+			}
+			i = end
+		default:
+			found := false
+			for _, symbol := range symbols {
+				if strings.HasPrefix(source[i:], symbol) {
+					tokens = append(tokens, token{kind: TOKEN_SYMBOL, text: symbol})
+					i += len(symbol)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// A parser reads a predicate from its tokens by recursive descent.
+type parser struct {
+	tokens []token
+	pos    int // The index of the next token
+}
+
+// Consume the next token if it is the given symbol.
+func (p *parser) accept(symbol string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == TOKEN_SYMBOL && p.tokens[p.pos].text == symbol {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// or := and ("||" and)*
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = or{left, right}
+	}
+	return left, nil
+}
+
+// and := unary ("&&" unary)*
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = and{left, right}
+	}
+	return left, nil
+}
+
+// unary := "!" unary | "(" or ")" | operand op operand
+func (p *parser) parseUnary() (node, error) {
+	if p.accept("!") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return not{inner}, nil
+	}
+	if p.accept("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, errors.New("missing )")
+		}
+		return inner, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("expected a comparison at the end")
+	}
+	op := p.tokens[p.pos]
+	if op.kind != TOKEN_SYMBOL || !strings.Contains(" == != < <= > >= ", " "+op.text+" ") {
+		return nil, fmt.Errorf("expected a comparison, got %q", op.text)
+	}
+	p.pos++
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return comparison{op: op.text, left: left, right: right}, nil
+}
+
+// operand := field | literal
+func (p *parser) parseOperand() (operand, error) {
+	if p.pos >= len(p.tokens) {
+		return operand{}, errors.New("expected a field or value at the end")
+	}
+	t := p.tokens[p.pos]
+	switch t.kind {
+	case TOKEN_FIELD:
+		p.pos++
+		field := strings.Split(t.text, ".")
+		for _, key := range field {
+			if key == "" {
+				return operand{}, fmt.Errorf("invalid field %q", t.text)
+			}
+		}
+		return operand{field: field}, nil
+	case TOKEN_LITERAL:
+		p.pos++
+		return operand{value: t.value}, nil
+	default:
+		return operand{}, fmt.Errorf("expected a field or value, got %q", t.text)
+	}
+}
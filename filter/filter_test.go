@@ -0,0 +1,68 @@
+package filter
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	var doc any
+	json.Unmarshal([]byte(`{"status":"open","priority":3,"done":false,"owner":{"name":"alice"},"tags":["a","b"],"none":null}`), &doc)
+
+	tests := []struct {
+		filter   string
+		expected bool
+	}{
+		{`status == "open"`, true},
+		{`status != "open"`, false},
+		{`priority >= 3`, true},
+		{`priority > 3`, false},
+		{`priority < 3.5`, true},
+		{`status == "open" && priority >= 3`, true},
+		{`status == "closed" || priority <= -1`, false},
+		{`!(status == "closed") && done == false`, true},
+		{`owner.name == "alice"`, true},
+		{`tags.1 == "b"`, true},
+		{`status > "a"`, true},
+		// missing fields are null, and nothing orders against null or other types
+		{`missing == null`, true},
+		{`none == null && none != 0`, true},
+		{`missing < 3 || missing >= 3`, false},
+		{`status > 3`, false},
+		// and binds tighter than or
+		{`status == "closed" && priority == 3 || done == false`, true},
+		{`status == "closed" && (priority == 3 || done == false)`, false},
+		{`priority == owner.name`, false},
+	}
+	for _, test := range tests {
+		f, err := Parse(test.filter)
+		if err != nil {
+			t.Errorf("%s: expected to parse, got %v", test.filter, err)
+			continue
+		}
+		if f.Match(doc) != test.expected {
+			t.Errorf("%s: expected %v", test.filter, test.expected)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, source := range []string{
+		``,
+		`status`,
+		`status ==`,
+		`status = "open"`,
+		`"open`,
+		`(status == "open"`,
+		`status == "open")`,
+		`status == "open" &&`,
+		`priority >= 3 4`,
+		`a..b == 1`,
+		`status == #`,
+	} {
+		_, err := Parse(source)
+		if err == nil {
+			t.Errorf("%q: expected an error", source)
+		}
+	}
+}
@@ -1,29 +1,64 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
+	"strings"
 
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/audit"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/collection"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/document"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/idempotency"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/paths"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/schemas"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/structs"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/subscribe"
 	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
 type Handler struct {
 	DB            interfaces.ICollectionHolder // The database service
-	schema        *jsonschema.Schema           // The schema for validation
+	schema        *schemas.Holder              // The global schema for validation
 	authenticator interfaces.Authenticator     // The authentication service
+	authorizer    interfaces.Authorizer        // The access control, if enabled
+	limiter       interfaces.Authorizer        // The rate limits, if enabled
+	auditor       interfaces.Auditor           // The audit log of writes, if enabled
+	idempotency   *idempotency.Store           // The responses to POSTs with idempotency keys, if enabled
+	applyDefaults bool                         // Whether schema defaults are filled into new documents
 }
 
 // Create a new handler
 func New(db interfaces.ICollectionHolder, schema *jsonschema.Schema, authenticator interfaces.Authenticator) Handler {
-	return Handler{db, schema, authenticator}
+	return Handler{DB: db, schema: schemas.NewHolder(schema, nil), authenticator: authenticator}
+}
+
+// Check every authenticated request with the given authorizer.
+// Without one, every user may perform every request.
+func (d *Handler) SetAuthorizer(authorizer interfaces.Authorizer) {
+	d.authorizer = authorizer
+}
+
+// Limit how fast users may make requests with the given limiter, which is
+// asked before the authorizer and may refuse requests with "429 Too Many Requests."
+func (d *Handler) SetRateLimiter(limiter interfaces.Authorizer) {
+	d.limiter = limiter
+}
+
+// Record every write request and its outcome with the given auditor.
+func (d *Handler) SetAuditor(auditor interfaces.Auditor) {
+	d.auditor = auditor
+}
+
+// Remember POST responses by their Idempotency-Key header in the given store.
+func (d *Handler) SetIdempotencyStore(store *idempotency.Store) {
+	d.idempotency = store
 }
 
 // The server implements the "handler" interface,
@@ -42,46 +77,99 @@ func (d *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		slog.Debug("handlers ServeHTTP: User requested OPTIONS", "method", r.Method)
 		Options(w, r)
 	} else {
-		username, valid := d.authenticator.ValidateToken(w, r)
-		if valid {
-			if r.URL.Path == "/v1/subscribe" && r.Method == http.MethodGet {
-				d.handleSubscribe(w, r)
+		// Writes are audited with their outcome, so keep the body and the status
+		var body []byte
+		var recorder *audit.StatusWriter
+		if d.auditor != nil && r.Method != http.MethodGet {
+			var err error
+			body, err = io.ReadAll(r.Body)
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			recorder = audit.NewStatusWriter(w)
+			w = recorder
+			if err != nil {
+				slog.Info("handlers ServeHTTP: error reading request body", "error", err)
+				errorMessage.ErrorResponse(w, "error reading request body", http.StatusBadRequest)
+				d.auditor.Audit(r, "", recorder.Status(), body)
 				return
 			}
+		}
 
-			switch r.Method {
-			case http.MethodGet:
-				d.get(w, r)
-			case http.MethodPut:
-				d.put(w, r, username)
-			case http.MethodDelete:
-				d.delete(w, r)
-			case http.MethodPatch:
-				d.patch(w, r, username)
-			case http.MethodPost:
-				d.post(w, r, username)
-			default:
-				// If user used method we do not support.
-				slog.Info("handlers ServeHTTP: user used unsupported method", "method", r.Method)
-				msg := fmt.Sprintf("unsupported method: %s", r.Method)
-				errorMessage.ErrorResponse(w, msg, http.StatusBadRequest)
-			}
+		username, valid := d.authenticator.ValidateToken(w, r)
+		if valid && d.limiter != nil {
+			valid = d.limiter.Authorize(w, r, username)
+		}
+		if valid && d.authorizer != nil && r.URL.Path != WEBSOCKET_PATH {
+			// each subscription over a WebSocket is authorized on its own
+			valid = d.authorizer.Authorize(w, r, username)
+		}
+		if valid {
+			d.dispatch(w, r, username)
+		}
 
+		if recorder != nil {
+			d.auditor.Audit(r, username, recorder.Status(), body)
 		}
 	}
 }
 
+// Send an authorized request to the method handling it.
+func (d *Handler) dispatch(w http.ResponseWriter, r *http.Request, username string) {
+	if r.URL.Path == WEBSOCKET_PATH && r.Method == http.MethodGet {
+		d.handleWebSocket(w, r, username)
+		return
+	}
+	if r.URL.Path == "/v1/subscribe" && r.Method == http.MethodGet {
+		d.handleSubscribe(w, r, username)
+		return
+	}
+
+	switch r.URL.Query().Get("mode") {
+	case "schema":
+		d.schemaRequest(w, r, username)
+		return
+	case "ownership":
+		d.ownershipRequest(w, r, username)
+		return
+	case "collaborators":
+		d.collaboratorsRequest(w, r, username)
+		return
+	}
+
+	if !d.checkOwnership(w, r, username) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		d.get(w, r, username)
+	case http.MethodPut:
+		d.put(w, r, username)
+	case http.MethodDelete:
+		d.delete(w, r)
+	case http.MethodPatch:
+		d.patch(w, r, username)
+	case http.MethodPost:
+		d.idempotentPost(w, r, username)
+	default:
+		// If user used method we do not support.
+		slog.Info("handlers ServeHTTP: user used unsupported method", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method: %s", r.Method)
+		errorMessage.ErrorResponse(w, msg, http.StatusBadRequest)
+	}
+}
+
 // Top-level function to perform the HTTP GET request
 // getDB, getColl, and getDoc are implemented in their respective files.
-func (d *Handler) get(w http.ResponseWriter, r *http.Request) {
+func (d *Handler) get(w http.ResponseWriter, r *http.Request, username string) {
 	coll, doc, resCode := paths.ParsePath(r.URL.Path, d.DB)
 	switch resCode {
 	case paths.RESOURCE_DB:
 		// GET collection of documents from database
-		d.getColl(w, r, coll)
+		d.getColl(w, r, coll, username)
 	case paths.RESOURCE_COLL:
 		// GET document from collection
-		coll.GetDoc(w, r)
+		d.getColl(w, r, coll, username)
 	case paths.RESOURCE_DOC:
 		// GET collection from document
 		doc.GetDoc(w, r)
@@ -100,7 +188,7 @@ func (d *Handler) put(w http.ResponseWriter, r *http.Request, username string) {
 	// Put request handling based on the resource type
 	if resCode == paths.RESOURCE_DB_PUT_DEL {
 		dbPath := newRequestName //expecting string in putDB so it hink it has to be this?
-		d.putDB(w, r, dbPath)
+		d.putDB(w, r, dbPath, username)
 		return
 	} else if resCode == paths.RESOURCE_DB {
 		slog.Info("handlers put: bad syntax, user is trying to PUT database", "path", r.URL.Path)
@@ -132,6 +220,9 @@ func (d *Handler) put(w http.ResponseWriter, r *http.Request, username string) {
 	case paths.RESOURCE_DOC:
 		// PUT collection in document
 		coll := collection.New() // Create a new collection
+		if !setIDStrategy(w, r, &coll) || !setInitialSchema(w, r, &coll) {
+			return
+		}
 
 		// convert the original doc to collHolder
 		collHolder, hasCollection := interface{}(doc).(interfaces.ICollectionHolder)
@@ -195,24 +286,174 @@ func (d *Handler) delete(w http.ResponseWriter, r *http.Request) {
 // on success, add a new document with a random name to the collection or database
 func (d *Handler) post(w http.ResponseWriter, r *http.Request, username string) {
 	// action fork based on the resource type
-	coll, _, resCode := paths.ParsePath(r.URL.Path, d.DB)
+	coll, doc, resCode := paths.ParsePath(r.URL.Path, d.DB)
 	switch resCode {
 	case paths.RESOURCE_DB:
 		// POST document in database
 		d.postDoc(w, r, coll, username)
 	case paths.RESOURCE_COLL:
 		// POST document in collection
-		doc, err := d.createDoc(w, r, username)
-		if err != nil {
-			// handled in createDoc
-			return
+		d.postDoc(w, r, coll, username)
+	case paths.RESOURCE_DOC:
+		// copy or move a document elsewhere
+		mode := r.URL.Query().Get("mode")
+		if mode == "copy" || mode == "move" {
+			d.copyDoc(w, r, doc, username, mode == "move")
+		} else {
+			paths.HandlePathError(w, r, resCode)
 		}
-		coll.PostDoc(w, r, &doc)
 	default:
 		paths.HandlePathError(w, r, resCode)
 	}
 }
 
+// Fill in schema default values for properties missing from PUT and POST documents.
+func (d *Handler) SetApplyDefaults(applyDefaults bool) {
+	d.applyDefaults = applyDefaults
+}
+
+// Perform a POST request, replaying the original response if the
+// request carries an Idempotency-Key that was already used.
+func (d *Handler) idempotentPost(w http.ResponseWriter, r *http.Request, username string) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || d.idempotency == nil {
+		d.post(w, r, username)
+		return
+	}
+
+	// Read the body so it can be fingerprinted, then put it back
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		slog.Error("handlers idempotentPost: error reading the request body", "error", err)
+		errorMessage.ErrorResponse(w, "invalid document format", http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	state, stored := d.idempotency.Begin(username, key, idempotency.Fingerprint(r, body))
+	switch state {
+	case idempotency.STATE_REPLAY:
+		slog.Info("handlers idempotentPost: replaying response", "key", key, "path", r.URL.Path)
+		if stored.Location != "" {
+			w.Header().Set("Location", stored.Location)
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(stored.Status)
+		w.Write(stored.Body)
+		return
+	case idempotency.STATE_MISMATCH:
+		errorMessage.ErrorResponse(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+		return
+	case idempotency.STATE_IN_PROGRESS:
+		errorMessage.ErrorResponse(w, "a request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return
+	}
+
+	// Handle the request, keeping a copy of the response
+	recorder := newResponseRecorder(w)
+	d.post(recorder, r, username)
+
+	if recorder.status >= 200 && recorder.status < 300 {
+		d.idempotency.Complete(username, key, idempotency.Response{
+			Status:   recorder.status,
+			Location: w.Header().Get("Location"),
+			Body:     recorder.body.Bytes(),
+		})
+	} else {
+		d.idempotency.Abandon(username, key)
+	}
+}
+
+// Copy or move a document and everything below it to the document path given by "?to=".
+// The copies keep their metadata unless "?resetMeta=true" is given.
+func (d *Handler) copyDoc(w http.ResponseWriter, r *http.Request, doc interfaces.IDocument, username string, move bool) {
+	to := r.URL.Query().Get("to")
+	resetMeta := r.URL.Query().Get("resetMeta") == "true"
+
+	// a document cannot be copied onto itself or below itself
+	if to == r.URL.Path || strings.HasPrefix(to, r.URL.Path+"/") {
+		slog.Info("handlers copyDoc: destination inside source", "path", r.URL.Path, "to", to)
+		errorMessage.ErrorResponse(w, "Destination cannot be the document or below it", http.StatusBadRequest)
+		return
+	}
+
+	// Find the collection holding the source
+	srcRequest, srcName, resCode := paths.GetParentResource(r.URL.Path)
+	if resCode != paths.RESOURCE_DOC {
+		paths.HandlePathError(w, r, resCode)
+		return
+	}
+	srcColl, _, resCode := paths.ParsePath(srcRequest, d.DB)
+	if resCode != paths.RESOURCE_DB && resCode != paths.RESOURCE_COLL {
+		paths.HandlePathError(w, r, resCode)
+		return
+	}
+
+	// Find the collection to hold the destination
+	dstRequest, dstName, resCode := paths.GetParentResource(to)
+	if resCode != paths.RESOURCE_DOC {
+		slog.Info("handlers copyDoc: destination is not a document path", "to", to)
+		errorMessage.ErrorResponse(w, fmt.Sprintf("Invalid destination %s", to), http.StatusBadRequest)
+		return
+	}
+	dstColl, _, resCode := paths.ParsePath(dstRequest, d.DB)
+	if resCode != paths.RESOURCE_DB && resCode != paths.RESOURCE_COLL {
+		slog.Info("handlers copyDoc: destination collection not found", "to", to)
+		errorMessage.ErrorResponse(w, fmt.Sprintf("Destination collection not found for %s", to), http.StatusNotFound)
+		return
+	}
+
+	// Copy the whole subtree, validating it against the schema in effect at the destination,
+	// and insert the copy there
+	schema, _, _ := d.schemaFor(to)
+	copyable, canCopy := interface{}(doc).(interfaces.Copyable)
+	if !canCopy {
+		errorMessage.ErrorResponse(w, "Document cant be copied", http.StatusBadRequest)
+		return
+	}
+	statusCode := http.StatusConflict
+	place := func() error {
+		newDoc, err := copyable.DeepCopy(paths.GetRelativePathNonDB(to), username, resetMeta, schema)
+		if err != nil {
+			statusCode = http.StatusBadRequest
+			return err
+		}
+		err = dstColl.InsertDoc(dstName, newDoc)
+		if err != nil {
+			return fmt.Errorf("Destination %s: %s", to, err.Error())
+		}
+		return nil
+	}
+
+	// A move takes the source out before the copy appears, so that readers never find the
+	// document in two places and only one of several moves of the same document goes ahead
+	var err error
+	if move {
+		err = srcColl.MoveDoc(srcName, doc, place)
+	} else {
+		err = place()
+	}
+	if err != nil {
+		slog.Info("handlers copyDoc: copy failed", "path", r.URL.Path, "to", to, "error", err)
+		errorMessage.ErrorResponse(w, err.Error(), statusCode)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(structs.PutOutput{Uri: to})
+	if err != nil {
+		// This should never happen
+		slog.Error("handlers copyDoc: error marshalling json", "error", err)
+		errorMessage.ErrorResponse(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("handlers copyDoc: document copied", "path", r.URL.Path, "to", to, "move", move)
+	w.Header().Set("Location", to)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonResponse)
+}
+
 // top-level function to perform the HTTP PATCH request
 // handle PATCH requests for databases, collections
 // on success, apply the patch to the document
@@ -224,12 +465,13 @@ func (d *Handler) patch(w http.ResponseWriter, r *http.Request, username string)
 		return
 	}
 
+	schema, _, _ := d.schemaFor(r.URL.Path)
 	coll, _, resCode := paths.ParsePath(newRequest, d.DB)
 	switch resCode {
 	case paths.RESOURCE_DB:
-		coll.PatchDoc(w, r, newName, d.schema, username)
+		coll.PatchDoc(w, r, newName, schema, username)
 	case paths.RESOURCE_COLL:
-		coll.PatchDoc(w, r, newName, d.schema, username)
+		coll.PatchDoc(w, r, newName, schema, username)
 	default:
 		paths.HandlePathError(w, r, resCode)
 	}
@@ -244,20 +486,54 @@ func Options(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// specific handler for GET database (get a collection of documents from a database)
-func (d *Handler) getColl(w http.ResponseWriter, r *http.Request, coll interfaces.ICollection) {
-	coll.GetDoc(w, r)
+// specific handler for GET database or collection (get a collection of documents).
+// Under a private ownership policy, or with "?owned=true", only the documents
+// the user owns or collaborates on are listed.
+func (d *Handler) getColl(w http.ResponseWriter, r *http.Request, coll interfaces.ICollection, username string) {
+	keep := d.ownedFilter(r.URL.Path, username, r.URL.Query().Get("owned") == "true")
+	if keep == nil {
+		coll.GetDoc(w, r)
+		return
+	}
+	coll.GetDocFiltered(w, r, keep)
 }
 
 // Specific handler for PUT database (create a new database)
-func (d *Handler) putDB(w http.ResponseWriter, r *http.Request, dbpath string) {
+func (d *Handler) putDB(w http.ResponseWriter, r *http.Request, dbpath string, username string) {
 	// Same behavior as collection for now
 	coll := collection.New()
+	coll.SetCreator(username)
+	if !setIDStrategy(w, r, &coll) || !setInitialSchema(w, r, &coll) {
+		return
+	}
 	d.DB.PutColl(w, r, dbpath, &coll)
 }
 
-// Specific handler for POST database (create a new document in a database)
+// Set how documents posted to a new collection are named, from "?idgen=".
+// Returns false and writes an error if the strategy is unknown.
+func setIDStrategy(w http.ResponseWriter, r *http.Request, coll *collection.Collection) bool {
+	strategy := r.URL.Query().Get("idgen")
+	if strategy == "" {
+		return true
+	}
+
+	err := coll.SetIDStrategy(strategy)
+	if err != nil {
+		slog.Info("handlers setIDStrategy: unknown id strategy", "idgen", strategy)
+		errorMessage.ErrorResponse(w, "Unknown id strategy "+strategy, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Specific handler for POST database or collection (create a new document in it)
 func (d *Handler) postDoc(w http.ResponseWriter, r *http.Request, coll interfaces.ICollection, username string) {
+	// newline-delimited JSON bodies hold many documents
+	if isNDJSON(r) {
+		d.postBulk(w, r, coll, username)
+		return
+	}
+
 	doc, err := d.createDoc(w, r, username)
 	if err != nil {
 		// handled in createDoc
@@ -293,19 +569,122 @@ func (d *Handler) createDoc(w http.ResponseWriter, r *http.Request, name string)
 		return zero, err
 	}
 
+	doc, err := d.buildDoc(r, name, docBody)
+	if err != nil {
+		errorMessage.ValidationResponse(w, "document did not conform to schema", schemas.DescribeError(err))
+		return zero, err
+	}
+
+	return doc, nil
+}
+
+// Validate a document body against the schema in effect at the request path and wrap it in a new document.
+// Schema defaults are filled in first if enabled.
+func (d *Handler) buildDoc(r *http.Request, name string, docBody map[string]interface{}) (document.Document, error) {
+	var zero document.Document
+	schema, _, _ := d.schemaFor(r.URL.Path)
+
+	var body interface{} = docBody
+	if d.applyDefaults {
+		body = schemas.ApplyDefaults(schema, docBody)
+	}
+
 	// Validate against schema
-	err = d.schema.Validate(docBody)
+	err := schema.Validate(body)
 	if err != nil {
-		slog.Error("handlers createDoc: document did not conform to schema", "error", err)
-		errorMessage.ErrorResponse(w, "document did not conform to schema", http.StatusBadRequest)
+		slog.Error("handlers buildDoc: document did not conform to schema", "error", err)
 		return zero, err
 	}
 
-	return document.New(paths.GetRelativePathNonDB(r.URL.Path), name, docBody), nil
+	return document.New(paths.GetRelativePathNonDB(r.URL.Path), name, body), nil
+}
+
+// Check if the request body is newline-delimited JSON.
+func isNDJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-ndjson"
+}
+
+// Handle a bulk POST of newline-delimited JSON documents to a database or collection.
+// Each document may name its own key with the field given by "?key=",
+// and "?onError=skip" skips invalid lines instead of aborting the batch.
+func (d *Handler) postBulk(w http.ResponseWriter, r *http.Request, coll interfaces.ICollection, username string) {
+	queries := r.URL.Query()
+	keyField := queries.Get("key")
+
+	abortOnError := true
+	switch queries.Get("onError") {
+	case "", "abort":
+	case "skip":
+		abortOnError = false
+	default:
+		slog.Info("handlers postBulk: bad onError value", "onError", queries.Get("onError"))
+		errorMessage.ErrorResponse(w, "onError must be abort or skip", http.StatusBadRequest)
+		return
+	}
+
+	// Read body of requests
+	desc, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		slog.Error("handlers postBulk: error reading the request body", "error", err)
+		errorMessage.ErrorResponse(w, "invalid document format", http.StatusBadRequest)
+		return
+	}
+
+	// Turn every non-blank line into an entry
+	entries := make([]interfaces.BulkEntry, 0)
+	for i, line := range bytes.Split(desc, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		entry := interfaces.BulkEntry{Line: i + 1}
+
+		var docBody map[string]interface{}
+		err := json.Unmarshal(line, &docBody)
+		if err != nil {
+			entry.Error = "invalid document format"
+			entries = append(entries, entry)
+			continue
+		}
+
+		// The document may name its own key
+		if keyField != "" {
+			if rawKey, exists := docBody[keyField]; exists {
+				key, isString := rawKey.(string)
+				if !isString || key == "" || strings.Contains(key, "/") {
+					entry.Error = fmt.Sprintf("invalid document key in field %s", keyField)
+					entries = append(entries, entry)
+					continue
+				}
+				entry.Key = key
+			}
+		}
+
+		doc, err := d.buildDoc(r, username, docBody)
+		if err != nil {
+			entry.Error = "document did not conform to schema"
+			entry.Validation = schemas.DescribeError(err)
+			entries = append(entries, entry)
+			continue
+		}
+		entry.Doc = &doc
+		entries = append(entries, entry)
+	}
+
+	if len(entries) == 0 {
+		slog.Info("handlers postBulk: no documents in request", "path", r.URL.Path)
+		errorMessage.ErrorResponse(w, "no documents in request", http.StatusBadRequest)
+		return
+	}
+
+	coll.PostDocs(w, r, entries, abortOnError)
 }
 
-// Handle the subscribe request
-func (d *Handler) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+// Handle the subscribe request. Under a private ownership policy,
+// the user only hears about the documents they own or collaborate on.
+func (d *Handler) handleSubscribe(w http.ResponseWriter, r *http.Request, username string) {
 	// Get the query parameters
 	collectionName := r.URL.Query().Get("collection")
 	intervalStart := r.URL.Query().Get("start")
@@ -323,7 +702,17 @@ func (d *Handler) handleSubscribe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := coll.Subscribe(w, r, intervalStart, intervalEnd)
+	subscriber, err := subscribe.NewSubscriber(w, r, intervalStart, intervalEnd)
+	if err == nil {
+		keep := d.ownedFilter("/v1/"+collectionName+"/", username, false)
+		if keep != nil {
+			subscriber.Keep = func(doc any) bool {
+				document, ok := doc.(interfaces.IDocument)
+				return ok && keep(document)
+			}
+		}
+		err = coll.Stream(subscriber, r.Header.Get("Last-Event-ID"))
+	}
 	if err != nil {
 		http.Error(w, "Subscription failed: "+err.Error(), http.StatusBadRequest)
 		return
@@ -1,13 +1,25 @@
 package handlers
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/audit"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/collectionholder"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/idempotency"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/ratelimit"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/rbac"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/schemas"
 	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
@@ -175,3 +187,760 @@ func TestDeleteCollectionsDocsAndDBs(t *testing.T) {
 
 	runTests(t, testhandler, data)
 }
+
+// Create a bulk POST request with a newline-delimited JSON body.
+func bulkRequest(path, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	return r
+}
+
+func TestBulkPost(t *testing.T) {
+	testhandler, cleanup := setup()
+	defer cleanup()
+
+	aborted := httptest.NewRecorder()
+	rolledBack := httptest.NewRecorder()
+	data := []test{
+		{httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1\"}", 201},
+		{bulkRequest("/v1/db1/?key=id", "{\"id\":\"a\"}\n\n{\"id\":\"b\",\"prop\":1}\n"),
+			httptest.NewRecorder(),
+			"{\"aborted\":false,\"results\":[{\"line\":1,\"uri\":\"/v1/db1/a\"},{\"line\":3,\"uri\":\"/v1/db1/b\"}]}", 201},
+		{bulkRequest("/v1/db1/?key=id", "{\"id\":\"c\"}\n{\"id\":\"a\"}\nnot json\n"),
+			httptest.NewRecorder(),
+			"{\"aborted\":true,\"results\":[{\"line\":1},{\"line\":2},{\"line\":3,\"error\":\"invalid document format\"}]}", 400},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/", nil),
+			aborted,
+			"", 200},
+		{bulkRequest("/v1/db1/?key=id&onError=skip", "{\"id\":\"c\"}\n{\"id\":\"a\"}\n"),
+			httptest.NewRecorder(),
+			"{\"aborted\":false,\"results\":[{\"line\":1,\"uri\":\"/v1/db1/c\"},{\"line\":2,\"error\":\"document already exists\"}]}", 200},
+		{bulkRequest("/v1/db1/?key=id", "{\"id\":\"d\"}\n{\"id\":\"a\"}\n"),
+			httptest.NewRecorder(),
+			"{\"aborted\":true,\"results\":[{\"line\":1},{\"line\":2,\"error\":\"document already exists\"}]}", 400},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/", nil),
+			rolledBack,
+			"", 200},
+		{bulkRequest("/v1/db1/?onError=never", "{}\n"),
+			httptest.NewRecorder(),
+			"", 400},
+	}
+
+	runTests(t, testhandler, data)
+
+	// aborted requests leave none of their documents behind
+	if strings.Count(aborted.Body.String(), "\"path\"") != 2 || strings.Contains(aborted.Body.String(), "\"path\":\"/c\"") {
+		t.Errorf("Expected only documents a and b, got %s", aborted.Body.String())
+	}
+	if strings.Count(rolledBack.Body.String(), "\"path\"") != 3 || strings.Contains(rolledBack.Body.String(), "\"path\":\"/d\"") {
+		t.Errorf("Expected only documents a, b and c, got %s", rolledBack.Body.String())
+	}
+}
+
+// Create a POST request with an idempotency key.
+func idempotentRequest(path, body, key string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", key)
+	return r
+}
+
+func TestIdempotentPost(t *testing.T) {
+	testhandler, cleanup := setup()
+	defer cleanup()
+	testhandler.SetIdempotencyStore(idempotency.NewStore(time.Hour))
+
+	first := httptest.NewRecorder()
+	data := []test{
+		{httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1\"}", 201},
+		{idempotentRequest("/v1/db1/", "{\"prop\":1}", "k1"),
+			first,
+			"", 201},
+	}
+	runTests(t, testhandler, data)
+
+	// the retry returns the original response
+	data = []test{
+		{idempotentRequest("/v1/db1/", "{\"prop\":1}", "k1"),
+			httptest.NewRecorder(),
+			first.Body.String(), 201},
+		{idempotentRequest("/v1/db1/", "{\"prop\":2}", "k1"),
+			httptest.NewRecorder(),
+			"", 422},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/", nil),
+			httptest.NewRecorder(),
+			"", 200},
+	}
+	runTests(t, testhandler, data)
+
+	if data[0].w.Header().Get("Location") != first.Header().Get("Location") {
+		t.Errorf("Expected replayed location %s got %s", first.Header().Get("Location"), data[0].w.Header().Get("Location"))
+	}
+	if strings.Count(data[2].w.Body.String(), "\"path\"") != 1 {
+		t.Errorf("Expected exactly one document, got %s", data[2].w.Body.String())
+	}
+}
+
+func TestPostIDStrategies(t *testing.T) {
+	testhandler, cleanup := setup()
+	defer cleanup()
+
+	data := []test{
+		{httptest.NewRequest(http.MethodPut, "/v1/db1?idgen=counter", nil),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1\"}", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db2?idgen=sequential", nil),
+			httptest.NewRecorder(),
+			"", 400},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/", strings.NewReader("{}")),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/00000000000000000001\"}", 201},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/", strings.NewReader("{}")),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/00000000000000000002\"}", 201},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/?idgen=ulid", strings.NewReader("{}")),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/?idgen=sequential", strings.NewReader("{}")),
+			httptest.NewRecorder(),
+			"", 400},
+	}
+
+	runTests(t, testhandler, data)
+
+	if len(data[4].w.Header().Get("Location")) != len("/v1/db1/")+26 {
+		t.Errorf("Expected a ULID name, got %s", data[4].w.Header().Get("Location"))
+	}
+}
+
+func TestPutPreserveChildren(t *testing.T) {
+	testhandler, cleanup := setup()
+	defer cleanup()
+
+	data := []test{
+		{httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1\"}", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{\"prop\":1}")),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/doc1\"}", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1/col/", nil),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/doc1/col/\"}", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1?preserveChildren=true", strings.NewReader("{\"prop\":2}")),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/doc1\"}", 200},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc1/col/", nil),
+			httptest.NewRecorder(),
+			"[]", 200},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{\"prop\":3}")),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/doc1\",\"childrenDropped\":true}", 200},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc1/col/", nil),
+			httptest.NewRecorder(),
+			"", 400},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{\"prop\":4}")),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/doc1\"}", 200},
+	}
+
+	runTests(t, testhandler, data)
+}
+
+func TestCopyAndMove(t *testing.T) {
+	testhandler, cleanup := setup()
+	defer cleanup()
+
+	moved := httptest.NewRecorder()
+	data := []test{
+		{httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1\"}", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db2", nil),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db2\"}", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{\"prop\":1}")),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1/col/", nil),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1/col/inner", strings.NewReader("{\"x\":1}")),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/doc1?mode=copy&to=/v1/db2/copy", nil),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db2/copy\"}", 201},
+		{httptest.NewRequest(http.MethodGet, "/v1/db2/copy/col/inner", nil),
+			httptest.NewRecorder(),
+			"", 200},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/doc1?mode=move&to=/v1/db1/doc1/col/x", nil),
+			httptest.NewRecorder(),
+			"", 400},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/doc1?mode=move&to=/v1/db2/copy", nil),
+			httptest.NewRecorder(),
+			"", 409},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/doc1?mode=move&to=/v1/db3/copy", nil),
+			httptest.NewRecorder(),
+			"", 404},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/doc1?mode=move&to=/v1/db2/moved", nil),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db2/moved\"}", 201},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc1", nil),
+			httptest.NewRecorder(),
+			"", 400},
+		{httptest.NewRequest(http.MethodGet, "/v1/db2/moved/col/inner", nil),
+			moved,
+			"", 200},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/doc1?mode=rename", nil),
+			httptest.NewRecorder(),
+			"", 400},
+	}
+
+	runTests(t, testhandler, data)
+
+	if !strings.Contains(moved.Body.String(), "\"path\":\"/moved/col/inner\"") {
+		t.Errorf("Expected moved document path to be rewritten, got %s", moved.Body.String())
+	}
+
+	// of many concurrent moves of a document, one wins and the others leave nothing behind
+	var wg sync.WaitGroup
+	codes := make([]int, 8)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/v1/db2/moved?mode=move&to=/v1/db1/race%d", i), nil))
+			codes[i] = w.Code
+		}()
+	}
+	wg.Wait()
+	if n := slices.Index(codes, http.StatusCreated); n < 0 || slices.Contains(codes[n+1:], http.StatusCreated) {
+		t.Errorf("Expected exactly one move to succeed, got %v", codes)
+	}
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/db1/", nil))
+	var docs []interface{}
+	json.Unmarshal(w.Body.Bytes(), &docs)
+	if len(docs) != 1 {
+		t.Errorf("Expected one moved document, got %s", w.Body.String())
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	schema, err := schemas.Compile([]byte(`{"type":"object","properties":{"status":{"type":"string","default":"open"}},"required":["status"]}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	databases := collectionholder.New()
+	testhandler := New(&databases, schema, skeletonAuthenticator{})
+
+	data := []test{
+		{httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{}")),
+			httptest.NewRecorder(),
+			"", 400},
+	}
+	runTests(t, &testhandler, data)
+
+	testhandler.SetApplyDefaults(true)
+	stored := httptest.NewRecorder()
+	data = []test{
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1?return=doc", strings.NewReader("{}")),
+			stored,
+			"", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc2", strings.NewReader("{\"status\":5}")),
+			httptest.NewRecorder(),
+			"", 400},
+	}
+	runTests(t, &testhandler, data)
+
+	if !strings.Contains(stored.Body.String(), "\"doc\":{\"status\":\"open\"}") {
+		t.Errorf("Expected default to be filled in, got %s", stored.Body.String())
+	}
+}
+
+func TestPerCollectionSchemas(t *testing.T) {
+	testhandler, _ := setup()
+	dbSchema := `{"type":"object","required":["name"],"properties":{"name":{"type":"string"}},"additionalProperties":false}`
+	collSchema := `{"type":"object","required":["count"]}`
+
+	data := []test{
+		{httptest.NewRequest(http.MethodPut, "/v1/db1", strings.NewReader(dbSchema)),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1\"}", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db2", strings.NewReader("{\"type\":5}")),
+			httptest.NewRecorder(),
+			"", 400},
+		// the database schema applies to its documents
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{}")),
+			httptest.NewRecorder(),
+			"", 400},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{\"name\":\"a\"}")),
+			httptest.NewRecorder(),
+			"", 201},
+		// and is inherited by nested collections
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1/col/", nil),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/doc1/col/", strings.NewReader("{}")),
+			httptest.NewRecorder(),
+			"", 400},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc1/col/?mode=schema", nil),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/doc1/col/\",\"source\":\"/v1/db1/\",\"schema\":" + dbSchema + "}", 200},
+		// until the collection gets its own
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1/col/?mode=schema", strings.NewReader(collSchema)),
+			httptest.NewRecorder(),
+			"", 200},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/doc1/col/", strings.NewReader("{\"count\":1}")),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPatch, "/v1/db1/doc1", strings.NewReader("[{\"op\":\"ObjectAdd\",\"path\":\"/extra\",\"value\":1}]")),
+			httptest.NewRecorder(),
+			"", 400},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1?mode=schema", strings.NewReader(collSchema)),
+			httptest.NewRecorder(),
+			"", 400},
+		// removing the schemas falls back to the global one
+		{httptest.NewRequest(http.MethodDelete, "/v1/db1/?mode=schema", nil),
+			httptest.NewRecorder(),
+			"", 204},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc2", strings.NewReader("{}")),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc2?mode=schema", nil),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/doc2\",\"source\":\"global\",\"schema\":null}", 200},
+	}
+
+	runTests(t, testhandler, data)
+}
+
+func TestReplaceSchema(t *testing.T) {
+	testhandler, _ := setup()
+	proposal := "{\"schema\":{\"type\":\"object\",\"required\":[\"b\"]}"
+	migration := ",\"migration\":[{\"op\":\"ObjectAdd\",\"path\":\"/b\",\"value\":true}]"
+
+	data := []test{
+		{httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{\"a\":1}")),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1/col/", nil),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1/col/doc2", strings.NewReader("{\"b\":1}")),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/?mode=schema", strings.NewReader("{\"schema\":5}")),
+			httptest.NewRecorder(),
+			"", 400},
+		// the existing documents are reported and nothing changes
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/?mode=schema", strings.NewReader(proposal+"}")),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/\",\"checked\":2,\"applied\":false,\"failures\":[{\"path\":\"/v1/db1/doc1\",\"error\":\"jsonschema: '' does not validate with mem:///schema.json#/required: missing properties: 'b'\",\"validation\":{\"instanceLocation\":\"\",\"keywordLocation\":\"\",\"message\":\"doesn't validate with mem:///schema.json#\",\"causes\":[{\"instanceLocation\":\"\",\"keywordLocation\":\"/required\",\"message\":\"missing properties: 'b'\"}]}}]}", 409},
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/?mode=schema&dryRun=true", strings.NewReader(proposal+migration+"}")),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/\",\"checked\":2,\"applied\":false,\"failures\":[]}", 200},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc3", strings.NewReader("{}")),
+			httptest.NewRecorder(),
+			"", 201},
+		// the migration makes every document conform
+		{httptest.NewRequest(http.MethodPost, "/v1/db1/?mode=schema", strings.NewReader(proposal+migration+"}")),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/\",\"checked\":3,\"applied\":true,\"failures\":[]}", 200},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc4", strings.NewReader("{}")),
+			httptest.NewRecorder(),
+			"", 400},
+		// forcing keeps non-conforming documents
+		{httptest.NewRequest(http.MethodPost, "/v1/db1?mode=schema&force=true", strings.NewReader("{\"schema\":{\"required\":[\"c\"]}}")),
+			httptest.NewRecorder(),
+			"", 200},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc4", strings.NewReader("{\"c\":1}")),
+			httptest.NewRecorder(),
+			"", 201},
+	}
+
+	runTests(t, testhandler, data)
+
+	// the forced report lists the documents stored without conforming
+	forced := data[10].w.Body.String()
+	if !strings.Contains(forced, "\"checked\":3,\"applied\":true") || strings.Count(forced, "\"path\"") != 3 {
+		t.Errorf("Expected three documents reported after forcing, got %s", forced)
+	}
+
+	doc, _ := testhandler.DB.GetColl("db1")
+	migrated, _ := doc.FindDoc("doc1")
+	if migrated.GetJSONDoc().(map[string]interface{})["b"] != true {
+		t.Errorf("Expected document to be migrated, got %v", migrated.GetJSONDoc())
+	}
+}
+
+// test that without an authorizer only the creator of a database may change its schemas
+func TestSchemaCreatorOnly(t *testing.T) {
+	testschema, _ := jsonschema.Compile("testschema.json")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, bearerAuthenticator{})
+
+	data := []test{
+		{requestAs("alice", http.MethodPut, "/v1/db1", ""),
+			httptest.NewRecorder(),
+			"", 201},
+		{requestAs("bob", http.MethodPut, "/v1/db1/?mode=schema", "{\"required\":[\"a\"]}"),
+			httptest.NewRecorder(),
+			"\"forbidden: only admins or the database creator may change schemas\"", 403},
+		{requestAs("bob", http.MethodPost, "/v1/db1/?mode=schema&force=true", "{\"schema\":{\"required\":[\"a\"]}}"),
+			httptest.NewRecorder(),
+			"", 403},
+		{requestAs("bob", http.MethodDelete, "/v1/db1/?mode=schema", ""),
+			httptest.NewRecorder(),
+			"", 403},
+		{requestAs("bob", http.MethodGet, "/v1/db1/?mode=schema", ""),
+			httptest.NewRecorder(),
+			"", 200},
+		{requestAs("alice", http.MethodPut, "/v1/db1/?mode=schema", "{\"required\":[\"a\"]}"),
+			httptest.NewRecorder(),
+			"", 200},
+	}
+	runTests(t, &testhandler, data)
+}
+
+func TestValidationErrors(t *testing.T) {
+	testhandler, _ := setup()
+	schema := `{"type":"object","properties":{"name":{"type":"string"},"tags":{"type":"array","items":{"type":"string"}}}}`
+
+	data := []test{
+		{httptest.NewRequest(http.MethodPut, "/v1/db1", strings.NewReader(schema)),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{\"name\":5}")),
+			httptest.NewRecorder(),
+			"{\"message\":\"document did not conform to schema\",\"validation\":{\"instanceLocation\":\"\",\"keywordLocation\":\"\",\"message\":\"doesn't validate with mem:///schema.json#\",\"causes\":[{\"instanceLocation\":\"/name\",\"keywordLocation\":\"/properties/name/type\",\"message\":\"expected string, but got number\"}]}}", 400},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{\"tags\":[]}")),
+			httptest.NewRecorder(),
+			"", 201},
+	}
+	runTests(t, testhandler, data)
+
+	patched := httptest.NewRecorder()
+	data = []test{
+		{httptest.NewRequest(http.MethodPatch, "/v1/db1/doc1", strings.NewReader("[{\"op\":\"ArrayAdd\",\"path\":\"/tags\",\"value\":1}]")),
+			patched,
+			"", 400},
+	}
+	runTests(t, testhandler, data)
+
+	if !strings.Contains(patched.Body.String(), "{\"instanceLocation\":\"/tags/0\",\"keywordLocation\":\"/properties/tags/items/type\",\"message\":\"expected string, but got number\"}") {
+		t.Errorf("Expected the failing keyword in the patch response, got %s", patched.Body.String())
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	testhandler, _ := setup()
+	policy := rbac.NewPolicy("")
+	policy.Grant(rbac.Grant{User: "rexle", Database: "db1", Role: rbac.ROLE_WRITER})
+	testhandler.SetAuthorizer(policy)
+
+	data := []test{
+		// creating databases needs an admin
+		{httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+			httptest.NewRecorder(),
+			"\"forbidden: admin role required\"", 403},
+	}
+	runTests(t, testhandler, data)
+
+	policy.Grant(rbac.Grant{User: "rexle", Database: "db1", Role: rbac.ROLE_ADMIN})
+	data = []test{
+		{httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db2", nil),
+			httptest.NewRecorder(),
+			"", 403},
+	}
+	runTests(t, testhandler, data)
+
+	policy.Grant(rbac.Grant{User: "rexle", Database: "db1", Role: rbac.ROLE_READER})
+	data = []test{
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/", nil),
+			httptest.NewRecorder(),
+			"", 200},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{}")),
+			httptest.NewRecorder(),
+			"\"forbidden: writer role required\"", 403},
+	}
+	runTests(t, testhandler, data)
+}
+
+// An authenticator for testing that takes the username from the bearer token.
+type bearerAuthenticator struct{}
+
+// Validate token, trusting whatever user the bearer token names.
+func (bearerAuthenticator) ValidateToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), true
+}
+
+// Create a request made by the given user.
+func requestAs(user, method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+user)
+	return r
+}
+
+func TestOwnership(t *testing.T) {
+	testschema, _ := jsonschema.Compile("testschema.json")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, bearerAuthenticator{})
+
+	data := []test{
+		{requestAs("alice", http.MethodPut, "/v1/db1", ""),
+			httptest.NewRecorder(),
+			"", 201},
+		{requestAs("alice", http.MethodPut, "/v1/db1?mode=ownership", "{\"policy\":\"owner\"}"),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1\"}", 200},
+		{requestAs("alice", http.MethodPut, "/v1/db1?mode=ownership", "{\"policy\":\"everyone\"}"),
+			httptest.NewRecorder(),
+			"", 400},
+		// without an authorizer, only the creator of the database may set policies
+		{requestAs("bob", http.MethodPut, "/v1/db1?mode=ownership", "{\"policy\":\"none\"}"),
+			httptest.NewRecorder(),
+			"", 403},
+		{requestAs("bob", http.MethodDelete, "/v1/db1?mode=ownership", ""),
+			httptest.NewRecorder(),
+			"", 403},
+		{requestAs("alice", http.MethodPut, "/v1/db1/doc1", "{\"a\":1}"),
+			httptest.NewRecorder(),
+			"", 201},
+		{requestAs("bob", http.MethodPut, "/v1/db1/doc2", "{\"a\":2}"),
+			httptest.NewRecorder(),
+			"", 201},
+		{requestAs("bob", http.MethodGet, "/v1/db1/doc1?mode=ownership", ""),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/doc1\",\"source\":\"/v1/db1/\",\"policy\":\"owner\"}", 200},
+		// others may read but not change the document
+		{requestAs("bob", http.MethodGet, "/v1/db1/doc1", ""),
+			httptest.NewRecorder(),
+			"", 200},
+		{requestAs("bob", http.MethodPut, "/v1/db1/doc1", "{\"a\":3}"),
+			httptest.NewRecorder(),
+			"", 403},
+		{requestAs("bob", http.MethodDelete, "/v1/db1/doc1", ""),
+			httptest.NewRecorder(),
+			"", 403},
+		{requestAs("bob", http.MethodPut, "/v1/db1/doc1/coll/", ""),
+			httptest.NewRecorder(),
+			"", 403},
+		// only the owner may share it
+		{requestAs("bob", http.MethodPut, "/v1/db1/doc1?mode=collaborators", "[\"bob\"]"),
+			httptest.NewRecorder(),
+			"", 403},
+		{requestAs("alice", http.MethodPut, "/v1/db1/doc1?mode=collaborators", "[\"bob\"]"),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/doc1\",\"collaborators\":[\"bob\"]}", 200},
+		{requestAs("bob", http.MethodPut, "/v1/db1/doc1", "{\"a\":3}"),
+			httptest.NewRecorder(),
+			"", 200},
+		{requestAs("carol", http.MethodPatch, "/v1/db1/doc1", "[{\"op\":\"ObjectAdd\",\"path\":\"/b\",\"value\":1}]"),
+			httptest.NewRecorder(),
+			"", 403},
+	}
+	runTests(t, &testhandler, data)
+
+	// listings can be limited to owned documents, and are under a private policy
+	countDocs := func(user, target string) int {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, requestAs(user, http.MethodGet, target, ""))
+		var docs []interface{}
+		json.Unmarshal(w.Body.Bytes(), &docs)
+		return len(docs)
+	}
+	if n := countDocs("carol", "/v1/db1/"); n != 2 {
+		t.Errorf("Expected 2 documents for %s at %s, got %d", "carol", "/v1/db1/", n)
+	}
+	if n := countDocs("carol", "/v1/db1/?owned=true"); n != 0 {
+		t.Errorf("Expected 0 documents for %s at %s, got %d", "carol", "/v1/db1/?owned=true", n)
+	}
+	if n := countDocs("alice", "/v1/db1/?owned=true"); n != 1 {
+		t.Errorf("Expected 1 documents for %s at %s, got %d", "alice", "/v1/db1/?owned=true", n)
+	}
+
+	data = []test{
+		{requestAs("alice", http.MethodPut, "/v1/db1?mode=ownership", "{\"policy\":\"private\"}"),
+			httptest.NewRecorder(),
+			"", 200},
+		{requestAs("carol", http.MethodGet, "/v1/db1/doc1", ""),
+			httptest.NewRecorder(),
+			"", 403},
+	}
+	runTests(t, &testhandler, data)
+	if n := countDocs("carol", "/v1/db1/"); n != 0 {
+		t.Errorf("Expected 0 documents for %s at %s, got %d", "carol", "/v1/db1/", n)
+	}
+	if n := countDocs("bob", "/v1/db1/"); n != 2 {
+		t.Errorf("Expected 2 documents for %s at %s, got %d", "bob", "/v1/db1/", n)
+	}
+
+	// admins may change any document
+	policy := rbac.NewPolicy("")
+	policy.Grant(rbac.Grant{User: rbac.ALL_USERS, Database: "db1", Role: rbac.ROLE_WRITER})
+	policy.Grant(rbac.Grant{User: "carol", Database: "db1", Role: rbac.ROLE_ADMIN})
+	testhandler.SetAuthorizer(policy)
+	data = []test{
+		{requestAs("carol", http.MethodDelete, "/v1/db1/doc2", ""),
+			httptest.NewRecorder(),
+			"", 204},
+		{requestAs("bob", http.MethodDelete, "/v1/db1?mode=ownership", ""),
+			httptest.NewRecorder(),
+			"", 403},
+		{requestAs("carol", http.MethodDelete, "/v1/db1?mode=ownership", ""),
+			httptest.NewRecorder(),
+			"", 204},
+		{requestAs("bob", http.MethodDelete, "/v1/db1/doc1", ""),
+			httptest.NewRecorder(),
+			"", 204},
+	}
+	runTests(t, &testhandler, data)
+}
+
+// test that the legacy subscribe endpoint keeps private documents to their owners
+func TestLegacySubscribeOwnership(t *testing.T) {
+	testschema, _ := jsonschema.Compile("testschema.json")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, bearerAuthenticator{})
+	server := httptest.NewServer(&testhandler)
+	defer server.Close()
+
+	data := []test{
+		{requestAs("alice", http.MethodPut, "/v1/db1", ""),
+			httptest.NewRecorder(),
+			"", 201},
+		{requestAs("alice", http.MethodPut, "/v1/db1?mode=ownership", "{\"policy\":\"private\"}"),
+			httptest.NewRecorder(),
+			"", 200},
+		{requestAs("alice", http.MethodPut, "/v1/db1/doc1", "{\"a\":1}"),
+			httptest.NewRecorder(),
+			"", 201},
+	}
+	runTests(t, &testhandler, data)
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/subscribe?collection=db1&start=a&end=z", nil)
+	request.Header.Set("Authorization", "Bearer carol")
+	var response *http.Response
+	done := make(chan error)
+	go func() {
+		var err error
+		response, err = http.DefaultClient.Do(request)
+		done <- err
+	}()
+
+	// the response starts with the first event, so carol writes until she hears about it
+	for subscribed := false; !subscribed; {
+		testhandler.ServeHTTP(httptest.NewRecorder(), requestAs("carol", http.MethodPut, "/v1/db1/ping", "{}"))
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Expected to subscribe, got %v", err)
+			}
+			subscribed = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	defer response.Body.Close()
+
+	data = []test{
+		{requestAs("alice", http.MethodPut, "/v1/db1/doc1", "{\"a\":2}"),
+			httptest.NewRecorder(),
+			"", 200},
+		{requestAs("carol", http.MethodPut, "/v1/db1/doc2", "{\"b\":1}"),
+			httptest.NewRecorder(),
+			"", 201},
+	}
+	runTests(t, &testhandler, data)
+
+	// carol only hears about her own documents
+	reader := bufio.NewReader(response.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Expected an event, got %v", err)
+		}
+		if strings.HasPrefix(line, "data:") && !strings.Contains(line, "\"/ping\"") {
+			if !strings.Contains(line, "\"/doc2\"") {
+				t.Errorf("Expected only carol's documents, got %s", line)
+			}
+			break
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	testhandler, _ := setup()
+	testhandler.SetRateLimiter(ratelimit.New(ratelimit.Config{Default: ratelimit.Limits{
+		Write: ratelimit.Limit{Rate: 0.1, Burst: 1},
+	}}))
+
+	data := []test{
+		{httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db2", nil),
+			httptest.NewRecorder(),
+			"\"rate limit exceeded, retry in 10 seconds\"", 429},
+		// reads are not limited
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/", nil),
+			httptest.NewRecorder(),
+			"", 200},
+	}
+	runTests(t, testhandler, data)
+}
+
+func TestAuditor(t *testing.T) {
+	testhandler, _ := setup()
+	auditLog, err := audit.Open(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("Expected no error opening the audit log, got %v", err)
+	}
+	defer auditLog.Close()
+	testhandler.SetAuditor(auditLog)
+
+	data := []test{
+		{httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+			httptest.NewRecorder(),
+			"", 201},
+		{httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{\"prop\":1}")),
+			httptest.NewRecorder(),
+			"", 201},
+		// reads are not audited
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc1", nil),
+			httptest.NewRecorder(),
+			"", 200},
+		{httptest.NewRequest(http.MethodDelete, "/v1/db1/doc2", nil),
+			httptest.NewRecorder(),
+			"", 404},
+	}
+	runTests(t, testhandler, data)
+
+	records, _ := auditLog.Query("", time.Time{}, time.Time{})
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 audit records, got %d", len(records))
+	}
+	if records[1].User != "rexle" || records[1].Path != "/v1/db1/doc1" || records[1].Status != 201 || records[1].BodyHash == "" {
+		t.Errorf("Expected the PUT to be recorded, got %+v", records[1])
+	}
+	if records[2].Method != http.MethodDelete || records[2].Status != 404 {
+		t.Errorf("Expected the failed DELETE to be recorded, got %+v", records[2])
+	}
+	if count, err := auditLog.Verify(); count != 3 || err != nil {
+		t.Errorf("Expected a valid audit log, got %d %v", count, err)
+	}
+}
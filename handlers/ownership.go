@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/paths"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/structs"
+)
+
+// The ownership policies of databases and collections
+const (
+	OWNERSHIP_NONE    = "none"    // Any user may change any document
+	OWNERSHIP_OWNER   = "owner"   // Only owners, collaborators and admins may change a document
+	OWNERSHIP_PRIVATE = "private" // Only they may also read it, and queries list only their documents
+)
+
+// A ownershipInput is the body of a request to set the ownership policy of a database or collection.
+type ownershipInput struct {
+	Policy string `json:"policy"` // The ownership policy.
+}
+
+// Find the ownership policy for documents at the given path: the policy of the nearest
+// database or collection on the path that has one, or else "none".
+// Also returns the URI that defines it, if any.
+func (d *Handler) ownershipFor(path string) (string, string) {
+	colls, uris := paths.CollectionsOnPath(path, d.DB)
+	for i := len(colls) - 1; i >= 0; i-- {
+		policy := colls[i].GetOwnership()
+		if policy != "" {
+			return policy, uris[i]
+		}
+	}
+	return OWNERSHIP_NONE, ""
+}
+
+// Check whether a user administers the resource at the path.
+// Without an authorizer, nobody does.
+func (d *Handler) isAdmin(username, path string) bool {
+	checker, canCheck := d.authorizer.(interfaces.AdminChecker)
+	return canCheck && checker.IsAdminOf(username, path)
+}
+
+// Check whether a user may change the settings of the database or collection at the path,
+// such as its schema or ownership policy. Admins may, and without an authorizer, the creator of the database.
+func (d *Handler) mayConfigure(username, path string) bool {
+	if d.authorizer != nil {
+		return d.isAdmin(username, path)
+	}
+	colls, _ := paths.CollectionsOnPath(path, d.DB)
+	return len(colls) > 0 && colls[0].GetCreator() == username
+}
+
+// Check whether the user created the document or collaborates on it.
+func ownsDoc(doc interfaces.IDocument, username string) bool {
+	metadata, hasMetadata := interface{}(doc).(interfaces.HasMetadata)
+	if hasMetadata && metadata.GetOriginalAuthor() == username {
+		return true
+	}
+	shareable, isShareable := interface{}(doc).(interfaces.Shareable)
+	return isShareable && slices.Contains(shareable.GetCollaborators(), username)
+}
+
+// Decide which documents of the database or collection at the path a user hears about
+// in listings and subscriptions: under a private policy, or if the user asks for owned
+// documents only, those the user owns or collaborates on. Returns nil if every document.
+func (d *Handler) ownedFilter(path, username string, owned bool) func(doc interfaces.IDocument) bool {
+	policy, _ := d.ownershipFor(path)
+	if !owned && (policy != OWNERSHIP_PRIVATE || d.isAdmin(username, path)) {
+		return nil
+	}
+	return func(doc interfaces.IDocument) bool {
+		return ownsDoc(doc, username)
+	}
+}
+
+// Find the existing document a request changes or reads: the document at the path,
+// or the document holding the collection that a PUT or DELETE creates or removes.
+// Returns nil if there is none.
+func (d *Handler) targetDoc(r *http.Request) (interfaces.IDocument, string) {
+	path := r.URL.Path
+	if strings.HasSuffix(path, "/") {
+		if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			return nil, ""
+		}
+		trimmed := strings.TrimSuffix(path, "/")
+		path = trimmed[:strings.LastIndex(trimmed, "/")]
+	}
+
+	_, doc, resCode := paths.ParsePath(path, d.DB)
+	if resCode != paths.RESOURCE_DOC {
+		return nil, ""
+	}
+	return doc, path
+}
+
+// Enforce the ownership policy on a request. Under a policy, only the owner of a document,
+// its collaborators and admins may change it, and under a private policy also read it.
+// Returns false and writes an error if the user may not.
+func (d *Handler) checkOwnership(w http.ResponseWriter, r *http.Request, username string) bool {
+	doc, path := d.targetDoc(r)
+	if doc == nil {
+		// new documents may be created by anyone
+		return true
+	}
+
+	policy, _ := d.ownershipFor(path)
+	if policy == OWNERSHIP_NONE {
+		return true
+	}
+
+	mode := r.URL.Query().Get("mode")
+	changes := r.Method == http.MethodPut || r.Method == http.MethodPatch || r.Method == http.MethodDelete ||
+		(r.Method == http.MethodPost && mode == "move")
+	if !changes && policy != OWNERSHIP_PRIVATE {
+		return true
+	}
+
+	if ownsDoc(doc, username) || d.isAdmin(username, path) {
+		return true
+	}
+
+	slog.Info("handlers checkOwnership: request denied", "username", username, "method", r.Method, "path", r.URL.Path, "policy", policy)
+	errorMessage.ErrorResponse(w, "forbidden: only the owner or collaborators may access this document", http.StatusForbidden)
+	return false
+}
+
+// Handle requests with "?mode=ownership": GET shows the ownership policy in effect for a resource,
+// PUT gives a database or collection its own policy and DELETE removes it again.
+// Only admins, or the creator of the database without an authorizer, may change policies.
+func (d *Handler) ownershipRequest(w http.ResponseWriter, r *http.Request, username string) {
+	coll, _, resCode := paths.ParsePath(r.URL.Path, d.DB)
+	if resCode < 0 {
+		paths.HandlePathError(w, r, resCode)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		policy, source := d.ownershipFor(r.URL.Path)
+		jsonResponse, _ := json.Marshal(structs.OwnershipOutput{Uri: r.URL.Path, Source: source, Policy: policy})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResponse)
+		return
+	}
+
+	// Only databases and collections have policies of their own
+	if resCode != paths.RESOURCE_DB && resCode != paths.RESOURCE_COLL && resCode != paths.RESOURCE_DB_PUT_DEL {
+		errorMessage.ErrorResponse(w, "Ownership policies can only be set on databases and collections", http.StatusBadRequest)
+		return
+	}
+	if !d.mayConfigure(username, r.URL.Path) {
+		slog.Info("handlers ownershipRequest: request denied", "username", username, "path", r.URL.Path)
+		errorMessage.ErrorResponse(w, "forbidden: only admins or the database creator may change ownership policies", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var input ownershipInput
+		body, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err == nil {
+			err = json.Unmarshal(body, &input)
+		}
+		if err != nil || (input.Policy != OWNERSHIP_NONE && input.Policy != OWNERSHIP_OWNER && input.Policy != OWNERSHIP_PRIVATE) {
+			slog.Info("handlers ownershipRequest: invalid policy", "error", err, "policy", input.Policy)
+			errorMessage.ErrorResponse(w, "Body must be {\"policy\": \"none\", \"owner\" or \"private\"}", http.StatusBadRequest)
+			return
+		}
+		coll.SetOwnership(input.Policy)
+		slog.Info("handlers ownershipRequest: policy set", "path", r.URL.Path, "policy", input.Policy)
+
+		jsonResponse, _ := json.Marshal(structs.PutOutput{Uri: r.URL.Path})
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResponse)
+	case http.MethodDelete:
+		coll.SetOwnership("")
+		slog.Info("handlers ownershipRequest: policy removed", "path", r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		errorMessage.ErrorResponse(w, "unsupported method for ownership: "+r.Method, http.StatusBadRequest)
+	}
+}
+
+// Handle requests with "?mode=collaborators" on a document: GET lists its collaborators
+// and PUT replaces them with the JSON array of usernames in the body.
+// Only the creator of the document and admins may change its collaborators.
+func (d *Handler) collaboratorsRequest(w http.ResponseWriter, r *http.Request, username string) {
+	_, doc, resCode := paths.ParsePath(r.URL.Path, d.DB)
+	if resCode != paths.RESOURCE_DOC {
+		if resCode < 0 {
+			paths.HandlePathError(w, r, resCode)
+		} else {
+			errorMessage.ErrorResponse(w, "Only documents have collaborators", http.StatusBadRequest)
+		}
+		return
+	}
+	shareable, isShareable := interface{}(doc).(interfaces.Shareable)
+	if !isShareable {
+		errorMessage.ErrorResponse(w, "Document cant be shared", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		policy, _ := d.ownershipFor(r.URL.Path)
+		if policy == OWNERSHIP_PRIVATE && !ownsDoc(doc, username) && !d.isAdmin(username, r.URL.Path) {
+			errorMessage.ErrorResponse(w, "forbidden: only the owner or collaborators may access this document", http.StatusForbidden)
+			return
+		}
+	case http.MethodPut:
+		metadata, hasMetadata := interface{}(doc).(interfaces.HasMetadata)
+		if !(hasMetadata && metadata.GetOriginalAuthor() == username) && !d.isAdmin(username, r.URL.Path) {
+			slog.Info("handlers collaboratorsRequest: request denied", "username", username, "path", r.URL.Path)
+			errorMessage.ErrorResponse(w, "forbidden: only the owner may change collaborators", http.StatusForbidden)
+			return
+		}
+
+		var users []string
+		body, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err == nil {
+			err = json.Unmarshal(body, &users)
+		}
+		if err != nil || slices.Contains(users, "") {
+			slog.Info("handlers collaboratorsRequest: invalid collaborators", "error", err)
+			errorMessage.ErrorResponse(w, "Body must be a JSON array of usernames", http.StatusBadRequest)
+			return
+		}
+		shareable.SetCollaborators(users)
+		slog.Info("handlers collaboratorsRequest: collaborators set", "path", r.URL.Path, "collaborators", users)
+	default:
+		errorMessage.ErrorResponse(w, "unsupported method for collaborators: "+r.Method, http.StatusBadRequest)
+		return
+	}
+
+	collaborators := shareable.GetCollaborators()
+	if collaborators == nil {
+		collaborators = make([]string, 0)
+	}
+	jsonResponse, _ := json.Marshal(structs.CollaboratorsOutput{Uri: r.URL.Path, Collaborators: collaborators})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
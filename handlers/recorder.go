@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// A responseRecorder passes a response through to a response writer while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter              // The response writer being recorded.
+	status              int          // The status code written, or 200 if none was.
+	body                bytes.Buffer // A copy of the body written.
+}
+
+// Create a new response recorder around a response writer.
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+// Record the status code and pass it through.
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	rr.status = statusCode
+	rr.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Record the body and pass it through.
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
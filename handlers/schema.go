@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/collection"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/patcher"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/paths"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/schemas"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/structs"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// The source reported for documents validated against the server-wide schema
+const GLOBAL_SCHEMA = "global"
+
+// Replace the server-wide schema, used where no database or collection on the path has its own.
+func (d *Handler) SetGlobalSchema(schema *jsonschema.Schema, source []byte) {
+	d.schema.Set(schema, source)
+}
+
+// Find the schema for documents at the given path: the schema of the nearest
+// database or collection on the path that has one, or else the global schema.
+// Also returns the JSON text of the schema and the URI that defines it.
+func (d *Handler) schemaFor(path string) (*jsonschema.Schema, []byte, string) {
+	colls, uris := paths.CollectionsOnPath(path, d.DB)
+	for i := len(colls) - 1; i >= 0; i-- {
+		schema, source := colls[i].GetSchema()
+		if schema != nil {
+			return schema, source, uris[i]
+		}
+	}
+
+	schema, source := d.schema.Get()
+	return schema, source, GLOBAL_SCHEMA
+}
+
+// A schemaProposal is the body of a request to replace the schema of a database or collection.
+type schemaProposal struct {
+	Schema    json.RawMessage `json:"schema"`    // The new schema.
+	Migration []patcher.Patch `json:"migration"` // Patches to apply to every document first, if any.
+}
+
+// Handle requests with "?mode=schema": GET shows the schema in effect for a resource,
+// PUT gives a database or collection its own schema and DELETE removes it again.
+// POST replaces the schema only if the existing documents conform to it.
+// Only admins, or the creator of the database without an authorizer, may change schemas.
+func (d *Handler) schemaRequest(w http.ResponseWriter, r *http.Request, username string) {
+	coll, _, resCode := paths.ParsePath(r.URL.Path, d.DB)
+	if resCode < 0 {
+		paths.HandlePathError(w, r, resCode)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		_, source, definedBy := d.schemaFor(r.URL.Path)
+		jsonResponse, err := json.Marshal(structs.SchemaOutput{Uri: r.URL.Path, Source: definedBy, Schema: source})
+		if err != nil {
+			slog.Error("handlers schemaRequest: error marshaling schema", "error", err)
+			errorMessage.ErrorResponse(w, "Error marshaling schema", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResponse)
+		return
+	}
+
+	// Only databases and collections have schemas of their own
+	if resCode != paths.RESOURCE_DB && resCode != paths.RESOURCE_COLL && resCode != paths.RESOURCE_DB_PUT_DEL {
+		errorMessage.ErrorResponse(w, "Schemas can only be set on databases and collections", http.StatusBadRequest)
+		return
+	}
+	if !d.mayConfigure(username, r.URL.Path) {
+		slog.Info("handlers schemaRequest: request denied", "username", username, "path", r.URL.Path)
+		errorMessage.ErrorResponse(w, "forbidden: only admins or the database creator may change schemas", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		schema, source, ok := readSchema(w, r)
+		if !ok {
+			return
+		}
+		if schema == nil {
+			errorMessage.ErrorResponse(w, "Missing schema", http.StatusBadRequest)
+			return
+		}
+		coll.SetSchema(schema, source)
+		slog.Info("handlers schemaRequest: schema set", "path", r.URL.Path)
+
+		jsonResponse, _ := json.Marshal(structs.PutOutput{Uri: r.URL.Path})
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResponse)
+	case http.MethodPost:
+		d.replaceSchema(w, r, coll, username)
+	case http.MethodDelete:
+		coll.SetSchema(nil, nil)
+		slog.Info("handlers schemaRequest: schema removed", "path", r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		errorMessage.ErrorResponse(w, "unsupported method for schema: "+r.Method, http.StatusBadRequest)
+	}
+}
+
+// Propose a new schema for a database or collection. Every document that would be validated
+// against it is checked, after applying the migration patches if given, and a report of
+// the documents that do not conform is returned. The schema and migration are applied
+// only if all documents conform or "?force=true" is given, and never with "?dryRun=true".
+// Once applied, the report lists the documents that do not conform after all, such as
+// those changed since the check, which keep their bodies.
+func (d *Handler) replaceSchema(w http.ResponseWriter, r *http.Request, coll interfaces.ICollection, username string) {
+	force := r.URL.Query().Get("force") == "true"
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+
+	// Read the proposal
+	desc, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		slog.Error("handlers replaceSchema: error reading the request body", "error", err)
+		errorMessage.ErrorResponse(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	var proposal schemaProposal
+	err = json.Unmarshal(desc, &proposal)
+	if err != nil || len(proposal.Schema) == 0 {
+		slog.Info("handlers replaceSchema: invalid proposal", "error", err)
+		errorMessage.ErrorResponse(w, "Body must be an object with a schema and an optional migration", http.StatusBadRequest)
+		return
+	}
+	schema, err := schemas.Compile(proposal.Schema)
+	if err != nil {
+		slog.Info("handlers replaceSchema: invalid schema", "error", err)
+		errorMessage.ErrorResponse(w, "invalid schema: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	uri := r.URL.Path
+	if !strings.HasSuffix(uri, "/") {
+		uri += "/"
+	}
+
+	// Check without changing anything first
+	report := structs.SchemaReport{Uri: uri, Failures: make([]structs.SchemaFailure, 0)}
+	coll.Migrate(uri, schema, proposal.Migration, username, false, &report)
+
+	statusCode := http.StatusOK
+	if dryRun {
+		slog.Info("handlers replaceSchema: dry run", "path", uri, "failures", len(report.Failures))
+	} else if len(report.Failures) > 0 && !force {
+		slog.Info("handlers replaceSchema: documents do not conform", "path", uri, "failures", len(report.Failures))
+		statusCode = http.StatusConflict
+	} else {
+		// Install the schema first, so that writes from now on are validated against it, then
+		// migrate and check every document again: the report is of what is stored now
+		coll.SetSchema(schema, []byte(proposal.Schema))
+		report = structs.SchemaReport{Uri: uri, Failures: make([]structs.SchemaFailure, 0)}
+		coll.Migrate(uri, schema, proposal.Migration, username, true, &report)
+		report.Applied = true
+		slog.Info("handlers replaceSchema: schema replaced", "path", uri, "failures", len(report.Failures))
+	}
+
+	jsonResponse, err := json.Marshal(report)
+	if err != nil {
+		slog.Error("handlers replaceSchema: error marshaling report", "error", err)
+		errorMessage.ErrorResponse(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(statusCode)
+	w.Write(jsonResponse)
+}
+
+// Give a new database or collection the schema in the body of its PUT request, if any.
+// Returns false and writes an error if the schema does not compile.
+func setInitialSchema(w http.ResponseWriter, r *http.Request, coll *collection.Collection) bool {
+	schema, source, ok := readSchema(w, r)
+	if !ok {
+		return false
+	}
+	if schema != nil {
+		coll.SetSchema(schema, source)
+	}
+	return true
+}
+
+// Read and compile a schema from the request body. Returns a nil schema if the body is empty.
+// Returns false and writes an error if the body cannot be read or compiled.
+func readSchema(w http.ResponseWriter, r *http.Request) (*jsonschema.Schema, []byte, bool) {
+	source, err := io.ReadAll(r.Body)
+	if err != nil {
+		slog.Error("handlers readSchema: error reading the request body", "error", err)
+		errorMessage.ErrorResponse(w, "invalid request body", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if len(bytes.TrimSpace(source)) == 0 {
+		return nil, nil, true
+	}
+
+	schema, err := schemas.Compile(source)
+	if err != nil {
+		slog.Info("handlers readSchema: invalid schema", "error", err)
+		errorMessage.ErrorResponse(w, "invalid schema: "+err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return schema, source, true
+}
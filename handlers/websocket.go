@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/collection"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/paths"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/subscribe"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/websocket"
+)
+
+// The path of the WebSocket endpoint for subscriptions
+const WEBSOCKET_PATH = "/v1/ws"
+
+// How often the server pings WebSocket clients. A client that sends nothing,
+// not even a pong, for two intervals is disconnected.
+const WEBSOCKET_PING_INTERVAL = 30 * time.Second
+
+// A wsMessage is a message of the WebSocket subscription protocol, in either direction.
+// Clients send "subscribe" and "unsubscribe" messages; the server answers them with
+// "subscribed", "unsubscribed" or "error" messages, and sends "event" messages with
+// the same update and delete messages as server-sent events.
+type wsMessage struct {
+	Type        string          `json:"type"`                  // The kind of message.
+	ID          string          `json:"id,omitempty"`          // The subscription, named by the client.
+	Path        string          `json:"path,omitempty"`        // The database, collection or document subscribed to.
+	Interval    string          `json:"interval,omitempty"`    // The interval of document names, as for a collection GET.
+	Owned       bool            `json:"owned,omitempty"`       // Whether to hear only about the documents the user owns.
+	Recursive   bool            `json:"recursive,omitempty"`   // Whether to hear about everything below the path.
+	Filter      string          `json:"filter,omitempty"`      // A predicate the documents heard about must match.
+	LastEventID string          `json:"lastEventId,omitempty"` // The last event seen, to resume after.
+	EventID     uint64          `json:"eventId,omitempty"`     // The sequence number of an event.
+	Event       string          `json:"event,omitempty"`       // The type of an event, such as "update" or "delete".
+	Data        json.RawMessage `json:"data,omitempty"`        // The message of an event.
+	Error       string          `json:"error,omitempty"`       // Why a request failed.
+}
+
+// A wsSession holds the subscriptions of one WebSocket connection.
+type wsSession struct {
+	handler       *Handler                         // The handler the connection was made to
+	conn          *websocket.Conn                  // The connection
+	username      string                           // The user who made the connection
+	header        http.Header                      // The headers of the handshake, used for each subscription
+	done          chan struct{}                    // Closed when the connection ends, ending every subscription
+	subscriptions map[string]*subscribe.Subscriber // The subscriptions, by the client's ids
+	wg            sync.WaitGroup                   // Waits for the subscriptions to end
+	mu            sync.Mutex                       // To protect access to subscriptions
+}
+
+// A wsSink writes the events of one subscription to its WebSocket connection.
+type wsSink struct {
+	session *wsSession
+	id      string
+}
+
+// Write an event as an "event" message.
+func (s wsSink) WriteEvent(event subscribe.Event) error {
+	data := json.RawMessage(event.Data)
+	if !json.Valid(data) {
+		data, _ = json.Marshal(string(event.Data))
+	}
+	return s.session.write(wsMessage{Type: "event", ID: s.id, EventID: event.ID, Event: event.Type, Data: data})
+}
+
+// Nothing to write, as pings keep the connection alive.
+func (s wsSink) WriteComment(comment string) error {
+	return nil
+}
+
+// A bufferWriter keeps a response in memory, for checking a subscription as if it were a request.
+type bufferWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferWriter) WriteHeader(statusCode int) {
+	b.status = statusCode
+}
+
+func (b *bufferWriter) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
+
+// The error written to the response, unquoted if it is a JSON string.
+func (b *bufferWriter) message() string {
+	var message string
+	if json.Unmarshal(b.body.Bytes(), &message) == nil {
+		return message
+	}
+	return strings.TrimSpace(b.body.String())
+}
+
+// Handle a WebSocket connection to WEBSOCKET_PATH, over which the user may
+// subscribe to and unsubscribe from many resources until it closes.
+func (d *Handler) handleWebSocket(w http.ResponseWriter, r *http.Request, username string) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		slog.Info("handlers handleWebSocket: bad handshake", "error", err)
+		return
+	}
+	conn.SetReadTimeout(2 * WEBSOCKET_PING_INTERVAL)
+
+	session := &wsSession{
+		handler:       d,
+		conn:          conn,
+		username:      username,
+		header:        r.Header,
+		done:          make(chan struct{}),
+		subscriptions: make(map[string]*subscribe.Subscriber),
+	}
+	slog.Info("handlers handleWebSocket: connection opened", "username", username)
+	session.run()
+	slog.Info("handlers handleWebSocket: connection closed", "username", username)
+}
+
+// Read the client's messages until the connection ends, then end every subscription.
+func (s *wsSession) run() {
+	go s.keepAlive()
+	defer func() {
+		close(s.done)
+		s.conn.Close()
+		s.wg.Wait()
+	}()
+
+	for {
+		opcode, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if opcode != websocket.OP_TEXT {
+			s.write(wsMessage{Type: "error", Error: "messages must be text"})
+			continue
+		}
+
+		var msg wsMessage
+		err = json.Unmarshal(data, &msg)
+		if err != nil {
+			s.write(wsMessage{Type: "error", Error: "invalid message: " + err.Error()})
+			continue
+		}
+
+		switch msg.Type {
+		case "subscribe":
+			s.subscribe(msg)
+		case "unsubscribe":
+			s.unsubscribe(msg)
+		default:
+			s.write(wsMessage{Type: "error", ID: msg.ID, Error: "unknown message type: " + msg.Type})
+		}
+	}
+}
+
+// Ping the client until the connection ends.
+func (s *wsSession) keepAlive() {
+	ticker := time.NewTicker(WEBSOCKET_PING_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			err := s.conn.Ping()
+			if err != nil {
+				slog.Info("handlers keepAlive: ping failed", "username", s.username, "error", err)
+				return
+			}
+		}
+	}
+}
+
+// Write a message to the client.
+func (s *wsSession) write(msg wsMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(websocket.OP_TEXT, data)
+}
+
+// Start a subscription, after checking it as a GET of the path in subscribe mode would be.
+func (s *wsSession) subscribe(msg wsMessage) {
+	if msg.ID == "" || !strings.HasPrefix(msg.Path, "/v1/") {
+		s.write(wsMessage{Type: "error", ID: msg.ID, Error: "a subscription needs an id and a path starting with /v1/"})
+		return
+	}
+	s.mu.Lock()
+	_, taken := s.subscriptions[msg.ID]
+	s.mu.Unlock()
+	if taken {
+		s.write(wsMessage{Type: "error", ID: msg.ID, Error: "subscription id already in use"})
+		return
+	}
+
+	target, message := s.handler.subscriptionTarget(msg, s.header, s.username)
+	if target == nil {
+		s.write(wsMessage{Type: "error", ID: msg.ID, Error: message})
+		return
+	}
+
+	subscriber := subscribe.NewSinkSubscriber(wsSink{s, msg.ID}, s.done, target.interval[0], target.interval[1])
+	subscriber.Recursive = msg.Recursive
+	if target.keep != nil {
+		subscriber.Keep = func(doc any) bool {
+			document, ok := doc.(interfaces.IDocument)
+			return ok && target.keep(document)
+		}
+	}
+	if target.match != nil {
+		target.coll.FilterSubscriber(subscriber, target.match)
+	}
+	s.mu.Lock()
+	s.subscriptions[msg.ID] = subscriber
+	s.mu.Unlock()
+
+	s.write(wsMessage{Type: "subscribed", ID: msg.ID, Path: msg.Path})
+	slog.Info("handlers subscribe: subscription started", "username", s.username, "id", msg.ID, "path", msg.Path)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := target.resource.Stream(subscriber, msg.LastEventID)
+		if err != nil {
+			s.write(wsMessage{Type: "error", ID: msg.ID, Error: "subscription failed: " + err.Error()})
+		}
+		s.mu.Lock()
+		if s.subscriptions[msg.ID] == subscriber {
+			delete(s.subscriptions, msg.ID)
+		}
+		s.mu.Unlock()
+	}()
+}
+
+// End a subscription.
+func (s *wsSession) unsubscribe(msg wsMessage) {
+	s.mu.Lock()
+	subscriber, found := s.subscriptions[msg.ID]
+	delete(s.subscriptions, msg.ID)
+	s.mu.Unlock()
+	if !found {
+		s.write(wsMessage{Type: "error", ID: msg.ID, Error: "no such subscription"})
+		return
+	}
+
+	subscriber.Close()
+	s.write(wsMessage{Type: "unsubscribed", ID: msg.ID})
+	slog.Info("handlers unsubscribe: subscription ended", "username", s.username, "id", msg.ID)
+}
+
+// A wsTarget is the resource a subscription is to, with the filters of its subscriber.
+type wsTarget struct {
+	resource interfaces.Subscribable             // The database, collection or document
+	coll     interfaces.ICollection              // The same resource, if it is a database or collection
+	interval [2]string                           // The interval of document names heard about
+	keep     func(doc interfaces.IDocument) bool // Which documents the user may hear about, or nil for all
+	match    func(doc interfaces.IDocument) bool // Which documents match the subscription's filter, or nil for all
+}
+
+// Find the resource a subscription is to, with the interval and the filters its subscriber
+// should have. The subscription goes through the rate limiter, the authorizer and the
+// ownership policy as a GET of its path in subscribe mode would. Returns nil and the
+// reason if the resource is missing, the filter invalid or the user may not subscribe.
+func (d *Handler) subscriptionTarget(msg wsMessage, header http.Header, username string) (*wsTarget, string) {
+	query := url.Values{"mode": {"subscribe"}}
+	if msg.Interval != "" {
+		query.Set("interval", msg.Interval)
+	}
+	r, err := http.NewRequest(http.MethodGet, msg.Path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, "invalid path: " + err.Error()
+	}
+	r.Header = header.Clone()
+
+	w := &bufferWriter{header: make(http.Header)}
+	allowed := d.limiter == nil || d.limiter.Authorize(w, r, username)
+	allowed = allowed && (d.authorizer == nil || d.authorizer.Authorize(w, r, username))
+	allowed = allowed && d.checkOwnership(w, r, username)
+	if !allowed {
+		return nil, w.message()
+	}
+
+	coll, doc, resCode := paths.ParsePath(r.URL.Path, d.DB)
+	switch resCode {
+	case paths.RESOURCE_DB, paths.RESOURCE_COLL:
+		// hear about the documents a GET of the collection would list
+		target := &wsTarget{resource: coll, coll: coll, interval: collection.GetInterval(msg.Interval)}
+		target.keep = d.ownedFilter(r.URL.Path, username, msg.Owned)
+		target.match, err = collection.ParseFilter(msg.Filter)
+		if err != nil {
+			return nil, "invalid filter: " + err.Error()
+		}
+		return target, ""
+	case paths.RESOURCE_DOC:
+		if msg.Filter != "" {
+			return nil, "only collections can be filtered"
+		}
+		subscribable, ok := doc.(interfaces.Subscribable)
+		if !ok {
+			return nil, "document does not support subscriptions"
+		}
+		return &wsTarget{resource: subscribable}, ""
+	default:
+		paths.HandlePathError(w, r, resCode)
+		return nil, w.message()
+	}
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/collectionholder"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/websocket"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Send a message over a WebSocket connection.
+func sendMessage(t *testing.T, conn *websocket.Conn, msg wsMessage) {
+	data, _ := json.Marshal(msg)
+	if err := conn.WriteMessage(websocket.OP_TEXT, data); err != nil {
+		t.Fatalf("Expected no error writing, got %v", err)
+	}
+}
+
+// Read the next message from a WebSocket connection.
+func readMessage(t *testing.T, conn *websocket.Conn) wsMessage {
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Expected a message, got %v", err)
+	}
+	var msg wsMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("Expected a JSON message, got %s", data)
+	}
+	return msg
+}
+
+func TestWebSocketSubscriptions(t *testing.T) {
+	testschema, _ := jsonschema.Compile("testschema.json")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, bearerAuthenticator{})
+	server := httptest.NewServer(&testhandler)
+	defer server.Close()
+
+	put := func(target, body string) {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, requestAs("alice", http.MethodPut, target, body))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected PUT %s to create, got %d %s", target, w.Code, w.Body.String())
+		}
+	}
+	put("/v1/db1", "")
+	put("/v1/db1/doc1", "{\"a\":1}")
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+WEBSOCKET_PATH, http.Header{"Authorization": {"Bearer alice"}})
+	if err != nil {
+		t.Fatalf("Expected to connect, got %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadTimeout(5 * time.Second)
+
+	// missing resources cannot be subscribed to
+	sendMessage(t, conn, wsMessage{Type: "subscribe", ID: "x", Path: "/v1/db2/"})
+	msg := readMessage(t, conn)
+	if msg.Type != "error" || msg.ID != "x" {
+		t.Errorf("Expected an error for a missing database, got %+v", msg)
+	}
+	sendMessage(t, conn, wsMessage{Type: "subscribe", ID: "x", Path: "/v1/db1/", Filter: "a = 1"})
+	if msg := readMessage(t, conn); msg.Type != "error" || !strings.HasPrefix(msg.Error, "invalid filter") {
+		t.Errorf("Expected an error for an invalid filter, got %+v", msg)
+	}
+
+	// a document subscription starts with the document
+	sendMessage(t, conn, wsMessage{Type: "subscribe", ID: "doc", Path: "/v1/db1/doc1"})
+	if msg := readMessage(t, conn); msg.Type != "subscribed" || msg.ID != "doc" {
+		t.Errorf("Expected the document subscription to start, got %+v", msg)
+	}
+	msg = readMessage(t, conn)
+	if msg.Type != "event" || msg.ID != "doc" || msg.Event != "update" || !strings.Contains(string(msg.Data), "\"a\":1") {
+		t.Errorf("Expected the document, got %+v", msg)
+	}
+
+	// many subscriptions share the connection
+	sendMessage(t, conn, wsMessage{Type: "subscribe", ID: "coll", Path: "/v1/db1/", Interval: "[doc2,doc3]"})
+	if msg := readMessage(t, conn); msg.Type != "subscribed" || msg.ID != "coll" {
+		t.Errorf("Expected the collection subscription to start, got %+v", msg)
+	}
+	sendMessage(t, conn, wsMessage{Type: "subscribe", ID: "coll", Path: "/v1/db1/"})
+	if msg := readMessage(t, conn); msg.Type != "error" || msg.ID != "coll" {
+		t.Errorf("Expected an error for a reused id, got %+v", msg)
+	}
+
+	put("/v1/db1/doc2", "{\"b\":2}")
+	msg = readMessage(t, conn)
+	if msg.Type != "event" || msg.ID != "coll" || msg.Event != "update" || msg.EventID != 2 || !strings.Contains(string(msg.Data), "\"/doc2\"") {
+		t.Errorf("Expected an update of doc2, got %+v", msg)
+	}
+
+	// after unsubscribing, nothing more is heard
+	sendMessage(t, conn, wsMessage{Type: "unsubscribe", ID: "coll"})
+	if msg := readMessage(t, conn); msg.Type != "unsubscribed" || msg.ID != "coll" {
+		t.Errorf("Expected the collection subscription to end, got %+v", msg)
+	}
+	put("/v1/db1/doc3", "{\"c\":3}")
+	sendMessage(t, conn, wsMessage{Type: "unsubscribe", ID: "coll"})
+	if msg := readMessage(t, conn); msg.Type != "error" || msg.ID != "coll" {
+		t.Errorf("Expected no events after unsubscribing, got %+v", msg)
+	}
+}
+
+func TestWebSocketRecursiveSubscription(t *testing.T) {
+	testschema, _ := jsonschema.Compile("testschema.json")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, bearerAuthenticator{})
+	server := httptest.NewServer(&testhandler)
+	defer server.Close()
+
+	write := func(method, target, body string, code int) {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, requestAs("alice", method, target, body))
+		if w.Code != code {
+			t.Fatalf("Expected %s %s to answer %d, got %d %s", method, target, code, w.Code, w.Body.String())
+		}
+	}
+	write(http.MethodPut, "/v1/db1", "", http.StatusCreated)
+	write(http.MethodPut, "/v1/db1/doc1", "{\"a\":1}", http.StatusCreated)
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+WEBSOCKET_PATH, http.Header{"Authorization": {"Bearer alice"}})
+	if err != nil {
+		t.Fatalf("Expected to connect, got %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadTimeout(5 * time.Second)
+
+	sendMessage(t, conn, wsMessage{Type: "subscribe", ID: "tree", Path: "/v1/db1/", Recursive: true})
+	if msg := readMessage(t, conn); msg.Type != "subscribed" {
+		t.Fatalf("Expected the subscription to start, got %+v", msg)
+	}
+
+	// every change below the database arrives with the full path of what changed
+	write(http.MethodPut, "/v1/db1/doc1/coll/", "", http.StatusCreated)
+	write(http.MethodPut, "/v1/db1/doc1/coll/doc2", "{\"b\":2}", http.StatusCreated)
+	write(http.MethodDelete, "/v1/db1/doc1", "", http.StatusNoContent)
+	expected := []struct{ event, path string }{
+		{"create", "/v1/db1/doc1/coll/"},
+		{"update", "/v1/db1/doc1/coll/doc2"},
+		{"delete", "/v1/db1/doc1"},
+	}
+	// creating the database and doc1 were not numbered, as nobody subscribed recursively then
+	for i, e := range expected {
+		msg := readMessage(t, conn)
+		var data struct {
+			Path string `json:"path"`
+		}
+		json.Unmarshal(msg.Data, &data)
+		if msg.Type != "event" || msg.Event != e.event || msg.EventID != uint64(i+1) || data.Path != e.path {
+			t.Errorf("Expected %s of %s, got %+v", e.event, e.path, msg)
+		}
+	}
+}
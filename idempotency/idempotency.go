@@ -0,0 +1,128 @@
+// Package idempotency remembers the responses to requests that carry an
+// Idempotency-Key header, so that a retried request returns the original
+// response instead of being applied a second time.
+package idempotency
+
+import (
+	"crypto/sha256"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Result codes from beginning a request with an idempotency key.
+const (
+	STATE_NEW         = 0 // The key has not been seen; the request should be handled.
+	STATE_REPLAY      = 1 // The key finished before; the stored response should be returned.
+	STATE_MISMATCH    = 2 // The key was used before with a different request.
+	STATE_IN_PROGRESS = 3 // A request with this key is still being handled.
+)
+
+// A Response is a stored response to a request.
+type Response struct {
+	Status   int    // The status code of the response.
+	Location string // The Location header of the response.
+	Body     []byte // The body of the response.
+}
+
+// An entry is what the store remembers about one idempotency key.
+type entry struct {
+	fingerprint [sha256.Size]byte // A hash of the request this key was first used with.
+	response    Response          // The response to the request, once it is done.
+	done        bool              // Whether the request has finished.
+	expires     time.Time         // When this entry is forgotten.
+}
+
+// A Store maps idempotency keys of each user to the responses they produced.
+type Store struct {
+	window    time.Duration     // How long keys are remembered.
+	entries   map[string]*entry // Entries by user and key.
+	lastSweep time.Time         // The last time expired entries were removed.
+	mu        sync.Mutex        // To protect access to above
+}
+
+// Create a new store that remembers keys for the given window.
+func NewStore(window time.Duration) *Store {
+	return &Store{
+		window:    window,
+		entries:   make(map[string]*entry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Compute the fingerprint of a request from its method, path and body.
+func Fingerprint(r *http.Request, body []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	h.Write(body)
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// Begin handling a request with the given key for a user.
+// Returns a result code, and the stored response if the code is STATE_REPLAY.
+// When the code is STATE_NEW the caller must later call Complete or Abandon.
+func (s *Store) Begin(user, key string, fingerprint [sha256.Size]byte) (int, Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	id := user + "\x00" + key
+	e, exists := s.entries[id]
+	if exists && now.After(e.expires) {
+		delete(s.entries, id)
+		exists = false
+	}
+
+	if !exists {
+		s.entries[id] = &entry{fingerprint: fingerprint, expires: now.Add(s.window)}
+		return STATE_NEW, Response{}
+	}
+
+	if e.fingerprint != fingerprint {
+		slog.Info("idempotency Begin: key reused with a different request", "user", user, "key", key)
+		return STATE_MISMATCH, Response{}
+	}
+	if !e.done {
+		return STATE_IN_PROGRESS, Response{}
+	}
+	return STATE_REPLAY, e.response
+}
+
+// Store the response to a request begun with the given key.
+func (s *Store) Complete(user, key string, response Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, exists := s.entries[user+"\x00"+key]; exists {
+		e.response = response
+		e.done = true
+	}
+}
+
+// Forget a key whose request did not succeed, so that it can be retried.
+func (s *Store) Abandon(user, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, user+"\x00"+key)
+}
+
+// Remove expired entries, at most once a minute. Expects the lock to be held.
+func (s *Store) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+
+	for id, e := range s.entries {
+		if e.done && now.After(e.expires) {
+			delete(s.entries, id)
+		}
+	}
+	s.lastSweep = now
+}
@@ -0,0 +1,69 @@
+package idempotency
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// test that a completed key replays its response
+func TestBeginCompleteReplay(t *testing.T) {
+	store := NewStore(time.Hour)
+	r := httptest.NewRequest(http.MethodPost, "/v1/db/", nil)
+	fingerprint := Fingerprint(r, []byte(`{"a":1}`))
+
+	if state, _ := store.Begin("rexle", "k1", fingerprint); state != STATE_NEW {
+		t.Fatalf("Expected new key, got state %d", state)
+	}
+	if state, _ := store.Begin("rexle", "k1", fingerprint); state != STATE_IN_PROGRESS {
+		t.Errorf("Expected key in progress, got state %d", state)
+	}
+
+	store.Complete("rexle", "k1", Response{Status: http.StatusCreated, Location: "/v1/db/x", Body: []byte("{}")})
+
+	state, response := store.Begin("rexle", "k1", fingerprint)
+	if state != STATE_REPLAY {
+		t.Fatalf("Expected replay, got state %d", state)
+	}
+	if response.Status != http.StatusCreated || response.Location != "/v1/db/x" {
+		t.Errorf("Expected stored response, got %v", response)
+	}
+
+	// the same key of another user is independent
+	if state, _ := store.Begin("other", "k1", fingerprint); state != STATE_NEW {
+		t.Errorf("Expected new key for other user, got state %d", state)
+	}
+}
+
+// test that a key used with a different body is rejected
+func TestBeginMismatch(t *testing.T) {
+	store := NewStore(time.Hour)
+	r := httptest.NewRequest(http.MethodPost, "/v1/db/", nil)
+
+	store.Begin("rexle", "k1", Fingerprint(r, []byte(`{"a":1}`)))
+	store.Complete("rexle", "k1", Response{Status: http.StatusCreated})
+
+	if state, _ := store.Begin("rexle", "k1", Fingerprint(r, []byte(`{"a":2}`))); state != STATE_MISMATCH {
+		t.Errorf("Expected mismatch, got state %d", state)
+	}
+}
+
+// test that abandoned and expired keys can be used again
+func TestAbandonAndExpire(t *testing.T) {
+	store := NewStore(time.Millisecond)
+	r := httptest.NewRequest(http.MethodPost, "/v1/db/", nil)
+	fingerprint := Fingerprint(r, nil)
+
+	store.Begin("rexle", "k1", fingerprint)
+	store.Abandon("rexle", "k1")
+	if state, _ := store.Begin("rexle", "k1", fingerprint); state != STATE_NEW {
+		t.Errorf("Expected abandoned key to be new, got state %d", state)
+	}
+
+	store.Complete("rexle", "k1", Response{Status: http.StatusCreated})
+	time.Sleep(5 * time.Millisecond)
+	if state, _ := store.Begin("rexle", "k1", fingerprint); state != STATE_NEW {
+		t.Errorf("Expected expired key to be new, got state %d", state)
+	}
+}
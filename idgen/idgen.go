@@ -0,0 +1,162 @@
+// Package idgen generates names for documents posted to a collection.
+// Names can be random hex strings, time-ordered ULIDs, or a zero-padded counter.
+package idgen
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The supported strategies for generating names.
+const (
+	RANDOM  = "random"  // 128-bit random hex strings.
+	ULID    = "ulid"    // Lexicographically time-sortable ULIDs.
+	COUNTER = "counter" // A monotonic counter padded with zeros.
+)
+
+// The width of counter names; enough digits for any uint64.
+const COUNTER_WIDTH = 20
+
+// Crockford's base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Generators holds one generator of each strategy, and the strategy used by default.
+type Generators struct {
+	strategy string        // The default strategy.
+	ulid     ulidState     // The state of the ULID generator.
+	counter  atomic.Uint64 // The last counter value handed out.
+	mu       sync.Mutex    // To protect access to strategy
+}
+
+// The state of a monotonic ULID generator.
+type ulidState struct {
+	lastTime   int64      // The millisecond timestamp of the last ULID.
+	lastRandom [10]byte   // The random part of the last ULID.
+	mu         sync.Mutex // To protect access to above
+}
+
+// Check if a strategy name is supported.
+func Valid(strategy string) bool {
+	return strategy == RANDOM || strategy == ULID || strategy == COUNTER
+}
+
+// Create a new set of generators that uses random names by default.
+func New() *Generators {
+	return &Generators{strategy: RANDOM}
+}
+
+// Set the default strategy.
+func (g *Generators) SetStrategy(strategy string) error {
+	if !Valid(strategy) {
+		return fmt.Errorf("unknown id strategy: %s", strategy)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.strategy = strategy
+	return nil
+}
+
+// Get the default strategy.
+func (g *Generators) Strategy() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.strategy
+}
+
+// Generate the next name with the given strategy, or the default strategy if it is empty.
+func (g *Generators) Next(strategy string) (string, error) {
+	if strategy == "" {
+		strategy = g.Strategy()
+	}
+
+	switch strategy {
+	case RANDOM:
+		return randomName()
+	case ULID:
+		return g.ulid.next(time.Now())
+	case COUNTER:
+		return fmt.Sprintf("%0*d", COUNTER_WIDTH, g.counter.Add(1)), nil
+	default:
+		return "", fmt.Errorf("unknown id strategy: %s", strategy)
+	}
+}
+
+// Generate a 16-byte or 128-bit random name as a hexadecimal string.
+func randomName() (string, error) {
+	token := make([]byte, 16)
+
+	// fill the slice with random bytes
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
+
+// Generate the next ULID at the given time.
+// ULIDs made in the same millisecond increment the random part so they stay ordered.
+func (u *ulidState) next(now time.Time) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ms := now.UnixMilli()
+	if ms <= u.lastTime {
+		// same (or an earlier) millisecond; keep the last time and increment
+		ms = u.lastTime
+		if !increment(u.lastRandom[:]) {
+			return "", errors.New("ulid random part overflowed")
+		}
+	} else {
+		_, err := rand.Read(u.lastRandom[:])
+		if err != nil {
+			return "", err
+		}
+		u.lastTime = ms
+	}
+
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (40 - 8*i))
+	}
+	copy(id[6:], u.lastRandom[:])
+	return encodeULID(id), nil
+}
+
+// Increment a big-endian number in place. Returns false if it overflowed.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Encode 128 bits as 26 characters of Crockford's base32.
+func encodeULID(id [16]byte) string {
+	out := make([]byte, 26)
+
+	// the last character holds the lowest 5 bits; the first holds only the top 3
+	for i := 25; i >= 0; i-- {
+		var v byte
+		for bit := 0; bit < 5; bit++ {
+			pos := (25-i)*5 + bit
+			if pos >= 128 {
+				break
+			}
+			if id[15-pos/8]&(1<<(pos%8)) != 0 {
+				v |= 1 << bit
+			}
+		}
+		out[i] = crockford[v]
+	}
+	return string(out)
+}
@@ -0,0 +1,64 @@
+package idgen
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+// test that ULIDs encode the timestamp like the reference implementation
+func TestEncodeULID(t *testing.T) {
+	var u ulidState
+	id, err := u.next(time.UnixMilli(1469918176385))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(id) != 26 {
+		t.Fatalf("Expected 26 characters, got %s", id)
+	}
+	if id[:10] != "01ARYZ6S41" {
+		t.Errorf("Expected time prefix 01ARYZ6S41, got %s", id[:10])
+	}
+}
+
+// test that ULIDs and counters sort in the order they were made
+func TestNamesAreOrdered(t *testing.T) {
+	for _, strategy := range []string{ULID, COUNTER} {
+		g := New()
+		names := make([]string, 0)
+		for i := 0; i < 1000; i++ {
+			name, err := g.Next(strategy)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			names = append(names, name)
+		}
+
+		if !sort.StringsAreSorted(names) {
+			t.Errorf("Expected %s names to be sorted", strategy)
+		}
+		for i := 1; i < len(names); i++ {
+			if names[i] == names[i-1] {
+				t.Errorf("Expected unique %s names, got %s twice", strategy, names[i])
+			}
+		}
+	}
+}
+
+// test the default strategy and counter padding
+func TestStrategy(t *testing.T) {
+	g := New()
+	name, _ := g.Next("")
+	if len(name) != 32 {
+		t.Errorf("Expected a random hex name by default, got %s", name)
+	}
+
+	if err := g.SetStrategy("bogus"); err == nil {
+		t.Errorf("Expected error for unknown strategy")
+	}
+	g.SetStrategy(COUNTER)
+	name, _ = g.Next("")
+	if name != "00000000000000000001" {
+		t.Errorf("Expected first counter name, got %s", name)
+	}
+}
@@ -2,56 +2,219 @@
 package initialize
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/audit"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/authentication"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/ratelimit"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/rbac"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/schemas"
 	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
-func Initialize() (int, *jsonschema.Schema, map[string]string, error) {
+// A Config holds the settings given on the command line and the contents of the files they name.
+type Config struct {
+	Port              int                       // The port to listen on.
+	Schema            *jsonschema.Schema        // The schema documents are validated against.
+	SchemaSource      []byte                    // The JSON text of the schema.
+	Tokens            map[string]string         // The login tokens to install, by username.
+	IdempotencyWindow time.Duration             // How long idempotency keys are remembered, or 0 to disable them.
+	ApplyDefaults     bool                      // Whether schema default values are filled into new documents.
+	Users             *authentication.UserStore // The password hashes logins are checked against, if given.
+	Grants            *rbac.Policy              // The roles of users on databases, if access control is enabled.
+	SessionTTL        time.Duration             // How long sessions last.
+	RefreshTTL        time.Duration             // How long refresh tokens last, or 0 to disable them.
+	SlidingSessions   bool                      // Whether using a session extends it.
+	SweepInterval     time.Duration             // How often expired sessions are removed.
+	AuthMode          string                    // How users are authenticated, "session" or "hmac".
+	Keys              *authentication.KeyRing   // The keys signed tokens use, for "hmac" authentication.
+	APIKeys           *authentication.APIKeys   // The API keys of service accounts, if enabled.
+	Limits            *ratelimit.Config         // The request rate limits of users, if enabled.
+	Audit             *audit.Log                // The audit log of writes, logins and logouts, if enabled.
+	Files             Files                     // The files the settings were read from, for reloading.
+}
+
+// The Files a configuration is read from, empty if not given
+type Files struct {
+	Schema string // The schema file.
+	Tokens string // The login token file.
+	Users  string // The user file.
+	Grants string // The grants file.
+	Limits string // The rate limit file.
+	Keys   string // The signing key file.
+}
+
+// The ways users can be authenticated
+const (
+	AUTH_SESSION = "session" // Tokens name sessions kept by the server
+	AUTH_HMAC    = "hmac"    // Tokens are signed and carry the user themselves
+)
+
+// Returned by Initialize when it added a user instead of configuring the server
+var ErrUserAdded = errors.New("user added")
+
+func Initialize() (Config, error) {
+	var config Config
+
 	// Initialize flags
 	//These are for the flags requirement
 	portNum := flag.Int("p", 3318, "Port number for listening")
 	schemaFlag := flag.String("s", "", "Schema path")
 	tokenFlag := flag.String("t", "", "Token path")
 	loggerFlag := flag.Int("l", 0, "Logger output level, -1 for debug, 1 for only errors")
+	idempotencyFlag := flag.Duration("idempotency", 24*time.Hour, "How long POST idempotency keys are remembered, 0 to disable")
+	defaultsFlag := flag.Bool("defaults", false, "Fill in schema default values for properties missing from PUT and POST documents")
+	usersFlag := flag.String("users", "", "User file with password hashes; logins must give a password if set")
+	grantsFlag := flag.String("grants", "", "Grants file giving users roles on databases; enables access control if set")
+	ttlFlag := flag.Duration("ttl", authentication.DEFAULT_SESSION_TTL, "How long login sessions last")
+	refreshTTLFlag := flag.Duration("refreshttl", 0, "How long refresh tokens last, 0 to disable them")
+	slidingFlag := flag.Bool("sliding", false, "Extend a session by its lifetime whenever it is used")
+	sweepFlag := flag.Duration("sweep", authentication.DEFAULT_SWEEP_INTERVAL, "How often expired sessions are removed")
+	authFlag := flag.String("auth", AUTH_SESSION, "How users are authenticated: session, or hmac for signed tokens that need no server state")
+	keysFlag := flag.String("keys", "", "Key file for signing tokens, needed with -auth hmac")
+	apiKeysFlag := flag.String("apikeys", "", "API key file for service accounts, created if missing; enables API keys if set, with -grants")
+	limitsFlag := flag.String("limits", "", "Rate limit file giving users request budgets; enables rate limiting if set")
+	auditFlag := flag.String("audit", "", "Audit log file recording every write, login and logout; enables auditing if set")
+	addUserFlag := flag.String("adduser", "", "Add a user to the -users file, or change their password, reading the password from stdin, and exit")
 	flag.Parse()
 
-	var tokenMap map[string]string
+	// Adding a user needs nothing else
+	if *addUserFlag != "" {
+		err := addUser(*usersFlag, *addUserFlag, os.Stdin)
+		if err != nil {
+			slog.Error("Could not add user", "username", *addUserFlag, "error", err)
+			return config, err
+		}
+		slog.Info("User added", "username", *addUserFlag, "file", *usersFlag)
+		return config, ErrUserAdded
+	}
 
 	//A check before anything to see if the schema file exists
 	if *schemaFlag == "" {
 		slog.Error("Missing schema file. Specify with the -s flag", "error", errors.New("missing schema file"))
-		return 0, nil, tokenMap, errors.New("missing schema file")
+		return config, errors.New("missing schema file")
 	}
 
 	// Compile the schema
-	schema, err := jsonschema.Compile(*schemaFlag)
+	schema, schemaSource, err := loadSchema(*schemaFlag)
 
 	// Check for errors
 	if err != nil {
 		slog.Error("Invalid schema file", "error", err)
-		return 0, nil, tokenMap, errors.New("invalid schema file")
+		return config, errors.New("invalid schema file")
 	}
 
 	// the user inputs a token file
 	if *tokenFlag != "" {
-		// Read in the token file
-		token, err := os.ReadFile(*tokenFlag)
-		if err != nil {
+		config.Tokens, err = loadTokens(*tokenFlag)
+		if errors.Is(err, fs.ErrNotExist) {
 			slog.Error("Token file not found", "error", err)
-			return 0, nil, tokenMap, errors.New("token file not found")
+			return config, errors.New("token file not found")
+		} else if err != nil {
+			slog.Error("Error marshalling token file", "error", err)
+			return config, errors.New("marshalling token file")
 		}
+	}
 
-		// Unmarshal the token file
-		err = json.Unmarshal(token, &tokenMap)
+	// the user chooses signed tokens
+	switch *authFlag {
+	case AUTH_SESSION:
+	case AUTH_HMAC:
+		if *keysFlag == "" {
+			slog.Error("Missing key file. Specify with the -keys flag", "error", errors.New("missing key file"))
+			return config, errors.New("missing key file")
+		}
+		if *tokenFlag != "" {
+			slog.Error("Token files need session authentication", "error", errors.New("token file with hmac authentication"))
+			return config, errors.New("token file with hmac authentication")
+		}
+		keys, err := authentication.LoadKeyRing(*keysFlag)
 		if err != nil {
-			slog.Error("Error marshalling token file", "error", err)
-			return 0, nil, tokenMap, errors.New("marshalling token file")
+			slog.Error("Invalid key file", "error", err)
+			return config, errors.New("invalid key file")
 		}
+		config.Keys = keys
+	default:
+		slog.Error("Unknown authentication", "auth", *authFlag)
+		return config, errors.New("unknown authentication")
+	}
+
+	// the user inputs a user file
+	if *usersFlag != "" {
+		users, err := authentication.LoadUserStore(*usersFlag)
+		if err != nil {
+			slog.Error("Invalid user file", "error", err)
+			return config, errors.New("invalid user file")
+		}
+		config.Users = users
+	}
+
+	// the user inputs an API key file
+	if *apiKeysFlag != "" {
+		apiKeys, err := authentication.LoadAPIKeys(*apiKeysFlag)
+		if errors.Is(err, fs.ErrNotExist) {
+			apiKeys = authentication.NewAPIKeys(*apiKeysFlag)
+		} else if err != nil {
+			slog.Error("Invalid API key file", "error", err)
+			return config, errors.New("invalid API key file")
+		}
+		config.APIKeys = apiKeys
+	}
+
+	// the user inputs a rate limit file
+	if *limitsFlag != "" {
+		limits, err := ratelimit.LoadConfig(*limitsFlag)
+		if err != nil {
+			slog.Error("Invalid rate limit file", "error", err)
+			return config, errors.New("invalid rate limit file")
+		}
+		config.Limits = &limits
+	}
+
+	// the user inputs a grants file
+	if *grantsFlag != "" {
+		grants, err := rbac.LoadPolicy(*grantsFlag)
+		if err != nil {
+			slog.Error("Invalid grants file", "error", err)
+			return config, errors.New("invalid grants file")
+		}
+		config.Grants = grants
+	}
+
+	// API keys are managed by admins, who only exist with grants
+	if config.APIKeys != nil && config.Grants == nil {
+		slog.Error("API keys need a grants file", "apikeys", *apiKeysFlag)
+		return config, errors.New("API keys need a grants file")
+	}
+
+	if *ttlFlag <= 0 || *refreshTTLFlag < 0 || *sweepFlag <= 0 {
+		slog.Error("Invalid session lifetime", "ttl", *ttlFlag, "refreshttl", *refreshTTLFlag, "sweep", *sweepFlag)
+		return config, errors.New("invalid session lifetime")
+	}
+
+	if *idempotencyFlag < 0 {
+		slog.Error("Negative idempotency window", "window", *idempotencyFlag)
+		return config, errors.New("negative idempotency window")
+	}
+
+	// the user inputs an audit log, opened last so that nothing else can fail after
+	if *auditFlag != "" {
+		auditLog, err := audit.Open(*auditFlag)
+		if err != nil {
+			slog.Error("Invalid audit log", "error", err)
+			return config, errors.New("invalid audit log")
+		}
+		config.Audit = auditLog
 	}
 
 	// set the logger level
@@ -66,6 +229,124 @@ func Initialize() (int, *jsonschema.Schema, map[string]string, error) {
 		slog.SetDefault(slog.New(h))
 	}
 
-	return *portNum, schema, tokenMap, nil
+	config.Port = *portNum
+	config.Schema = schema
+	config.SchemaSource = schemaSource
+	config.IdempotencyWindow = *idempotencyFlag
+	config.ApplyDefaults = *defaultsFlag
+	config.SessionTTL = *ttlFlag
+	config.RefreshTTL = *refreshTTLFlag
+	config.SlidingSessions = *slidingFlag
+	config.SweepInterval = *sweepFlag
+	config.AuthMode = *authFlag
+	config.Files = Files{
+		Schema: *schemaFlag,
+		Tokens: *tokenFlag,
+		Users:  *usersFlag,
+		Grants: *grantsFlag,
+		Limits: *limitsFlag,
+		Keys:   *keysFlag,
+	}
+	return config, nil
 
 }
+
+// Read the configuration files again, giving the schema, tokens, users, grants, limits
+// and keys of a new configuration. Files that are not given are left out. Nothing is
+// applied, so a running server can keep its configuration if any file is invalid.
+func Reload(files Files) (Config, error) {
+	var config Config
+	var err error
+
+	config.Schema, config.SchemaSource, err = loadSchema(files.Schema)
+	if err != nil {
+		return config, fmt.Errorf("invalid schema file: %w", err)
+	}
+	if files.Tokens != "" {
+		config.Tokens, err = loadTokens(files.Tokens)
+		if err != nil {
+			return config, fmt.Errorf("invalid token file: %w", err)
+		}
+	}
+	if files.Users != "" {
+		config.Users, err = authentication.LoadUserStore(files.Users)
+		if err != nil {
+			return config, fmt.Errorf("invalid user file: %w", err)
+		}
+	}
+	if files.Grants != "" {
+		config.Grants, err = rbac.LoadPolicy(files.Grants)
+		if err != nil {
+			return config, fmt.Errorf("invalid grants file: %w", err)
+		}
+	}
+	if files.Limits != "" {
+		limits, err := ratelimit.LoadConfig(files.Limits)
+		if err != nil {
+			return config, fmt.Errorf("invalid rate limit file: %w", err)
+		}
+		config.Limits = &limits
+	}
+	if files.Keys != "" {
+		config.Keys, err = authentication.LoadKeyRing(files.Keys)
+		if err != nil {
+			return config, fmt.Errorf("invalid key file: %w", err)
+		}
+	}
+	config.Files = files
+	return config, nil
+}
+
+// Compile the schema in a file, also returning its JSON text.
+func loadSchema(path string) (*jsonschema.Schema, []byte, error) {
+	schema, err := schemas.CompileFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return schema, source, nil
+}
+
+// Read a token file mapping usernames to their login tokens.
+func loadTokens(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens map[string]string
+	err = json.Unmarshal(data, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Add a user to the user file at the given path, creating the file if needed.
+// The password is the first line read from "in."
+func addUser(path, username string, in io.Reader) error {
+	if path == "" {
+		return errors.New("missing user file, specify with the -users flag")
+	}
+
+	users, err := authentication.LoadUserStore(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		users = authentication.NewUserStore(path)
+	} else if err != nil {
+		return err
+	}
+
+	password, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	err = users.SetPassword(username, password)
+	if err != nil {
+		return err
+	}
+	return users.Save()
+}
@@ -6,6 +6,8 @@ import (
 	"net/http"
 
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/patcher"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/structs"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/subscribe"
 	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
@@ -30,6 +32,13 @@ type ICollection interface {
 	// HTTP handler for GET requests on collections (query collection)
 	GetDoc(w http.ResponseWriter, r *http.Request)
 
+	// HTTP handler for GET requests on collections, listing only the documents keep returns true for
+	GetDocFiltered(w http.ResponseWriter, r *http.Request, keep func(doc IDocument) bool)
+
+	// Filter the events of a subscriber that is yet to stream to the documents that match,
+	// sending documents that start or stop matching as enter or leave events
+	FilterSubscriber(subscriber *subscribe.Subscriber, match func(doc IDocument) bool)
+
 	// HTTP handler for PUTs on document paths
 	PutDoc(w http.ResponseWriter, r *http.Request, path string, newDoc IDocument)
 
@@ -42,10 +51,62 @@ type ICollection interface {
 	// HTTP handler for POST on document paths
 	PostDoc(w http.ResponseWriter, r *http.Request, newDoc IDocument)
 
+	// HTTP handler for bulk POSTs of many documents at once
+	PostDocs(w http.ResponseWriter, r *http.Request, entries []BulkEntry, abortOnError bool)
+
+	// Insert a document under a name that is not yet taken, notifying subscribers
+	InsertDoc(name string, newDoc IDocument) error
+
+	// Remove a document, notifying subscribers
+	RemoveDoc(name string) (IDocument, bool)
+
+	// Take a document out to move it, if it is still the given one, and hand it to place, which puts
+	// a copy elsewhere; the document is put back if place fails, and subscribers notified if not
+	MoveDoc(name string, doc IDocument, place func() error) error
+
+	// Remove every document of this collection, whose URI is given, and the collections
+	// below them, notifying their subscribers
+	DropDocs(uri string)
+
+	// Get the schema of this collection and its JSON text, or nil if it has none of its own
+	GetSchema() (*jsonschema.Schema, []byte)
+
+	// Set the schema of this collection and its JSON text; nil makes it inherit its ancestors' schema
+	SetSchema(schema *jsonschema.Schema, source []byte)
+
+	// Get the ownership policy of this collection, or "" if it has none of its own
+	GetOwnership() string
+
+	// Set the ownership policy of this collection; "" makes it inherit its ancestors' policy
+	SetOwnership(policy string)
+
+	// Get the user who created this collection, or "" if unknown
+	GetCreator() string
+
+	// Check every document of this collection, whose URI is given, and of the collections below it
+	// that inherit its schema, against a new schema after applying the migration patches.
+	// When apply is set, the migrated documents are stored and subscribers notified.
+	Migrate(uri string, schema *jsonschema.Schema, migration []patcher.Patch, user string, apply bool, report *structs.SchemaReport)
+
+	// Deep-copy this collection and its documents to a new relative path,
+	// validating every copied document against the schema
+	DeepCopy(path string, user string, resetMeta bool, schema *jsonschema.Schema) (ICollection, error)
+
 	//Subscription
 	Subscribable
 }
 
+// A BulkEntry is one line of a bulk insert into a collection.
+type BulkEntry struct {
+	Line  int       // The line of the request body this entry came from, starting at 1.
+	Key   string    // The name requested for the document, or "" for a random name.
+	Doc   IDocument // The document to insert, or nil if the line was invalid.
+	Error string    // Why the line was invalid, if it was.
+
+	// The failing schema keywords, if the document did not conform.
+	Validation *structs.ValidationError
+}
+
 // Interface for a collection holder.
 // A collection holder holds collections.
 type ICollectionHolder interface {
@@ -67,6 +128,25 @@ type Authenticator interface {
 	ValidateToken(w http.ResponseWriter, r *http.Request) (string, bool)
 }
 
+// An authorizer decides which requests users may perform.
+type Authorizer interface {
+	// Authorize tells if the user may perform the request. If not,
+	// writes an error to the input response writer.
+	Authorize(w http.ResponseWriter, r *http.Request, username string) bool
+}
+
+// An auditor records requests and their outcomes.
+type Auditor interface {
+	// Records a request made by the user, the status of its response and its body.
+	Audit(r *http.Request, username string, status int, body []byte)
+}
+
+// An AdminChecker tells which users administer a resource.
+type AdminChecker interface {
+	// Tells if the user administers the database or resource at the path.
+	IsAdminOf(username string, path string) bool
+}
+
 // A HasMetadata object allows storage and public retrieval of metadata
 type HasMetadata interface {
 	// Gets the original author of this document
@@ -77,10 +157,43 @@ type HasMetadata interface {
 	GetLastModified() int64
 }
 
+// A shareable object can be changed by collaborators besides its creator
+type Shareable interface {
+	// Get the users besides the creator who may change this document.
+	GetCollaborators() []string
+
+	// Set the users besides the creator who may change this document.
+	SetCollaborators(users []string)
+}
+
 // A overwritable object allows being overwritten
 type Overwriteable interface {
 	// Overwrite the body of a document upon recieving a put or patch.
 	OverwriteBody(docBody interface{}, name string)
+
+	// Delete every collection held by this document, whose URI is given.
+	// Returns whether there were any collections to delete.
+	DropChildren(uri string) bool
+}
+
+// A copyable object can be deep-copied together with the collections it holds
+type Copyable interface {
+	// Copy this document and its collections to a new relative path, validating
+	// every copied document against the schema. When resetMeta is set,
+	// the copies are recorded as created by the user now.
+	DeepCopy(path string, user string, resetMeta bool, schema *jsonschema.Schema) (IDocument, error)
+}
+
+// A migratable object can be checked against a new schema together with the collections it holds
+type Migratable interface {
+	// Apply the migration patches to a copy of the body of this document and check the result
+	// against the schema. Returns the migrated body, or why it does not conform.
+	MigrateBody(schema *jsonschema.Schema, migration []patcher.Patch) (interface{}, error)
+
+	// Check the collections of this document, whose URI is given, against a new schema after
+	// applying the migration patches, adding failures to the report. When apply is set, the
+	// migrated documents are stored.
+	MigrateChildren(uri string, schema *jsonschema.Schema, migration []patcher.Patch, user string, apply bool, report *structs.SchemaReport)
 }
 
 // A postable object supports posting
@@ -91,8 +204,6 @@ type Postable interface {
 
 // A Patchable object allows patching
 type Patchable interface {
-	ApplyPatch(patchData map[string]interface{}, schema *jsonschema.Schema, username string) error
-
 	// Applys a slice of patches to this document.
 	ApplyPatches(patches []patcher.Patch, schema *jsonschema.Schema) (patcher.PatchResponse, interface{})
 
@@ -100,11 +211,37 @@ type Patchable interface {
 	OverwriteBody(docBody interface{}, name string)
 }
 
+// A Watchable document tells its own subscribers when it changes.
+type Watchable interface {
+	// Sends the current document to its subscribers.
+	NotifyChanged()
+}
+
+// An attachable resource tells the recursive subscribers of the resources above it about its changes.
+type Attachable interface {
+	// Attach below the subscriber manager of the resource holding this one, under the path segment this one
+	// adds: a document's name, a collection's name between slashes, or a database's full path.
+	Attach(parent *subscribe.SubscriberManager, name string)
+
+	// Stop telling the resources above about changes, once removed.
+	Detach()
+
+	// Notifies the recursive subscribers of this resource and of those above it of a message about it.
+	NotifyTree(msg []byte)
+}
+
 // A subscribable object allows the sending of messages to subscribers.
 type Subscribable interface {
 	Subscribe(w http.ResponseWriter, r *http.Request, intervalStart, intervalEnd string) error
-	NotifySubscribersUpdate(msg []byte, intervalVal string)
-	NotifySubscribersDelete(msg string, intervalVal string)
+	// Sends the updates for the subscriber's interval to it until it closes, first replaying
+	// the events after lastEventID that it missed, if given. Used by transports besides SSE.
+	Stream(subscriber *subscribe.Subscriber, lastEventID string) error
+	// Notifies the subscribers whose interval holds the key of the updated or deleted document.
+	NotifySubscribersUpdate(msg []byte, key string)
+	NotifySubscribersDelete(msg string, key string)
+
+	// Notifies every subscriber that the subscribed resource itself was deleted.
+	NotifyResourceDeleted(msg string)
 	// Notifies subscribers of update messages.
 	// NotifySubscribersUpdate(msg []byte, intervalComp string)
 
@@ -15,37 +15,157 @@ import (
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/collectionholder"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/handlers"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/idempotency"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group70/initialize"
-	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/ratelimit"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/rbac"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/reload"
 )
 
 func main() {
 	var server *http.Server
 	var port int
-	var tokenMap map[string]string
 	var err error
-	var schema *jsonschema.Schema
+	var config initialize.Config
 	var authenticator authentication.Authenticator
+	var tokenAuthenticator *authentication.TokenAuthenticator
+	var auth interface {
+		interfaces.Authenticator
+		http.Handler
+	}
 	var owlDB handlers.Handler
 
 	// Initialize flags
-	port, schema, tokenMap, err = initialize.Initialize()
+	config, err = initialize.Initialize()
+	if err == initialize.ErrUserAdded {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(1)
+	}
+	port = config.Port
+
+	if config.AuthMode == initialize.AUTH_HMAC {
+		// signed tokens carry the user, so several servers can share the load
+		tokenAuthenticator = authentication.NewTokenAuthenticator(config.Keys, config.SessionTTL)
+		if config.Users != nil {
+			tokenAuthenticator.SetUserStore(config.Users)
+		}
+		if config.Grants != nil {
+			tokenAuthenticator.SetRoleSource(config.Grants.RolesOf)
+		}
+		if config.Audit != nil {
+			tokenAuthenticator.SetAuditor(config.Audit)
+		}
+		auth = tokenAuthenticator
+	} else {
+		authenticator = authentication.NewAuthenticator()
+		authenticator.SetSessionLifetime(config.SessionTTL, config.RefreshTTL, config.SlidingSessions)
+		stopSweeper := authenticator.StartSweeper(config.SweepInterval)
+		defer stopSweeper()
+		if config.Users != nil {
+			authenticator.SetUserStore(config.Users)
+		}
+		if config.Audit != nil {
+			authenticator.SetAuditor(config.Audit)
+		}
+		// install user tokens into the authenticator
+		authenticator.InstallUsers(config.Tokens)
+		auth = &authenticator
+	}
+	// API keys are checked before the login tokens
+	var validator interfaces.Authenticator = auth
+	if config.APIKeys != nil {
+		validator = config.APIKeys.Authenticate(auth)
+	}
 
-	authenticator = authentication.NewAuthenticator()
 	database := collectionholder.New()
-	owlDB = handlers.New(&database, schema, &authenticator)
+	owlDB = handlers.New(&database, config.Schema, validator)
+	owlDB.SetGlobalSchema(config.Schema, config.SchemaSource)
+	owlDB.SetApplyDefaults(config.ApplyDefaults)
+	if config.Grants != nil {
+		owlDB.SetAuthorizer(config.Grants)
+	}
+	if config.Audit != nil {
+		owlDB.SetAuditor(config.Audit)
+		defer config.Audit.Close()
+	}
+	var limiter *ratelimit.Limiter
+	if config.Limits != nil {
+		limiter = ratelimit.New(*config.Limits)
+		if config.Grants != nil {
+			limiter.SetRoleSource(config.Grants.HighestRole)
+		}
+		owlDB.SetRateLimiter(limiter)
+	}
+	if config.IdempotencyWindow > 0 {
+		owlDB.SetIdempotencyStore(idempotency.NewStore(config.IdempotencyWindow))
+	}
+
+	// Reload the configuration files on SIGHUP, reading them all before applying any
+	reloader := reload.New(func() error {
+		fresh, err := initialize.Reload(config.Files)
+		if err != nil {
+			return err
+		}
+		owlDB.SetGlobalSchema(fresh.Schema, fresh.SchemaSource)
+		if config.AuthMode == initialize.AUTH_SESSION {
+			authenticator.ReloadUsers(fresh.Tokens)
+		} else {
+			tokenAuthenticator.SetKeys(fresh.Keys)
+		}
+		if config.Users != nil {
+			config.Users.Replace(fresh.Users)
+		}
+		if config.Grants != nil {
+			config.Grants.Replace(fresh.Grants)
+		}
+		if limiter != nil {
+			limiter.SetConfig(*fresh.Limits)
+		}
+		return nil
+	})
+	stopReloader := reloader.HandleSignals()
+	defer stopReloader()
 
 	// Install handlers into the server mux
 	mux := http.NewServeMux()
 	mux.Handle("/v1/", &owlDB)
-	mux.Handle("/auth", &authenticator)
+	mux.Handle("/auth", auth)
+	if config.AuthMode == initialize.AUTH_SESSION {
+		mux.Handle("/auth/refresh", auth)
+	}
+	// admin endpoints only exist once the grants say who the admins are
+	if config.AuthMode == initialize.AUTH_SESSION && config.Grants != nil {
+		admin := rbac.RequireAdmin(config.Grants, auth, authenticator.Admin())
+		mux.Handle("/auth/users", admin)
+		mux.Handle("/auth/users/", admin)
+		mux.Handle("/auth/sessions", admin)
+		mux.Handle("/auth/sessions/", admin)
+	}
+	if config.Grants != nil {
+		mux.Handle("/admin/grants", rbac.RequireAdmin(config.Grants, auth, config.Grants))
+	}
+	if config.Audit != nil && config.Grants != nil {
+		mux.Handle("/admin/audit", rbac.RequireAdmin(config.Grants, auth, config.Audit))
+		mux.Handle("/admin/audit/verify", rbac.RequireAdmin(config.Grants, auth, config.Audit))
+	}
+	if limiter != nil && config.Grants != nil {
+		mux.Handle("/admin/limits", rbac.RequireAdmin(config.Grants, auth, limiter))
+	}
+	if config.APIKeys != nil {
+		// everyone manages their own keys, admins every key
+		apiKeys := config.APIKeys.Manage(auth, config.Grants.IsAdmin)
+		mux.Handle("/auth/apikeys", apiKeys)
+		mux.Handle("/auth/apikeys/", apiKeys)
+	}
+	if config.Grants != nil {
+		mux.Handle("/admin/reload", rbac.RequireAdmin(config.Grants, auth, reloader))
+	}
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		errorMessage.ErrorResponse(w, "Missing /v1/ or /auth in the request", 400)
 	})
 
-	// install user tokens into the authenticator
-	authenticator.InstallUsers(tokenMap)
-
 	server = &http.Server{
 		Addr:    fmt.Sprintf("localhost:%d", port),
 		Handler: mux,
@@ -12,13 +12,16 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/structs"
 )
 
-// Patch is a struct that represents a patch to be applied to a document
+// Patch is a struct that represents a patch to be applied to a document.
+// PATCH requests and schema migrations send it as {"op": ..., "path": ..., "value": ...}.
 type Patch struct {
-	Operation string      // the operation to be performed
-	Path      string      // the path to the value to be patched
-	Value     interface{} // the value to be added or replaced
+	Operation string      `json:"op"`    // the operation to be performed
+	Path      string      `json:"path"`  // the path to the value to be patched
+	Value     interface{} `json:"value"` // the value to be added or replaced
 }
 
 // A recursive struct that represents a patch to be applied to a document
@@ -29,9 +32,13 @@ type patchVisitor struct {
 
 // A PatchResponse stores the response from a Patch operation
 type PatchResponse struct {
-	Uri         string `json:"uri"`         // The URI at which this patch was applied.
-	PatchFailed bool   `json:"patchFailed"` // A boolean indicating whether this patch failed.
-	Message     string `json:"message"`     // A message indicating why a patch failed or "patches applied."
+	Uri         string      `json:"uri"`                // The URI at which this patch was applied.
+	PatchFailed bool        `json:"patchFailed"`        // A boolean indicating whether this patch failed.
+	Message     string      `json:"message"`            // A message indicating why a patch failed or "patches applied."
+	Document    interface{} `json:"document,omitempty"` // The stored document, if the client asked for it.
+
+	// The failing schema keywords, if the patched document did not conform.
+	Validation *structs.ValidationError `json:"validation,omitempty"`
 }
 
 // A JSONProcessor is used by ProcessJSON to handle arbitrary values that only contain
@@ -1,6 +1,7 @@
 package patcher
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -224,3 +225,17 @@ func TestApplyPatch_NotModifiedOnSuccess(t *testing.T) {
 	assert.Equal(t, doc, patchedDoc) // Ensure original doc remains unchanged
 
 }
+
+// test that patches are read with the keys of the owlDB API
+func TestPatch_JSON(t *testing.T) {
+	var patches []Patch
+	err := json.Unmarshal([]byte(`[{"op":"ObjectAdd","path":"/a","value":1}]`), &patches)
+	assert.NoError(t, err)
+	assert.Equal(t, []Patch{{Operation: "ObjectAdd", Path: "/a", Value: 1.0}}, patches)
+
+	// the field name is not a key of its own
+	patches = nil
+	err = json.Unmarshal([]byte(`[{"operation":"ObjectAdd","path":"/a"}]`), &patches)
+	assert.NoError(t, err)
+	assert.Equal(t, "", patches[0].Operation)
+}
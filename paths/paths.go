@@ -153,6 +153,60 @@ func ParsePath(request string, root interfaces.ICollectionHolder) (interfaces.IC
 
 }
 
+// Obtain the databases and collections along the specified path "request," outermost first,
+// together with their URIs. Start looking at the "root" collection holder.
+// Stops at the first resource on the path that does not exist.
+func CollectionsOnPath(request string, root interfaces.ICollectionHolder) ([]interfaces.ICollection, []string) {
+	colls := make([]interfaces.ICollection, 0)
+	uris := make([]string, 0)
+
+	// Check version
+	path, found := strings.CutPrefix(request, "/v1/")
+	if !found {
+		return colls, uris
+	}
+
+	uri := "/v1/"
+	var lastDoc interfaces.IDocument
+	for i, resource := range strings.Split(path, "/") {
+		if resource == "" {
+			break
+		}
+		uri += resource + "/"
+
+		if i == 0 {
+			// Database
+			coll, found := root.GetColl(resource)
+			if !found {
+				break
+			}
+			colls = append(colls, coll)
+			uris = append(uris, uri)
+		} else if i%2 == 1 {
+			// Document
+			doc, found := colls[len(colls)-1].FindDoc(resource)
+			if !found {
+				break
+			}
+			lastDoc = doc
+		} else {
+			// Collection
+			collHolder, hasCollection := interface{}(lastDoc).(interfaces.ICollectionHolder)
+			if !hasCollection {
+				break
+			}
+			coll, found := collHolder.GetColl(resource)
+			if !found {
+				break
+			}
+			colls = append(colls, coll)
+			uris = append(uris, uri)
+		}
+	}
+
+	return colls, uris
+}
+
 // Obtain the parent resource from the specified path "request."
 // Returns the truncated request, the resource name, and a result code.
 func GetParentResource(request string) (truncatedRequest string, parentResource string, resourceCode int) {
@@ -106,6 +106,32 @@ func TestParsePath_DocumentNotFound(t *testing.T) {
 	assert.Equal(t, ERROR_NO_DOC, resCode)
 }
 
+// Tests for CollectionsOnPath
+
+func TestCollectionsOnPath(t *testing.T) {
+	// Setting up /v1/db/doc1/inner/
+	holder := collectionholder.New()
+	coll := collection.New()
+	holder.PutColl(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v1/db", nil), "db", &coll)
+	doc := document.New("/doc1", "testUser", map[string]interface{}{"key": "value"})
+	coll.PutDoc(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v1/db/doc1", nil), "doc1", &doc)
+	inner := collection.New()
+	doc.PutColl(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v1/db/doc1/inner/", nil), "inner", &inner)
+
+	// Every collection on the path is found, outermost first
+	colls, uris := CollectionsOnPath("/v1/db/doc1/inner/doc2", &holder)
+	assert.Equal(t, []string{"/v1/db/", "/v1/db/doc1/inner/"}, uris)
+	assert.Len(t, colls, 2)
+
+	// Looking stops at a missing resource
+	colls, uris = CollectionsOnPath("/v1/db/doc3/inner/", &holder)
+	assert.Equal(t, []string{"/v1/db/"}, uris)
+	assert.Len(t, colls, 1)
+
+	colls, _ = CollectionsOnPath("/v2/db/", &holder)
+	assert.Empty(t, colls)
+}
+
 // Tests for GetParentResource
 
 func TestGetParentResource_ValidDoc(t *testing.T) {
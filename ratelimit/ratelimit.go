@@ -0,0 +1,251 @@
+// Package ratelimit limits how fast each user may make requests, with
+// token buckets giving separate budgets for reads, writes and subscriptions.
+// Implement the handler interface for showing usage, expect input urls to start with "/admin/limits."
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
+)
+
+// The classes of requests, each with its own budget
+const (
+	CLASS_READ      = "read"      // GET requests
+	CLASS_WRITE     = "write"     // Every other request
+	CLASS_SUBSCRIBE = "subscribe" // Requests starting a subscription
+)
+
+// How often buckets that have filled up again are forgotten
+const SWEEP_INTERVAL = time.Minute
+
+// A Limit lets a user make Burst requests at once, refilled at Rate requests per second.
+// A zero rate means no limit.
+type Limit struct {
+	Rate  float64 `json:"rate"`  // Requests per second.
+	Burst int     `json:"burst"` // The most requests at once.
+}
+
+// The Limits of a user, one for each class of request
+type Limits struct {
+	Read      Limit `json:"read"`
+	Write     Limit `json:"write"`
+	Subscribe Limit `json:"subscribe"`
+}
+
+// The Config of a limiter gives the limits of users by username, then by role, then the default.
+type Config struct {
+	Default Limits            `json:"default"`         // The limits of everyone else.
+	Users   map[string]Limits `json:"users,omitempty"` // The limits of particular users.
+	Roles   map[string]Limits `json:"roles,omitempty"` // The limits of users with a role.
+}
+
+// A bucket holds the requests a user may still make in one class.
+type bucket struct {
+	tokens  float64   // The requests available
+	last    time.Time // When tokens was last brought up to date
+	allowed int       // The requests allowed
+	denied  int       // The requests refused
+}
+
+// A Limiter decides whether users are over their limits.
+type Limiter struct {
+	config  Config                       // The limits
+	roleOf  func(username string) string // Finds the role of a user, if set
+	buckets map[string]*bucket           // The buckets by class and username
+	last    time.Time                    // The last time full buckets were forgotten
+	now     func() time.Time             // The clock
+	mu      sync.Mutex                   // To protect access to above
+}
+
+// Create a new limiter with the given limits.
+func New(config Config) *Limiter {
+	return &Limiter{config: config, buckets: make(map[string]*bucket), last: time.Now(), now: time.Now}
+}
+
+// Load the limits of a limiter from a JSON file.
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, err
+	}
+
+	limits := []Limits{config.Default}
+	for _, userLimits := range config.Users {
+		limits = append(limits, userLimits)
+	}
+	for _, roleLimits := range config.Roles {
+		limits = append(limits, roleLimits)
+	}
+	for _, l := range limits {
+		for _, limit := range []Limit{l.Read, l.Write, l.Subscribe} {
+			if limit.Rate < 0 || limit.Burst < 0 || (limit.Rate > 0 && limit.Burst < 1) {
+				return config, fmt.Errorf("invalid limit of %g per second with burst %d", limit.Rate, limit.Burst)
+			}
+		}
+	}
+	return config, nil
+}
+
+// Replace the limits. Users keep the requests they have left, up to their new burst.
+func (l *Limiter) SetConfig(config Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = config
+}
+
+// Look up the roles of users for role limits with the given function.
+func (l *Limiter) SetRoleSource(roleOf func(username string) string) {
+	l.roleOf = roleOf
+}
+
+// Authorize implements the authorizer interface. It takes a request from the user's
+// budget for its class, or writes a 429 error with a Retry-After header if there is none left.
+func (l *Limiter) Authorize(w http.ResponseWriter, r *http.Request, username string) bool {
+	class := Classify(r)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit := l.limitFor(username, class)
+	if limit.Rate == 0 {
+		return true
+	}
+	now := l.now()
+	l.sweep(now)
+
+	b := l.buckets[class+" "+username]
+	if b == nil {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[class+" "+username] = b
+	}
+	refill(b, limit, now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.allowed++
+		return true
+	}
+
+	b.denied++
+	retryAfter := int(math.Ceil((1 - b.tokens) / limit.Rate))
+	slog.Info("ratelimit Authorize: request over limit", "username", username, "class", class, "retryAfter", retryAfter)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	errorMessage.ErrorResponse(w, fmt.Sprintf("rate limit exceeded, retry in %d seconds", retryAfter), http.StatusTooManyRequests)
+	return false
+}
+
+// Classify a request to the database handler as a read, a write or a subscription.
+func Classify(r *http.Request) string {
+	if r.URL.Path == "/v1/subscribe" || r.URL.Query().Get("mode") == "subscribe" {
+		return CLASS_SUBSCRIBE
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodOptions {
+		return CLASS_READ
+	}
+	return CLASS_WRITE
+}
+
+// Find the limit of a user for a class of requests. The caller must hold the lock.
+func (l *Limiter) limitFor(username, class string) Limit {
+	limits, found := l.config.Users[username]
+	if !found && l.roleOf != nil {
+		limits, found = l.config.Roles[l.roleOf(username)]
+	}
+	if !found {
+		limits = l.config.Default
+	}
+
+	switch class {
+	case CLASS_READ:
+		return limits.Read
+	case CLASS_SUBSCRIBE:
+		return limits.Subscribe
+	default:
+		return limits.Write
+	}
+}
+
+// Add the requests earned since a bucket was last brought up to date, up to the burst.
+func refill(b *bucket, limit Limit, now time.Time) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+}
+
+// Forget the buckets that have filled up again, which are no different from new ones.
+// The caller must hold the lock.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.last) < SWEEP_INTERVAL {
+		return
+	}
+	l.last = now
+
+	for key, b := range l.buckets {
+		class, username, _ := strings.Cut(key, " ")
+		limit := l.limitFor(username, class)
+		if limit.Rate == 0 || b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// The Usage of a user in one class of requests
+type Usage struct {
+	Available float64 `json:"available"` // The requests the user may make now.
+	Limit     Limit   `json:"limit"`     // The limit of the user.
+	Allowed   int     `json:"allowed"`   // The requests allowed since the bucket was created.
+	Denied    int     `json:"denied"`    // The requests refused since the bucket was created.
+}
+
+// Report the usage of every user with a bucket, by username and class.
+func (l *Limiter) Usage() map[string]map[string]Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	usage := make(map[string]map[string]Usage)
+	for key, current := range l.buckets {
+		class, username, _ := strings.Cut(key, " ")
+		limit := l.limitFor(username, class)
+		b := *current
+		refill(&b, limit, now)
+		if usage[username] == nil {
+			usage[username] = make(map[string]Usage)
+		}
+		usage[username][class] = Usage{Available: math.Floor(b.tokens), Limit: limit, Allowed: b.allowed, Denied: b.denied}
+	}
+	return usage
+}
+
+// ServeHTTP implements the http.Handler interface for showing the usage of every user.
+func (l *Limiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		slog.Info("ratelimit ServeHTTP: unsupported method", "method", r.Method)
+		errorMessage.ErrorResponse(w, "unsupported method: "+r.Method, http.StatusBadRequest)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(l.Usage())
+	if err != nil {
+		// This should never happen
+		slog.Error("ratelimit ServeHTTP: error marshalling usage", "error", err)
+		errorMessage.ErrorResponse(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
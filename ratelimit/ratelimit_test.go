@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A clock for testing that only moves when told to.
+type fakeClock struct {
+	current time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.current
+}
+
+// Create a limiter for testing with the given limits and a fake clock.
+func testLimiter(config Config) (*Limiter, *fakeClock) {
+	clock := &fakeClock{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	limiter := New(config)
+	limiter.now = clock.now
+	limiter.last = clock.current
+	return limiter, clock
+}
+
+// Make a request as the user and return the response.
+func request(limiter *Limiter, username, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	if limiter.Authorize(w, httptest.NewRequest(method, target, http.NoBody), username) {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w
+}
+
+func TestTokenBucket(t *testing.T) {
+	limiter, clock := testLimiter(Config{Default: Limits{
+		Read:  Limit{Rate: 1, Burst: 2},
+		Write: Limit{Rate: 0.5, Burst: 1},
+	}})
+
+	for i := 0; i < 2; i++ {
+		if w := request(limiter, "rexle", http.MethodGet, "/v1/db/"); w.Code != http.StatusOK {
+			t.Errorf("Expected read %d within the burst to be allowed, got %d", i, w.Code)
+		}
+	}
+	w := request(limiter, "rexle", http.MethodGet, "/v1/db/")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After 1, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// reads and writes have separate budgets, and so do users
+	if w := request(limiter, "rexle", http.MethodPut, "/v1/db/doc"); w.Code != http.StatusOK {
+		t.Errorf("Expected a write to be allowed, got %d", w.Code)
+	}
+	w = request(limiter, "rexle", http.MethodPost, "/v1/db/")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("Expected 429 with Retry-After 2, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := request(limiter, "other", http.MethodGet, "/v1/db/"); w.Code != http.StatusOK {
+		t.Errorf("Expected another user to be allowed, got %d", w.Code)
+	}
+
+	clock.current = clock.current.Add(time.Second)
+	if w := request(limiter, "rexle", http.MethodGet, "/v1/db/"); w.Code != http.StatusOK {
+		t.Errorf("Expected the bucket to refill, got %d", w.Code)
+	}
+
+	usage := limiter.Usage()["rexle"]
+	if usage[CLASS_READ].Allowed != 3 || usage[CLASS_READ].Denied != 1 || usage[CLASS_WRITE].Denied != 1 {
+		t.Errorf("Expected usage to count requests, got %+v", usage)
+	}
+
+	// full buckets are forgotten
+	clock.current = clock.current.Add(SWEEP_INTERVAL)
+	request(limiter, "other", http.MethodGet, "/v1/db/")
+	if _, found := limiter.Usage()["rexle"]; found {
+		t.Errorf("Expected full buckets to be forgotten, got %+v", limiter.Usage())
+	}
+}
+
+func TestLimitsByUserAndRole(t *testing.T) {
+	limiter, _ := testLimiter(Config{
+		Default: Limits{Subscribe: Limit{Rate: 1, Burst: 1}},
+		Users:   map[string]Limits{"batch": {Subscribe: Limit{Rate: 1, Burst: 3}}},
+		Roles:   map[string]Limits{"admin": {}},
+	})
+	limiter.SetRoleSource(func(username string) string {
+		if username == "root" {
+			return "admin"
+		}
+		return ""
+	})
+
+	counts := map[string]int{}
+	for _, username := range []string{"rexle", "batch", "root"} {
+		for i := 0; i < 5; i++ {
+			if request(limiter, username, http.MethodGet, "/v1/subscribe").Code == http.StatusOK {
+				counts[username]++
+			}
+		}
+	}
+	if counts["rexle"] != 1 || counts["batch"] != 3 || counts["root"] != 5 {
+		t.Errorf("Expected 1, 3 and unlimited subscriptions, got %v", counts)
+	}
+	if Classify(httptest.NewRequest(http.MethodGet, "/v1/db/doc?mode=subscribe", http.NoBody)) != CLASS_SUBSCRIBE {
+		t.Errorf("Expected mode=subscribe to be a subscription")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.json")
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(good, []byte("{\"default\":{\"read\":{\"rate\":10,\"burst\":20}},\"users\":{\"batch\":{}}}"), 0600)
+	os.WriteFile(bad, []byte("{\"default\":{\"read\":{\"rate\":10,\"burst\":0}}}"), 0600)
+
+	config, err := LoadConfig(good)
+	if err != nil || config.Default.Read.Burst != 20 {
+		t.Errorf("Expected the limits to load, got %+v %v", config, err)
+	}
+	if _, err := LoadConfig(bad); err == nil {
+		t.Errorf("Expected a limit without a burst to be rejected")
+	}
+}
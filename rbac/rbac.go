@@ -0,0 +1,412 @@
+// Package rbac grants users roles on databases, and on path prefixes within them,
+// and decides which requests users may perform. Implement the handler interface
+// for managing grants, expect input urls to start with "/admin/grants."
+package rbac
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/interfaces"
+)
+
+// The roles, from least to most privileged, and the wildcards for grants
+const (
+	ROLE_READER   = "reader" // May read documents and collections
+	ROLE_WRITER   = "writer" // May also create, change and delete documents and collections
+	ROLE_ADMIN    = "admin"  // May also create and delete databases and set schemas
+	ALL_DATABASES = "*"      // A grant on every database
+	ALL_USERS     = "*"      // A grant to every authenticated user
+)
+
+// How privileged each role is
+var roleRanks = map[string]int{ROLE_READER: 1, ROLE_WRITER: 2, ROLE_ADMIN: 3}
+
+// A Grant gives a user a role on a database, or on the paths below a prefix in it.
+type Grant struct {
+	User     string `json:"user"`             // The username, or "*" for every user.
+	Database string `json:"database"`         // The database, or "*" for every database.
+	Prefix   string `json:"prefix,omitempty"` // The path prefix within the database, such as "/doc/coll/", if any.
+	Role     string `json:"role"`             // The role granted.
+}
+
+// A Policy holds the grants of every user and saves them to a file.
+type Policy struct {
+	path   string       // The file grants are saved to, if any
+	grants []Grant      // The grants
+	mu     sync.RWMutex // To protect access to above
+}
+
+// Create a new policy without grants that saves to the file at the given path, if any.
+func NewPolicy(path string) *Policy {
+	return &Policy{path: path, grants: make([]Grant, 0)}
+}
+
+// Load a policy from a file holding a JSON array of grants.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var grants []Grant
+	err = json.Unmarshal(data, &grants)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := NewPolicy(path)
+	for _, grant := range grants {
+		err = checkGrant(grant)
+		if err != nil {
+			return nil, err
+		}
+		policy.grants = append(policy.grants, grant)
+	}
+	return policy, nil
+}
+
+// Get a copy of every grant.
+func (p *Policy) Grants() []Grant {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append(make([]Grant, 0, len(p.grants)), p.grants...)
+}
+
+// Add a grant, replacing the role of an existing grant to the same user on the same path.
+func (p *Policy) Grant(grant Grant) error {
+	err := checkGrant(grant)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, existing := range p.grants {
+		if existing.User == grant.User && existing.Database == grant.Database && existing.Prefix == grant.Prefix {
+			p.grants[i] = grant
+			return p.save()
+		}
+	}
+	p.grants = append(p.grants, grant)
+	return p.save()
+}
+
+// Remove the grant to a user on a path. Returns false if there was none.
+func (p *Policy) Revoke(grant Grant) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, existing := range p.grants {
+		if existing.User == grant.User && existing.Database == grant.Database && existing.Prefix == grant.Prefix {
+			p.grants = append(p.grants[:i], p.grants[i+1:]...)
+			return true, p.save()
+		}
+	}
+	return false, nil
+}
+
+// Replace every grant with those of another policy, such as one reloaded from the file.
+func (p *Policy) Replace(other *Policy) {
+	grants := other.Grants()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.grants = grants
+}
+
+// Check whether the user has at least the given role on the path of a database or resource.
+func (p *Policy) Allowed(username, path, role string) bool {
+	database, rest, found := splitPath(path)
+	if !found {
+		// not a database path; the handler rejects it
+		return true
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, grant := range p.grants {
+		if grant.User != username && grant.User != ALL_USERS {
+			continue
+		}
+		if grant.Database != database && grant.Database != ALL_DATABASES {
+			continue
+		}
+		if !underPrefix(rest, grant.Prefix) {
+			continue
+		}
+		if roleRanks[grant.Role] >= roleRanks[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the user administers the database or resource at the path.
+func (p *Policy) IsAdminOf(username, path string) bool {
+	return p.Allowed(username, path, ROLE_ADMIN)
+}
+
+// Check whether the user administers every database.
+func (p *Policy) IsAdmin(username string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, grant := range p.grants {
+		if (grant.User == username || grant.User == ALL_USERS) && grant.Database == ALL_DATABASES &&
+			grant.Prefix == "" && grant.Role == ROLE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize tells if the user may perform the request to the database handler.
+// If not, writes a 403 error to the response writer.
+func (p *Policy) Authorize(w http.ResponseWriter, r *http.Request, username string) bool {
+	role := requiredRole(r)
+	allowed := p.Allowed(username, TargetPath(r), role)
+
+	// copies and moves also write their destination
+	mode := r.URL.Query().Get("mode")
+	if allowed && r.Method == http.MethodPost && (mode == "copy" || mode == "move") {
+		allowed = p.Allowed(username, r.URL.Query().Get("to"), ROLE_WRITER)
+	}
+
+	if !allowed {
+		slog.Info("rbac Authorize: request denied", "username", username, "method", r.Method, "path", TargetPath(r), "role", role)
+		errorMessage.ErrorResponse(w, fmt.Sprintf("forbidden: %s role required", role), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// ServeHTTP implements the http.Handler interface for managing grants.
+// GET lists the grants, POST adds the grant in the body and DELETE removes it.
+func (p *Policy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse, err := json.Marshal(p.Grants())
+		if err != nil {
+			// This should never happen
+			slog.Error("rbac ServeHTTP: error marshalling grants", "error", err)
+			errorMessage.ErrorResponse(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResponse)
+	case http.MethodPost:
+		grant, ok := readGrant(w, r)
+		if !ok {
+			return
+		}
+		err := checkGrant(grant)
+		if err != nil {
+			slog.Info("rbac ServeHTTP: invalid grant", "error", err)
+			errorMessage.ErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = p.Grant(grant)
+		if err != nil {
+			slog.Error("rbac ServeHTTP: could not save grants", "error", err)
+			errorMessage.ErrorResponse(w, "could not save grants", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("rbac ServeHTTP: grant added", "user", grant.User, "database", grant.Database, "prefix", grant.Prefix, "role", grant.Role)
+		jsonResponse, _ := json.Marshal(grant)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(jsonResponse)
+	case http.MethodDelete:
+		grant, ok := readGrant(w, r)
+		if !ok {
+			return
+		}
+		found, err := p.Revoke(grant)
+		if err != nil {
+			slog.Error("rbac ServeHTTP: could not save grants", "error", err)
+			errorMessage.ErrorResponse(w, "could not save grants", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			errorMessage.ErrorResponse(w, "grant not found", http.StatusNotFound)
+			return
+		}
+		slog.Info("rbac ServeHTTP: grant revoked", "user", grant.User, "database", grant.Database, "prefix", grant.Prefix)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		slog.Info("rbac ServeHTTP: unsupported method", "method", r.Method)
+		errorMessage.ErrorResponse(w, "unsupported method: "+r.Method, http.StatusBadRequest)
+	}
+}
+
+// RequireAdmin wraps a handler so that only users who administer every database may use it.
+// Without a policy, no one is an admin and no one may.
+func RequireAdmin(policy *Policy, authenticator interfaces.Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, valid := authenticator.ValidateToken(w, r)
+		if !valid {
+			return
+		}
+		if policy == nil || !policy.IsAdmin(username) {
+			slog.Info("rbac RequireAdmin: request denied", "username", username, "path", r.URL.Path)
+			errorMessage.ErrorResponse(w, "forbidden: admin role required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Decide which role a request to the database handler needs.
+// Reading needs a reader, creating and deleting whole databases
+// and setting schemas or ownership policies needs an admin, everything else a writer.
+func requiredRole(r *http.Request) string {
+	if r.Method == http.MethodGet {
+		return ROLE_READER
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "schema" || mode == "ownership" {
+		return ROLE_ADMIN
+	}
+
+	_, rest, _ := splitPath(r.URL.Path)
+	if rest == "" && (r.Method == http.MethodPut || r.Method == http.MethodDelete) {
+		return ROLE_ADMIN
+	}
+	return ROLE_WRITER
+}
+
+// TargetPath gives the path of the database or resource a request to the database handler
+// is about. That is the request path, except for the legacy "/v1/subscribe" endpoint,
+// which names the database it subscribes to in its "collection" query parameter.
+func TargetPath(r *http.Request) string {
+	if r.URL.Path == "/v1/subscribe" {
+		return "/v1/" + r.URL.Query().Get("collection") + "/"
+	}
+	return r.URL.Path
+}
+
+// Check whether the path of a database or resource lies in the given database,
+// or any database for "*", and below the given prefix within it.
+func Covers(path, database, prefix string) bool {
+	db, rest, found := splitPath(path)
+	return found && (database == ALL_DATABASES || database == db) && underPrefix(rest, prefix)
+}
+
+// Split a path such as "/v1/db/doc/coll/" into the database "db" and the rest "/doc/coll/".
+// Returns false if it is not a database path.
+func splitPath(path string) (string, string, bool) {
+	path, found := strings.CutPrefix(path, "/v1/")
+	if !found || path == "" {
+		return "", "", false
+	}
+	database, rest, hasRest := strings.Cut(path, "/")
+	if hasRest {
+		rest = "/" + rest
+	}
+	return database, rest, true
+}
+
+// Check whether the rest of a path lies below the prefix of a grant.
+// The prefix "/doc" covers "/doc" and "/doc/coll/" but not "/doc2".
+func underPrefix(rest, prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	return rest == prefix || strings.HasPrefix(rest, prefix+"/")
+}
+
+// Check that a grant names a user, a database and a known role.
+func checkGrant(grant Grant) error {
+	if grant.User == "" || grant.Database == "" {
+		return errors.New("grant needs a user and a database")
+	}
+	if _, known := roleRanks[grant.Role]; !known {
+		return fmt.Errorf("unknown role %s", grant.Role)
+	}
+	if grant.Prefix != "" && !strings.HasPrefix(grant.Prefix, "/") {
+		return errors.New("grant prefix must start with /")
+	}
+	return nil
+}
+
+// Read a grant from the request body.
+// Returns false and writes an error if it is malformed.
+func readGrant(w http.ResponseWriter, r *http.Request) (Grant, bool) {
+	var grant Grant
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err == nil {
+		err = json.Unmarshal(body, &grant)
+	}
+	if err != nil {
+		slog.Info("rbac readGrant: invalid grant", "error", err)
+		errorMessage.ErrorResponse(w, "invalid grant format", http.StatusBadRequest)
+		return grant, false
+	}
+	return grant, true
+}
+
+// Save the grants to the file of the policy, if any. The caller must hold the lock.
+func (p *Policy) save() error {
+	if p.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(p.grants, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// replace the file at once so that readers never see a partial policy
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), ".grants-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
+
+// Find the most privileged role a user has anywhere, or "" if none.
+func (p *Policy) HighestRole(username string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	highest := ""
+	for _, grant := range p.grants {
+		if (grant.User == username || grant.User == ALL_USERS) && roleRanks[grant.Role] > roleRanks[highest] {
+			highest = grant.Role
+		}
+	}
+	return highest
+}
+
+// List the roles of a user, such as "writer:db1" or "reader:db1/doc/coll/",
+// for putting into signed tokens.
+func (p *Policy) RolesOf(username string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	roles := make([]string, 0)
+	for _, grant := range p.grants {
+		if grant.User == username || grant.User == ALL_USERS {
+			roles = append(roles, grant.Role+":"+grant.Database+grant.Prefix)
+		}
+	}
+	return roles
+}
@@ -0,0 +1,146 @@
+package rbac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// An authenticator that takes the bearer token as the username.
+type tokenIsUser struct{}
+
+// Validate a token by taking it as the username.
+func (tokenIsUser) ValidateToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return username, username != ""
+}
+
+// Create a policy with a few grants
+func testPolicy(t *testing.T) *Policy {
+	policy := NewPolicy(filepath.Join(t.TempDir(), "grants.json"))
+	assert.NoError(t, policy.Grant(Grant{User: "root", Database: ALL_DATABASES, Role: ROLE_ADMIN}))
+	assert.NoError(t, policy.Grant(Grant{User: "alice", Database: "db1", Role: ROLE_WRITER}))
+	assert.NoError(t, policy.Grant(Grant{User: "bob", Database: "db1", Role: ROLE_READER}))
+	assert.NoError(t, policy.Grant(Grant{User: "bob", Database: "db1", Prefix: "/doc/coll/", Role: ROLE_ADMIN}))
+	return policy
+}
+
+// test which roles requests need
+func TestRequiredRole(t *testing.T) {
+	cases := map[string]string{
+		"GET /v1/db1/doc":                ROLE_READER,
+		"GET /v1/db1/?mode=schema":       ROLE_READER,
+		"PUT /v1/db1/doc":                ROLE_WRITER,
+		"POST /v1/db1/":                  ROLE_WRITER,
+		"PATCH /v1/db1/doc":              ROLE_WRITER,
+		"DELETE /v1/db1/doc":             ROLE_WRITER,
+		"PUT /v1/db1":                    ROLE_ADMIN,
+		"DELETE /v1/db1":                 ROLE_ADMIN,
+		"PUT /v1/db1/doc/c/?mode=schema": ROLE_ADMIN,
+	}
+	for request, role := range cases {
+		method, target, _ := strings.Cut(request, " ")
+		assert.Equal(t, role, requiredRole(httptest.NewRequest(method, target, nil)), request)
+	}
+}
+
+// test that grants apply to their databases and prefixes only
+func TestAllowed(t *testing.T) {
+	policy := testPolicy(t)
+
+	assert.True(t, policy.Allowed("root", "/v1/anything", ROLE_ADMIN))
+	assert.True(t, policy.Allowed("alice", "/v1/db1/doc", ROLE_WRITER))
+	assert.False(t, policy.Allowed("alice", "/v1/db1", ROLE_ADMIN))
+	assert.False(t, policy.Allowed("alice", "/v1/db2/doc", ROLE_READER))
+	assert.True(t, policy.Allowed("bob", "/v1/db1/doc", ROLE_READER))
+	assert.False(t, policy.Allowed("bob", "/v1/db1/doc", ROLE_WRITER))
+	assert.True(t, policy.Allowed("bob", "/v1/db1/doc/coll/x", ROLE_WRITER))
+	assert.True(t, policy.Allowed("bob", "/v1/db1/doc/coll/", ROLE_ADMIN))
+	assert.False(t, policy.Allowed("bob", "/v1/db1/doc/coll2/", ROLE_WRITER))
+	assert.False(t, policy.Allowed("carol", "/v1/db1/doc", ROLE_READER))
+
+	assert.NoError(t, policy.Grant(Grant{User: ALL_USERS, Database: "public", Role: ROLE_READER}))
+	assert.True(t, policy.Allowed("carol", "/v1/public/doc", ROLE_READER))
+
+	assert.True(t, policy.IsAdmin("root"))
+	assert.False(t, policy.IsAdmin("bob"))
+}
+
+// test that a copy also needs to write its destination
+func TestAuthorize(t *testing.T) {
+	policy := testPolicy(t)
+
+	w := httptest.NewRecorder()
+	assert.False(t, policy.Authorize(w, httptest.NewRequest(http.MethodDelete, "/v1/db1", nil), "alice"))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "\"forbidden: admin role required\"", w.Body.String())
+
+	w = httptest.NewRecorder()
+	assert.True(t, policy.Authorize(w, httptest.NewRequest(http.MethodPost, "/v1/db1/doc?mode=copy&to=/v1/db1/doc2", nil), "alice"))
+	assert.False(t, policy.Authorize(w, httptest.NewRequest(http.MethodPost, "/v1/db1/doc?mode=copy&to=/v1/db2/doc", nil), "alice"))
+
+	// the legacy subscribe endpoint is about the database it names
+	assert.True(t, policy.Authorize(w, httptest.NewRequest(http.MethodGet, "/v1/subscribe?collection=db1", nil), "alice"))
+	assert.False(t, policy.Authorize(w, httptest.NewRequest(http.MethodGet, "/v1/subscribe?collection=db2", nil), "alice"))
+}
+
+// test managing grants through the admin API, and that they are saved
+func TestAdminAPI(t *testing.T) {
+	policy := testPolicy(t)
+	admin := RequireAdmin(policy, tokenIsUser{}, policy)
+
+	request := func(method, user, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/admin/grants", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+user)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "alice", "").Code)
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "root", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "root", `{"user":"carol","database":"db1","role":"owner"}`).Code)
+	assert.Equal(t, http.StatusCreated, request(http.MethodPost, "root", `{"user":"carol","database":"db1","role":"reader"}`).Code)
+	assert.True(t, policy.Allowed("carol", "/v1/db1/doc", ROLE_READER))
+
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "root", `{"user":"alice","database":"db1"}`).Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "root", `{"user":"alice","database":"db1"}`).Code)
+	assert.False(t, policy.Allowed("alice", "/v1/db1/doc", ROLE_READER))
+
+	loaded, err := LoadPolicy(policy.path)
+	assert.NoError(t, err)
+	assert.Equal(t, policy.Grants(), loaded.Grants())
+
+	// Without a policy, no one may use admin endpoints
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/admin/grants", nil)
+	r.Header.Set("Authorization", "Bearer root")
+	RequireAdmin(nil, tokenIsUser{}, policy).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// test that invalid grant files are rejected
+func TestLoadPolicyInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grants.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"user":"a","database":"db","role":"superuser"}]`), 0600))
+	_, err := LoadPolicy(path)
+	assert.Error(t, err)
+
+	_, err = LoadPolicy(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestReplace(t *testing.T) {
+	policy := testPolicy(t)
+	reloaded := NewPolicy("")
+	assert.NoError(t, reloaded.Grant(Grant{User: "carol", Database: "db1", Role: ROLE_WRITER}))
+
+	policy.Replace(reloaded)
+	assert.False(t, policy.Allowed("alice", "/v1/db1/doc", ROLE_WRITER))
+	assert.True(t, policy.Allowed("carol", "/v1/db1/doc", ROLE_WRITER))
+}
@@ -0,0 +1,112 @@
+// Package reload re-reads the configuration of a running server when it receives
+// SIGHUP, or when an admin asks, so that credentials and the schema can change
+// without a restart dropping every subscriber. Implement the handler interface
+// for reloading, expect input urls to start with "/admin/reload."
+package reload
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/errorMessage"
+)
+
+// The Result of a reload
+type Result struct {
+	Time  time.Time `json:"time"`            // When the reload finished.
+	OK    bool      `json:"ok"`              // Whether the new configuration was applied.
+	Error string    `json:"error,omitempty"` // Why it was not, if it was not.
+}
+
+// A Reloader runs one reload at a time and remembers how the last one went.
+type Reloader struct {
+	reload func() error     // Reads the configuration and applies it, or leaves it alone and returns an error
+	last   *Result          // The last reload, if any
+	now    func() time.Time // The clock
+	mu     sync.Mutex       // To protect access to above, and to run one reload at a time
+}
+
+// Create a new reloader calling the given function to reload. The function must read
+// everything before changing anything, so that an error leaves the old configuration in place.
+func New(reload func() error) *Reloader {
+	return &Reloader{reload: reload, now: time.Now}
+}
+
+// Reload the configuration, logging the outcome.
+func (l *Reloader) Reload() Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.reload()
+	result := Result{Time: l.now().UTC(), OK: err == nil}
+	if err != nil {
+		slog.Error("reload Reload: configuration not reloaded, keeping the old one", "error", err)
+		result.Error = err.Error()
+	} else {
+		slog.Info("reload Reload: configuration reloaded")
+	}
+	l.last = &result
+	return result
+}
+
+// Reload whenever the process receives SIGHUP, until the returned function is called.
+func (l *Reloader) HandleSignals() func() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case <-signals:
+				l.Reload()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// ServeHTTP implements the http.Handler interface for the reloader. POST reloads
+// the configuration, answering "422 Unprocessable Entity" with the reason if the
+// files are invalid, and GET shows how the last reload went.
+func (l *Reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var result Result
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodPost:
+		result = l.Reload()
+		if !result.OK {
+			status = http.StatusUnprocessableEntity
+		}
+	case http.MethodGet:
+		l.mu.Lock()
+		last := l.last
+		l.mu.Unlock()
+		if last == nil {
+			errorMessage.ErrorResponse(w, "configuration not reloaded yet", http.StatusNotFound)
+			return
+		}
+		result = *last
+	default:
+		slog.Info("reload ServeHTTP: unsupported method", "method", r.Method)
+		errorMessage.ErrorResponse(w, "unsupported method: "+r.Method, http.StatusBadRequest)
+		return
+	}
+
+	jsonResponse, _ := json.Marshal(result)
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
+}
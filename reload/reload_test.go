@@ -0,0 +1,76 @@
+package reload
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Send a request to the reloader and return the response.
+func request(reloader *Reloader, method string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	reloader.ServeHTTP(w, httptest.NewRequest(method, "/admin/reload", http.NoBody))
+	return w
+}
+
+func TestReloadEndpoint(t *testing.T) {
+	var fail error
+	reloads := 0
+	reloader := New(func() error {
+		if fail != nil {
+			return fail
+		}
+		reloads++
+		return nil
+	})
+	reloader.now = func() time.Time { return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	if w := request(reloader, http.MethodGet); w.Code != http.StatusNotFound {
+		t.Errorf("Expected %d before any reload, got %d", http.StatusNotFound, w.Code)
+	}
+
+	w := request(reloader, http.MethodPost)
+	expected := "{\"time\":\"2024-01-01T00:00:00Z\",\"ok\":true}"
+	if w.Code != http.StatusOK || w.Body.String() != expected || reloads != 1 {
+		t.Errorf("Expected %d %s, got %d %s", http.StatusOK, expected, w.Code, w.Body.String())
+	}
+
+	// a failed reload is reported, and kept for later
+	fail = errors.New("invalid schema file: bad")
+	w = request(reloader, http.MethodPost)
+	expected = "{\"time\":\"2024-01-01T00:00:00Z\",\"ok\":false,\"error\":\"invalid schema file: bad\"}"
+	if w.Code != http.StatusUnprocessableEntity || w.Body.String() != expected || reloads != 1 {
+		t.Errorf("Expected %d %s, got %d %s", http.StatusUnprocessableEntity, expected, w.Code, w.Body.String())
+	}
+	w = request(reloader, http.MethodGet)
+	if w.Code != http.StatusOK || w.Body.String() != expected {
+		t.Errorf("Expected the last reload %s, got %d %s", expected, w.Code, w.Body.String())
+	}
+
+	if w = request(reloader, http.MethodDelete); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d for an unsupported method, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	reloaded := make(chan struct{}, 1)
+	reloader := New(func() error {
+		reloaded <- struct{}{}
+		return nil
+	})
+	stop := reloader.HandleSignals()
+	defer stop()
+
+	err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	if err != nil {
+		t.Fatalf("Could not send SIGHUP: %v", err)
+	}
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected SIGHUP to reload the configuration")
+	}
+}
@@ -0,0 +1,159 @@
+package schemas
+
+import (
+	"log/slog"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/patcher"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// How deep references are followed, so that recursive schemas terminate.
+const MAX_REF_DEPTH = 32
+
+// A defaultsVisitor fills in a JSON value with the defaults of a schema.
+type defaultsVisitor struct {
+	schema *jsonschema.Schema // The schema the visited value must conform to.
+}
+
+// Fill in the missing properties of a document, and of the objects and
+// arrays nested in it, with the default values declared in the schema.
+// The input document is not modified.
+func ApplyDefaults(schema *jsonschema.Schema, doc interface{}) interface{} {
+	if schema == nil {
+		return doc
+	}
+
+	result, err := patcher.Accept[interface{}](doc, &defaultsVisitor{schema})
+	if err != nil {
+		slog.Error("schemas ApplyDefaults: could not apply defaults", "error", err)
+		return doc
+	}
+	return result
+}
+
+// Collect the schema and the schemas it refers to or combines with allOf,
+// all of which the value must conform to.
+func applicable(schema *jsonschema.Schema) []*jsonschema.Schema {
+	result := make([]*jsonschema.Schema, 0)
+
+	var collect func(s *jsonschema.Schema, depth int)
+	collect = func(s *jsonschema.Schema, depth int) {
+		if s == nil || depth > MAX_REF_DEPTH {
+			return
+		}
+		result = append(result, s)
+		collect(s.Ref, depth+1)
+		for _, sub := range s.AllOf {
+			collect(sub, depth+1)
+		}
+	}
+	collect(schema, 0)
+
+	return result
+}
+
+// Find the default value of a schema, looking through references.
+func defaultOf(schema *jsonschema.Schema) interface{} {
+	for _, s := range applicable(schema) {
+		if s.Default != nil {
+			return s.Default
+		}
+	}
+	return nil
+}
+
+// Fill in missing properties of an object and recurse into present ones.
+func (v *defaultsVisitor) Map(m map[string]any) (any, error) {
+	result := make(map[string]any)
+	for key, val := range m {
+		result[key] = val
+	}
+
+	for _, s := range applicable(v.schema) {
+		for name, property := range s.Properties {
+			val, exists := result[name]
+			if !exists {
+				def := defaultOf(property)
+				if def == nil {
+					continue
+				}
+				val = copyJSON(def)
+			}
+
+			// the value may itself have properties with defaults
+			filled, err := patcher.Accept[any](val, &defaultsVisitor{property})
+			if err != nil {
+				return nil, err
+			}
+			result[name] = filled
+		}
+	}
+
+	return result, nil
+}
+
+// Recurse into the items of an array.
+func (v *defaultsVisitor) Slice(slice []any) (any, error) {
+	result := make([]any, len(slice))
+	copy(result, slice)
+
+	for _, s := range applicable(v.schema) {
+		for i := range result {
+			itemSchema := itemSchemaOf(s, i)
+			if itemSchema == nil {
+				continue
+			}
+
+			filled, err := patcher.Accept[any](result[i], &defaultsVisitor{itemSchema})
+			if err != nil {
+				return nil, err
+			}
+			result[i] = filled
+		}
+	}
+
+	return result, nil
+}
+
+// Find the schema of the item at an index of an array, if there is one.
+func itemSchemaOf(s *jsonschema.Schema, index int) *jsonschema.Schema {
+	if index < len(s.PrefixItems) {
+		return s.PrefixItems[index]
+	}
+	if s.Items2020 != nil {
+		return s.Items2020
+	}
+
+	switch items := s.Items.(type) {
+	case *jsonschema.Schema:
+		return items
+	case []*jsonschema.Schema:
+		if index < len(items) {
+			return items[index]
+		}
+		if additional, ok := s.AdditionalItems.(*jsonschema.Schema); ok {
+			return additional
+		}
+	}
+	return nil
+}
+
+// Booleans have nothing to fill in.
+func (v *defaultsVisitor) Bool(b bool) (any, error) {
+	return b, nil
+}
+
+// Numbers have nothing to fill in.
+func (v *defaultsVisitor) Number(n float64) (any, error) {
+	return n, nil
+}
+
+// Strings have nothing to fill in.
+func (v *defaultsVisitor) String(s string) (any, error) {
+	return s, nil
+}
+
+// Nulls have nothing to fill in.
+func (v *defaultsVisitor) Null() (any, error) {
+	return nil, nil
+}
@@ -0,0 +1,33 @@
+package schemas
+
+import (
+	"errors"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group70/structs"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Describe why a value did not conform to a schema as the tree of failing keywords.
+// Returns nil if the error is not a validation error.
+func DescribeError(err error) *structs.ValidationError {
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return nil
+	}
+
+	description := describe(validationErr)
+	return &description
+}
+
+// Convert a validation error and its causes.
+func describe(validationErr *jsonschema.ValidationError) structs.ValidationError {
+	description := structs.ValidationError{
+		InstanceLocation: validationErr.InstanceLocation,
+		KeywordLocation:  validationErr.KeywordLocation,
+		Message:          validationErr.Message,
+	}
+	for _, cause := range validationErr.Causes {
+		description.Causes = append(description.Causes, describe(cause))
+	}
+	return description
+}
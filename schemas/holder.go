@@ -0,0 +1,35 @@
+package schemas
+
+import (
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// A Holder holds a compiled schema and its JSON text.
+// The schema can be swapped while other goroutines are validating with it.
+type Holder struct {
+	schema *jsonschema.Schema // The compiled schema, or nil if there is none.
+	source []byte             // The JSON text the schema was compiled from.
+	mu     sync.RWMutex       // To protect access to above
+}
+
+// Create a new holder of a schema and its JSON text.
+func NewHolder(schema *jsonschema.Schema, source []byte) *Holder {
+	return &Holder{schema: schema, source: source}
+}
+
+// Get the schema and its JSON text. The schema is nil if none is held.
+func (h *Holder) Get() (*jsonschema.Schema, []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.schema, h.source
+}
+
+// Replace the schema and its JSON text. A nil schema clears the holder.
+func (h *Holder) Set(schema *jsonschema.Schema, source []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.schema = schema
+	h.source = source
+}
@@ -0,0 +1,48 @@
+// Package schemas compiles JSON schemas and fills documents in with the
+// default values their schemas declare.
+package schemas
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Compile the schema in the file at the given path.
+// Annotations such as default values are kept in the compiled schema.
+func CompileFile(path string) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.ExtractAnnotations = true
+	return compiler.Compile(path)
+}
+
+// Compile a schema from its JSON text.
+// Annotations such as default values are kept in the compiled schema.
+// The schema is given an in-memory location, as a relative name would resolve against
+// the directory the server runs in, which then shows in validation errors sent to clients.
+func Compile(raw []byte) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.ExtractAnnotations = true
+
+	err := compiler.AddResource("mem:///schema.json", bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return compiler.Compile("mem:///schema.json")
+}
+
+// Copy a JSON value so that the copy shares nothing with the original.
+func copyJSON(value interface{}) interface{} {
+	jsonValue, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+
+	var result interface{}
+	err = json.Unmarshal(jsonValue, &result)
+	if err != nil {
+		return value
+	}
+	return result
+}
@@ -0,0 +1,112 @@
+package schemas
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A schema with defaults at several levels.
+const testSchema = `{
+	"type": "object",
+	"properties": {
+		"status": {"type": "string", "default": "open"},
+		"priority": {"type": "number", "default": 3},
+		"owner": {
+			"type": "object",
+			"properties": {"active": {"type": "boolean", "default": true}}
+		},
+		"settings": {
+			"$ref": "#/$defs/settings",
+			"default": {}
+		},
+		"tasks": {
+			"type": "array",
+			"items": {
+				"type": "object",
+				"properties": {"done": {"type": "boolean", "default": false}}
+			}
+		}
+	},
+	"$defs": {
+		"settings": {
+			"type": "object",
+			"properties": {"theme": {"type": "string", "default": "light"}}
+		}
+	}
+}`
+
+// test that defaults are filled in at every level
+func TestApplyDefaults(t *testing.T) {
+	schema, err := Compile([]byte(testSchema))
+	assert.NoError(t, err)
+
+	doc := map[string]interface{}{
+		"priority": 5.0,
+		"owner":    map[string]interface{}{},
+		"tasks":    []interface{}{map[string]interface{}{}, map[string]interface{}{"done": true}},
+	}
+	filled := ApplyDefaults(schema, doc)
+
+	expected := map[string]interface{}{
+		"status":   "open",
+		"priority": 5.0,
+		"owner":    map[string]interface{}{"active": true},
+		"settings": map[string]interface{}{"theme": "light"},
+		"tasks": []interface{}{
+			map[string]interface{}{"done": false},
+			map[string]interface{}{"done": true},
+		},
+	}
+	assert.Equal(t, expected, filled)
+	assert.NoError(t, schema.Validate(filled))
+
+	// the input is left alone
+	_, exists := doc["status"]
+	assert.False(t, exists)
+	assert.Equal(t, map[string]interface{}{}, doc["owner"])
+}
+
+// test that a schema without defaults leaves documents alone
+func TestApplyNoDefaults(t *testing.T) {
+	schema, err := Compile([]byte(`true`))
+	assert.NoError(t, err)
+
+	doc := map[string]interface{}{"a": 1.0}
+	assert.Equal(t, doc, ApplyDefaults(schema, doc))
+	assert.Equal(t, doc, ApplyDefaults(nil, doc))
+}
+
+// test that validation errors are described as a tree of failing keywords
+func TestDescribeError(t *testing.T) {
+	schema, err := Compile([]byte(testSchema))
+	assert.NoError(t, err)
+
+	err = schema.Validate(map[string]interface{}{"status": 1, "owner": map[string]interface{}{"active": "yes"}})
+	description := DescribeError(err)
+	assert.NotNil(t, description)
+	assert.Len(t, description.Causes, 2)
+
+	locations := make(map[string]string)
+	for _, cause := range description.Causes {
+		for len(cause.Causes) > 0 {
+			cause = cause.Causes[0]
+		}
+		locations[cause.InstanceLocation] = cause.KeywordLocation
+	}
+	assert.Equal(t, "/properties/status/type", locations["/status"])
+	assert.Equal(t, "/properties/owner/properties/active/type", locations["/owner/active"])
+
+	assert.Nil(t, DescribeError(nil))
+	assert.Nil(t, DescribeError(assert.AnError))
+}
+
+// test that validation errors of schemas compiled from text do not name server files
+func TestCompileLocation(t *testing.T) {
+	schema, err := Compile([]byte(`{"required":["a"]}`))
+	assert.NoError(t, err)
+
+	err = schema.Validate(map[string]interface{}{})
+	assert.ErrorContains(t, err, "mem:///schema.json#/required")
+	assert.NotContains(t, err.Error(), "file://")
+}
@@ -236,6 +236,12 @@ func (s *SkipList[K, V]) Upsert(key K, check UpdateCheck[K, V]) (updated bool, e
 
 // remove a key value pair from the skip list
 func (s *SkipList[K, V]) Remove(key K) (V, bool) {
+	return s.RemoveIf(key, nil)
+}
+
+// remove a key value pair from the skip list, if the check approves of the value
+// stored under the key; a nil check approves of any value
+func (s *SkipList[K, V]) RemoveIf(key K, check func(value V) bool) (V, bool) {
 	slog.Debug("Delete: deleting key", "key", key) // log the delete
 
 	isMarked := false
@@ -287,6 +293,13 @@ func (s *SkipList[K, V]) Remove(key K) (V, bool) {
 				return nothing, false
 			}
 
+			if check != nil && !check(victim.value) {
+				slog.Info("skiplist Remove: victim holds another value")
+				// the value changed since the caller looked
+				victim.Unlock()
+				return nothing, false
+			}
+
 			victim.marked.Store(true)
 			isMarked = true
 		}
@@ -402,10 +415,11 @@ func (s *SkipList[K, V]) Query(context context.Context, start K, end K) (results
 			return results, nil
 		}
 
-		// if deadline is reached, return the results
+		// if deadline is reached, give up; otherwise try again
 		select {
 		case <-context.Done():
 			return nil, context.Err()
+		default:
 		}
 	}
 }
@@ -1,11 +1,13 @@
 package skiplist
 
 import (
+	"context"
 	"errors"
 	"log/slog"
 	"os"
 	"sync"
 	"testing"
+	"time"
 )
 
 func checkFactory(i int) UpdateCheck[int, int] {
@@ -350,3 +352,69 @@ func TestConcurrentRepeatedRemoves(t *testing.T) {
 		}
 	}
 }
+
+// test that queries racing with writes try again rather than wait for their deadline
+func TestQueryRetries(t *testing.T) {
+	list := New[int, int](0, 100000, 10)
+	put := func(key int, value int, exists bool) (int, error) {
+		return key, nil
+	}
+
+	// long enough that writes land in the middle of queries
+	for i := 1; i < 5000; i++ {
+		list.Upsert(i*10, put)
+	}
+
+	// keep writing until the queries are done
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			list.Upsert(5, put)
+			list.Remove(5)
+		}
+	}()
+
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_, err := list.Query(context.Background(), 1, 99999)
+			if err != nil {
+				t.Errorf("expected no error. got %v", err)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("query did not return")
+	}
+	wg.Wait()
+}
+
+// test that a conditional remove leaves values the check does not approve of
+func TestRemoveIf(t *testing.T) {
+	list := New[int, int](0, 10, 3)
+	list.Upsert(1, checkFactory(1))
+
+	_, ok := list.RemoveIf(1, func(value int) bool { return value == 2 })
+	if ok {
+		t.Fatalf("expected false. got %t", ok)
+	}
+	if _, found := list.Find(1); !found {
+		t.Fatalf("expected the key to remain")
+	}
+
+	value, ok := list.RemoveIf(1, func(value int) bool { return value == 1 })
+	if !ok || value != 1 {
+		t.Fatalf("expected 1, true. got %d, %t", value, ok)
+	}
+}
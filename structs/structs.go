@@ -1,8 +1,12 @@
 package structs
 
+import "encoding/json"
+
 // A PutOutput stores the response to a put request.
 type PutOutput struct {
-	Uri string `json:"uri"` // The URI of the successful put operation.
+	Uri             string      `json:"uri"`                       // The URI of the successful put operation.
+	Document        interface{} `json:"document,omitempty"`        // The stored document, if the client asked for it.
+	ChildrenDropped bool        `json:"childrenDropped,omitempty"` // Whether an overwrite deleted the document's collections.
 }
 
 // A CollSub is a wrapper for a subscriber to a collection.
@@ -11,3 +15,66 @@ type CollSub struct {
 	IntervalStart string // The start of the interval for this subscribers query.
 	IntervalEnd   string // The end of the interval for this subscribers query.
 }
+
+// A BulkOutput stores the response to a bulk insert.
+type BulkOutput struct {
+	Aborted bool         `json:"aborted"` // Whether the batch was aborted without inserting anything.
+	Results []BulkResult `json:"results"` // The outcome of each line of the batch.
+}
+
+// A BulkResult stores the outcome of one line of a bulk insert.
+type BulkResult struct {
+	Line       int              `json:"line"`                 // The line of the request body, starting at 1.
+	Uri        string           `json:"uri,omitempty"`        // The URI of the created document.
+	Error      string           `json:"error,omitempty"`      // Why the line was not inserted.
+	Validation *ValidationError `json:"validation,omitempty"` // The failing schema keywords, if the document did not conform.
+}
+
+// A SchemaOutput stores the response to a request for the schema of a resource.
+type SchemaOutput struct {
+	Uri    string          `json:"uri"`    // The URI of the resource.
+	Source string          `json:"source"` // The URI of the database or collection defining the schema, or "global".
+	Schema json.RawMessage `json:"schema"` // The schema itself.
+}
+
+// A SchemaReport stores the result of checking the documents of a database or collection against a new schema.
+type SchemaReport struct {
+	Uri      string          `json:"uri"`      // The URI of the database or collection.
+	Checked  int             `json:"checked"`  // The number of documents checked.
+	Applied  bool            `json:"applied"`  // Whether the schema and migration were applied.
+	Failures []SchemaFailure `json:"failures"` // The documents that would not conform.
+}
+
+// A SchemaFailure stores why a document does not conform to a new schema.
+type SchemaFailure struct {
+	Path       string           `json:"path"`                 // The URI of the document.
+	Error      string           `json:"error"`                // Why the document does not conform.
+	Validation *ValidationError `json:"validation,omitempty"` // The failing schema keywords, if any.
+}
+
+// A ValidationError stores why a JSON value does not conform to a schema.
+type ValidationError struct {
+	InstanceLocation string            `json:"instanceLocation"` // A JSON pointer to the failing value in the document.
+	KeywordLocation  string            `json:"keywordLocation"`  // A JSON pointer to the failing keyword in the schema.
+	Message          string            `json:"message"`          // Why the keyword failed.
+	Causes           []ValidationError `json:"causes,omitempty"` // The failures of nested keywords.
+}
+
+// A ValidationOutput stores the response to a write of a document that does not conform to the schema.
+type ValidationOutput struct {
+	Message    string           `json:"message"`    // A message saying what failed.
+	Validation *ValidationError `json:"validation"` // The failing schema keywords.
+}
+
+// An OwnershipOutput stores the response to a request for the ownership policy of a resource.
+type OwnershipOutput struct {
+	Uri    string `json:"uri"`    // The URI of the resource.
+	Source string `json:"source"` // The URI of the database or collection defining the policy, if any.
+	Policy string `json:"policy"` // The ownership policy.
+}
+
+// A CollaboratorsOutput stores the response to a request for the collaborators of a document.
+type CollaboratorsOutput struct {
+	Uri           string   `json:"uri"`           // The URI of the document.
+	Collaborators []string `json:"collaborators"` // The users besides the creator who may change the document.
+}
@@ -0,0 +1,258 @@
+package subscribe
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+)
+
+// How many recent events each manager keeps for subscribers that reconnect
+const EVENT_HISTORY = 1024
+
+// The type of the event telling a subscriber that the events it missed are gone,
+// so it must fetch the resource again
+const EVENT_RESET = "reset"
+
+// The types of the events telling a subscriber with a filter that a document
+// started or stopped matching it
+const (
+	EVENT_ENTER = "enter"
+	EVENT_LEAVE = "leave"
+)
+
+// An Event is a message sent to subscribers, numbered in the order its manager sent it.
+type Event struct {
+	ID   uint64 // The sequence number of the event, from 1, or that of the last event for a snapshot
+	Type string // The SSE event type, such as "update" or "delete"
+	Data []byte // The message
+
+	key  string // The key of the document the event is about
+	doc  any    // The document the event is about, if known, for the subscribers' filters
+	all  bool   // Whether every subscriber hears about the event, whatever its interval
+	tree bool   // Whether the event is for recursive subscribers, carrying the full path of what changed
+}
+
+// A stream numbers events and keeps the recent ones. Recursive subscribers have a
+// stream of their own, so that the events of the others are numbered without gaps.
+// Events are only kept once anyone has subscribed to the stream, as every resource
+// has streams and most are never subscribed to.
+type stream struct {
+	seq     uint64      // The sequence number of the last event
+	history ring        // The recent events, for subscribers that reconnect
+	watched atomic.Bool // Whether anyone has subscribed to the stream, read without the lock
+}
+
+// A ring holds the most recent events, oldest first.
+type ring struct {
+	events []Event // The events, growing up to EVENT_HISTORY before wrapping
+	start  int     // The index of the oldest event, once full
+}
+
+// Add an event, dropping the oldest if full.
+func (r *ring) push(event Event) {
+	if len(r.events) < EVENT_HISTORY {
+		r.events = append(r.events, event)
+		return
+	}
+	r.events[r.start] = event
+	r.start = (r.start + 1) % len(r.events)
+}
+
+// List the events with sequence numbers after id, oldest first.
+func (r *ring) after(id uint64) []Event {
+	events := make([]Event, 0)
+	for i := range r.events {
+		event := r.events[(r.start+i)%len(r.events)]
+		if event.ID > id {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Check whether a subscriber should hear about an event.
+func (s *Subscriber) wants(event Event) bool {
+	if event.tree != s.Recursive {
+		return false
+	}
+	if event.all {
+		return true
+	}
+	return s.Covers(event.key) && (s.Keep == nil || (event.doc != nil && s.Keep(event.doc)))
+}
+
+// Filter the subscriber's events to the documents match returns true for, starting from the
+// keys of the documents that match now. Documents that start or stop matching are sent as
+// enter or leave events, and changes to documents that match neither before nor after are not sent.
+// A subscriber with a filter that resumes after missed events is sent a reset instead, as which
+// documents matched when it left is not known.
+func (s *Subscriber) Filter(match func(doc any) bool, matching []string) {
+	s.Match = match
+	s.matched = make(map[string]bool, len(matching))
+	for _, key := range matching {
+		s.matched[key] = true
+	}
+}
+
+// Rewrite an event for a subscriber with a filter, tracking which documents match it.
+// Returns false if the subscriber should not hear about the event.
+func (s *Subscriber) view(event Event) (Event, bool) {
+	if s.Match == nil || event.all {
+		return event, true
+	}
+
+	was := s.matched[event.key]
+	if event.doc == nil {
+		// a change below the document, which is seen if the document is
+		return event, was
+	}
+	if event.Type == "delete" {
+		delete(s.matched, event.key)
+		return event, was
+	}
+
+	now := s.Match(event.doc)
+	switch {
+	case was && now:
+		return event, true
+	case now:
+		s.matched[event.key] = true
+		return retype(event, EVENT_ENTER), true
+	case was:
+		delete(s.matched, event.key)
+		return retype(event, EVENT_LEAVE), true
+	default:
+		return event, false
+	}
+}
+
+// Change the action of an event and of its message.
+func retype(event Event, action string) Event {
+	var message map[string]interface{}
+	err := json.Unmarshal(event.Data, &message)
+	if err == nil {
+		message["action"] = action
+		data, err := json.Marshal(message)
+		if err == nil {
+			event.Data = data
+		}
+	}
+	event.Type = action
+	return event
+}
+
+// A delivery is an event as one subscriber is to be sent it.
+type delivery struct {
+	subscriber *Subscriber
+	event      Event
+}
+
+// Number and keep an event, and send it to the subscribers that want it. The subscribers
+// are sent the event once the manager is unlocked, so that a slow one does not hold up
+// others using the manager, but in the order the events were numbered.
+func (m *SubscriberManager) publish(event Event) {
+	m.mu.Lock()
+	stream := m.streamFor(event.tree)
+	stream.seq++
+	event.ID = stream.seq
+	event.Type = determineEventType(event.Data)
+	if stream.watched.Load() {
+		stream.history.push(event)
+	}
+
+	deliveries := make([]delivery, 0)
+	for _, s := range m.subscribers {
+		if !s.wants(event) {
+			continue
+		}
+		if seen, ok := s.view(event); ok {
+			deliveries = append(deliveries, delivery{s, seen})
+		}
+	}
+
+	// start sending before unlocking, so that the next event waits for this one
+	m.sending.Lock()
+	m.mu.Unlock()
+	defer m.sending.Unlock()
+
+	for _, d := range deliveries {
+		slog.Info("Notifying subscriber", "SubscriberID", d.subscriber.ID, "EventID", d.event.ID)
+		d.subscriber.SendUpdate(d.event)
+	}
+}
+
+// Add a subscriber to the manager, first queueing for it the events after the
+// given "Last-Event-ID", if any, that it missed. If those events are no longer
+// kept, or the subscriber has a filter and missed any, it is sent a reset event
+// instead. Returns whether the missed events were replayed, which is false if no ID was given.
+func (m *SubscriberManager) Resume(s *Subscriber, lastEventID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer slog.Info("subscribe Resume: Subscriber added", "ID", s.ID, "lastEventID", lastEventID)
+
+	stream := m.streamFor(s.Recursive)
+	stream.watched.Store(true)
+	if lastEventID == "" {
+		m.subscribers[s.ID] = s
+		return false
+	}
+
+	// the missed events are kept if the event after the last one seen is
+	id, err := strconv.ParseUint(lastEventID, 10, 64)
+	oldest := stream.seq - uint64(len(stream.history.events)) + 1
+	filtered := s.Match != nil && id < stream.seq
+	if err != nil || id > stream.seq || id+1 < oldest || filtered {
+		slog.Info("subscribe Resume: missed events cannot be replayed", "ID", s.ID, "lastEventID", lastEventID, "oldest", oldest, "filtered", filtered)
+		data, _ := json.Marshal(map[string]interface{}{"action": EVENT_RESET})
+		s.SendUpdate(Event{ID: stream.seq, Type: EVENT_RESET, Data: data})
+		m.subscribers[s.ID] = s
+		return false
+	}
+
+	missed := make([]Event, 0)
+	for _, event := range stream.history.after(id) {
+		if !s.wants(event) {
+			continue
+		}
+		if seen, ok := s.view(event); ok {
+			missed = append(missed, seen)
+		}
+	}
+
+	// make room for the missed events, as the subscriber is not yet reading them
+	if len(missed) > cap(s.Updates)-len(s.Updates) {
+		updates := make(chan Event, len(s.Updates)+len(missed)+SUBSCRIBER_BUFFER)
+		for len(s.Updates) > 0 {
+			updates <- <-s.Updates
+		}
+		s.Updates = updates
+	}
+	for _, event := range missed {
+		s.SendUpdate(event)
+	}
+	m.subscribers[s.ID] = s
+	return true
+}
+
+// The sequence number of the last event sent, 0 if none.
+func (m *SubscriberManager) LastEventID() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.events.seq
+}
+
+// The sequence number of the last event of the kind the subscriber hears about, 0 if none.
+func (m *SubscriberManager) LastEventIDFor(s *Subscriber) uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.streamFor(s.Recursive).seq
+}
+
+// The stream of the events for recursive subscribers, or for the others. The caller must hold the lock.
+func (m *SubscriberManager) streamFor(recursive bool) *stream {
+	if recursive {
+		return &m.treeEvents
+	}
+	return &m.events
+}
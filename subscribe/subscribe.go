@@ -10,21 +10,32 @@ import (
 	"time"
 )
 
+// How many events may wait to be written to a subscriber
+const SUBSCRIBER_BUFFER = 100
+
 type Subscriber struct {
-	ID            string              //The identifier for the sub
-	Updates       chan []byte         //Channel for updates sent to sub
-	IntervalStart string              //Interval start
-	IntervalEnd   string              //Interval end
-	Conn          http.ResponseWriter //http response writer
-	Flusher       http.Flusher        //For streaming
-	CloseNotify   <-chan struct{}     //To know when client closed
-	Closed        bool                //Tells us if its closed or not
-	mu            sync.Mutex          //To protect access to above
+	ID            string             //The identifier for the sub
+	Updates       chan Event         //Channel for updates sent to sub
+	IntervalStart string             //Interval start
+	IntervalEnd   string             //Interval end
+	Sink          Sink               //Writes the updates to the client
+	CloseNotify   <-chan struct{}    //To know when client closed
+	Closed        bool               //Tells us if its closed or not
+	Keep          func(doc any) bool //Whether the sub may hear about a document, every document if nil
+	Recursive     bool               //Whether the sub hears about everything below the resource, with full paths
+	Match         func(doc any) bool //Whether a document is in the sub's view, every document if nil
+	matched       map[string]bool    //The keys of the documents in the sub's view, with a Match
+	mu            sync.Mutex         //To protect access to above
 }
 
 type SubscriberManager struct {
 	subscribers map[string]*Subscriber // Map of subscribers
+	events      stream                 // The events for the subscribers of the resource itself
+	treeEvents  stream                 // The events for recursive subscribers
+	parent      *SubscriberManager     // The manager of the resource holding this one, if any
+	name        string                 // The segment this resource adds to the path of its parent
 	mu          sync.RWMutex           // To protect access to above
+	sending     sync.Mutex             // Held while sending an event, so that events are sent in order
 }
 
 // Create a new subscriber
@@ -41,18 +52,20 @@ func NewSubscriber(w http.ResponseWriter, r *http.Request, intervalStart, interv
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	s := &Subscriber{
+	return NewSinkSubscriber(sseSink{w, flusher}, r.Context().Done(), intervalStart, intervalEnd), nil
+}
+
+// Create a new subscriber writing its updates to the given sink, until done is closed
+func NewSinkSubscriber(sink Sink, done <-chan struct{}, intervalStart, intervalEnd string) *Subscriber {
+	return &Subscriber{
 		ID:            generateUniqueID(),
-		Updates:       make(chan []byte, 100),
+		Updates:       make(chan Event, SUBSCRIBER_BUFFER),
 		IntervalStart: intervalStart,
 		IntervalEnd:   intervalEnd,
-		Conn:          w,
-		Flusher:       flusher,
-		CloseNotify:   r.Context().Done(),
+		Sink:          sink,
+		CloseNotify:   done,
 		Closed:        false,
 	}
-
-	return s, nil
 }
 
 // Start the subscriber
@@ -94,14 +107,13 @@ func (s *Subscriber) sendComment(comment string) {
 		return
 	}
 
-	_, err := fmt.Fprintf(s.Conn, "%s\n\n", comment)
+	err := s.Sink.WriteComment(comment)
 	if err != nil {
 		// If there was an error sending the comment, log the error and close the subscriber
 		slog.Error("subscribe sendComment: Error sending comment to subscriber", "ID", s.ID, "error", err)
-		s.Close()
+		s.close()
 		return
 	}
-	s.Flusher.Flush()
 }
 
 // func (s *Subscriber) writeComment(comment string) {
@@ -121,8 +133,9 @@ func (s *Subscriber) sendComment(comment string) {
 // 	s.Flusher.Flush()
 // }
 
-// Writing updates to the subscriber's connection
-func (s *Subscriber) send(update []byte) {
+// Writing updates to the subscriber's connection, numbered so that the
+// client can resume after them with "Last-Event-ID"
+func (s *Subscriber) send(event Event) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -131,36 +144,50 @@ func (s *Subscriber) send(update []byte) {
 		return
 	}
 
-	eventID := time.Now().UnixNano() / int64(time.Millisecond)
-	eventType := determineEventType(update)
-
-	_, err := fmt.Fprintf(s.Conn, "id: %d\n", eventID)
+	err := s.Sink.WriteEvent(event)
 	if err != nil {
-		// If there was an error sending the event ID, log the error and close the subscriber
-		slog.Error("Error sending event ID to subscriber", "ID", s.ID, "error", err)
-		s.Close()
+		// If there was an error sending the event, log the error and close the subscriber
+		slog.Error("Error sending event to subscriber", "ID", s.ID, "error", err)
+		s.close()
 		return
 	}
 
-	_, err = fmt.Fprintf(s.Conn, "event: %s\n", eventType)
+	slog.Debug("Event sent successfully", "SubscriberID", s.ID, "EventID", event.ID)
+}
+
+// A Sink writes the updates of a subscriber to its client
+type Sink interface {
+	// Write an event.
+	WriteEvent(event Event) error
+
+	// Write a comment keeping the connection alive, if the transport needs one.
+	WriteComment(comment string) error
+}
+
+// An sseSink writes server-sent events to a streamed response
+type sseSink struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// Write an event, all at once so that a client never sees part of one.
+func (s sseSink) WriteEvent(event Event) error {
+	_, err := fmt.Fprintf(s.w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
 	if err != nil {
-		// If there was an error sending the event type, log the error and close the subscriber
-		slog.Error("Error sending event type to subscriber", "ID", s.ID, "error", err)
-		s.Close()
-		return
+		return err
 	}
+	s.flusher.Flush()
+	return nil
+}
 
-	_, err = fmt.Fprintf(s.Conn, "data: %s\n\n", update)
+// Write a comment, which clients ignore.
+func (s sseSink) WriteComment(comment string) error {
+	_, err := fmt.Fprintf(s.w, "%s\n\n", comment)
 	if err != nil {
-		// If there was an error sending the data, log the error and close the subscriber
-		slog.Error("Error sending data to subscriber", "ID", s.ID, "error", err)
-		s.Close()
-		return
+		return err
 	}
-
-	s.Flusher.Flush()
-	slog.Debug("Event sent successfully", "SubscriberID", s.ID)
-
+	s.flusher.Flush()
+	return nil
 }
 
 // To determine the event type of the update
@@ -181,7 +208,11 @@ func determineEventType(update []byte) string {
 func (s *Subscriber) Close() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.close()
+}
 
+// Close the subscriber. The caller must hold the lock.
+func (s *Subscriber) close() {
 	if s.Closed {
 		return
 	}
@@ -192,7 +223,7 @@ func (s *Subscriber) Close() {
 }
 
 // Send an update to the subscriber
-func (s *Subscriber) SendUpdate(msg []byte) {
+func (s *Subscriber) SendUpdate(event Event) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -202,11 +233,11 @@ func (s *Subscriber) SendUpdate(msg []byte) {
 	}
 
 	select {
-	case s.Updates <- msg:
+	case s.Updates <- event:
 	case <-time.After(5 * time.Second):
 		// 5 seconds timeout for sending update
 		slog.Info("subscribe SendUpdate: Subscriber send update timeout", "ID", s.ID)
-		s.Close()
+		s.close()
 	}
 }
 
@@ -224,10 +255,14 @@ func NewSubscriberManager() *SubscriberManager {
 
 // Add a subscriber to the manager
 func (m *SubscriberManager) AddSubscriber(s *Subscriber) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.subscribers[s.ID] = s
-	slog.Info("subscribe AddSubscriber: Subscriber added", "ID", s.ID)
+	m.Resume(s, "")
+}
+
+// Count the subscribers of the manager
+func (m *SubscriberManager) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.subscribers)
 }
 
 // Remove a subscriber from the manager
@@ -238,30 +273,31 @@ func (m *SubscriberManager) RemoveSubscriber(s *Subscriber) {
 	slog.Info("subscribe RemoveSubscriber: Subscriber removed", "ID", s.ID)
 }
 
-// Notify subscribers of update messages
-func (m *SubscriberManager) NotifySubscribersUpdate(msg []byte, intervalComp string) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	for _, s := range m.subscribers {
-		// check if the subscriber's interval is within the interval of the message
-		if s.IntervalStart <= intervalComp && s.IntervalEnd >= intervalComp {
-			slog.Info("Notifying subscriber update", "SubscriberID", s.ID, "IntervalComp", intervalComp)
-			s.SendUpdate(msg)
-		}
-	}
+// Check whether the key of a document falls in the subscriber's interval, ends included,
+// as in a GET of the collection with the same interval.
+func (s *Subscriber) Covers(key string) bool {
+	return s.IntervalStart <= key && key <= s.IntervalEnd
 }
 
-// Notify subscribers of delete messages
-func (m *SubscriberManager) NotifySubscribersDelete(msg string, intervalComp string) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	for _, s := range m.subscribers {
-		// check if the subscriber's interval is within the interval of the message
-		if s.IntervalStart <= intervalComp && s.IntervalEnd >= intervalComp {
-			slog.Info("Notifying subscriber deletion", "SubscriberID", s.ID, "IntervalComp", intervalComp)
-			s.SendUpdate([]byte(msg))
-		}
-	}
+// Notify subscribers of update messages about the document with the given key
+func (m *SubscriberManager) NotifySubscribersUpdate(msg []byte, key string) {
+	m.NotifyDocument(msg, key, nil)
+}
+
+// Notify subscribers of delete messages about the document with the given key
+func (m *SubscriberManager) NotifySubscribersDelete(msg string, key string) {
+	m.NotifyDocument([]byte(msg), key, nil)
+}
+
+// Notify the subscribers whose interval holds the key of a document of a message about it.
+// Subscribers that may not see the document are skipped; without a document, none are.
+func (m *SubscriberManager) NotifyDocument(msg []byte, key string, doc any) {
+	m.publish(Event{Data: msg, key: key, doc: doc})
+}
+
+// Notify every subscriber, whatever its interval
+func (m *SubscriberManager) NotifyAll(msg []byte) {
+	m.publish(Event{Data: msg, all: true})
 }
 
 // Cleanup the subscribers
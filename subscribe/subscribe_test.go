@@ -58,7 +58,7 @@ func TestSubscriberSendUpdate(t *testing.T) {
 	}()
 
 	updateMsg := []byte(`{"message":"test update"}`)
-	subscriber.SendUpdate(updateMsg)
+	subscriber.SendUpdate(Event{ID: 1, Type: "message", Data: updateMsg})
 
 	buffer := make([]byte, 1024)
 	n, err := pr.Read(buffer)
@@ -67,7 +67,7 @@ func TestSubscriberSendUpdate(t *testing.T) {
 	}
 
 	output := string(buffer[:n])
-	expectedOutput := "data: {\"message\":\"test update\"}\n\n"
+	expectedOutput := "id: 1\nevent: message\ndata: {\"message\":\"test update\"}\n\n"
 
 	if output != expectedOutput {
 		t.Errorf("Expected output %q, got %q", expectedOutput, output)
@@ -87,7 +87,7 @@ func TestSubscriberManager(t *testing.T) {
 		ID:            "sub1",
 		IntervalStart: "a",
 		IntervalEnd:   "m",
-		Updates:       make(chan []byte, 10),
+		Updates:       make(chan Event, 10),
 		Closed:        false,
 		mu:            sync.Mutex{},
 	}
@@ -96,7 +96,7 @@ func TestSubscriberManager(t *testing.T) {
 		ID:            "sub2",
 		IntervalStart: "n",
 		IntervalEnd:   "z",
-		Updates:       make(chan []byte, 10),
+		Updates:       make(chan Event, 10),
 		Closed:        false,
 		mu:            sync.Mutex{},
 	}
@@ -110,8 +110,8 @@ func TestSubscriberManager(t *testing.T) {
 
 	select {
 	case msg := <-sub1.Updates:
-		if !bytes.Equal(msg, updateMsg) {
-			t.Errorf("sub1 got incorrect update: %s", msg)
+		if !bytes.Equal(msg.Data, updateMsg) {
+			t.Errorf("sub1 got incorrect update: %s", msg.Data)
 		}
 	case <-time.After(time.Second):
 		t.Error("sub1 didnt receive update")
@@ -119,7 +119,7 @@ func TestSubscriberManager(t *testing.T) {
 
 	select {
 	case msg := <-sub2.Updates:
-		t.Errorf("sub2 got but shouldn't have gotten update: %s", msg)
+		t.Errorf("sub2 got but shouldn't have gotten update: %s", msg.Data)
 	case <-time.After(100 * time.Millisecond):
 	}
 
@@ -129,8 +129,8 @@ func TestSubscriberManager(t *testing.T) {
 
 	select {
 	case msg := <-sub2.Updates:
-		if !bytes.Equal(msg, updateMsg2) {
-			t.Errorf("sub2 received incorrect update: %s", msg)
+		if !bytes.Equal(msg.Data, updateMsg2) {
+			t.Errorf("sub2 received incorrect update: %s", msg.Data)
 		}
 	case <-time.After(time.Second):
 		t.Error("sub2 didn't receive update")
@@ -138,7 +138,7 @@ func TestSubscriberManager(t *testing.T) {
 
 	select {
 	case msg := <-sub1.Updates:
-		t.Errorf("sub1 should not have received update after removal, but got: %s", msg)
+		t.Errorf("sub1 should not have received update after removal, but got: %s", msg.Data)
 	case <-time.After(100 * time.Millisecond):
 	}
 }
@@ -160,3 +160,232 @@ func (rw *responseWriterWithFlusher) Flush() {
 type testFlusher struct{}
 
 func (f *testFlusher) Flush() {}
+
+// TestNotifyDocument tests that documents are matched by key, ends included, and by the subscriber's filter
+func TestNotifyDocument(t *testing.T) {
+	manager := NewSubscriberManager()
+	all := &Subscriber{ID: "all", IntervalStart: "b", IntervalEnd: "d", Updates: make(chan Event, 10)}
+	owned := &Subscriber{ID: "owned", IntervalStart: "b", IntervalEnd: "d", Updates: make(chan Event, 10),
+		Keep: func(doc any) bool { return doc == "mine" }}
+	manager.AddSubscriber(all)
+	manager.AddSubscriber(owned)
+
+	for _, key := range []string{"a", "b", "c", "d", "da", "e"} {
+		manager.NotifyDocument([]byte(key), key, "theirs")
+	}
+	manager.NotifyDocument([]byte("c mine"), "c", "mine")
+	manager.NotifySubscribersUpdate([]byte("c unknown"), "c")
+
+	expected := map[*Subscriber][]string{
+		all:   {"b", "c", "d", "c mine", "c unknown"},
+		owned: {"c mine"},
+	}
+	for s, messages := range expected {
+		for _, message := range messages {
+			select {
+			case msg := <-s.Updates:
+				if string(msg.Data) != message {
+					t.Errorf("%s expected %s got %s", s.ID, message, msg.Data)
+				}
+			default:
+				t.Errorf("%s expected %s got nothing", s.ID, message)
+			}
+		}
+		select {
+		case msg := <-s.Updates:
+			t.Errorf("%s got unexpected update %s", s.ID, msg.Data)
+		default:
+		}
+	}
+}
+
+// Subscribe to a manager and leave again, so that it keeps its events.
+func watch(manager *SubscriberManager) {
+	first := &Subscriber{ID: "first", Updates: make(chan Event, 10)}
+	manager.AddSubscriber(first)
+	manager.RemoveSubscriber(first)
+}
+
+// Read the events queued for a subscriber.
+func queued(s *Subscriber) []Event {
+	events := make([]Event, 0)
+	for len(s.Updates) > 0 {
+		events = append(events, <-s.Updates)
+	}
+	return events
+}
+
+// TestResume tests that reconnecting subscribers are sent the events they missed, or a reset
+func TestResume(t *testing.T) {
+	manager := NewSubscriberManager()
+	watch(manager)
+	manager.NotifyDocument([]byte(`{"action":"create"}`), "a", nil)
+	manager.NotifyDocument([]byte(`{"action":"update"}`), "z", nil)
+	manager.NotifyAll([]byte(`{"action":"delete"}`))
+	if manager.LastEventID() != 3 {
+		t.Errorf("Expected last event ID 3, got %d", manager.LastEventID())
+	}
+
+	// only the missed events in the interval are replayed
+	sub := &Subscriber{ID: "sub", IntervalStart: "a", IntervalEnd: "m", Updates: make(chan Event, 10)}
+	if !manager.Resume(sub, "0") {
+		t.Errorf("Expected the missed events to be replayed")
+	}
+	events := queued(sub)
+	if len(events) != 2 || events[0].ID != 1 || events[0].Type != "create" || events[1].ID != 3 || events[1].Type != "delete" {
+		t.Errorf("Expected events 1 and 3, got %v", events)
+	}
+
+	// a subscriber that saw everything gets nothing
+	caughtUp := &Subscriber{ID: "caughtUp", IntervalStart: "a", IntervalEnd: "z", Updates: make(chan Event, 10)}
+	if !manager.Resume(caughtUp, "3") || len(queued(caughtUp)) != 0 {
+		t.Errorf("Expected nothing to replay after the last event")
+	}
+
+	// IDs that are unknown or malformed get a reset
+	for _, lastEventID := range []string{"4", "abc"} {
+		reset := &Subscriber{ID: "reset" + lastEventID, IntervalStart: "a", IntervalEnd: "z", Updates: make(chan Event, 10)}
+		if manager.Resume(reset, lastEventID) {
+			t.Errorf("Expected %s not to be resumable", lastEventID)
+		}
+		events = queued(reset)
+		if len(events) != 1 || events[0].Type != EVENT_RESET || events[0].ID != 3 {
+			t.Errorf("Expected a reset event for %s, got %v", lastEventID, events)
+		}
+	}
+
+	// subscribers with a filter cannot tell which documents matched when they left
+	filtered := &Subscriber{ID: "filtered", IntervalStart: "a", IntervalEnd: "z", Updates: make(chan Event, 10)}
+	filtered.Filter(func(doc any) bool { return true }, nil)
+	if manager.Resume(filtered, "1") {
+		t.Errorf("Expected a filtered subscriber not to be resumable")
+	}
+	if events = queued(filtered); len(events) != 1 || events[0].Type != EVENT_RESET {
+		t.Errorf("Expected a reset event for a filtered subscriber, got %v", events)
+	}
+	filteredCaughtUp := &Subscriber{ID: "filteredCaughtUp", IntervalStart: "a", IntervalEnd: "z", Updates: make(chan Event, 10)}
+	filteredCaughtUp.Filter(func(doc any) bool { return true }, nil)
+	if !manager.Resume(filteredCaughtUp, "3") || len(queued(filteredCaughtUp)) != 0 {
+		t.Errorf("Expected a filtered subscriber that missed nothing to resume")
+	}
+}
+
+// TestResumeAgedOut tests that events older than the history are not replayed
+func TestResumeAgedOut(t *testing.T) {
+	manager := NewSubscriberManager()
+	watch(manager)
+	for i := 0; i < EVENT_HISTORY+10; i++ {
+		manager.NotifyAll([]byte(`{"action":"update"}`))
+	}
+
+	aged := &Subscriber{ID: "aged", Updates: make(chan Event, 10)}
+	if manager.Resume(aged, "9") {
+		t.Errorf("Expected events that aged out not to be replayed")
+	}
+	if events := queued(aged); len(events) != 1 || events[0].Type != EVENT_RESET {
+		t.Errorf("Expected a reset event, got %d events", len(events))
+	}
+
+	// the oldest kept events can still be replayed, however many there are
+	oldest := &Subscriber{ID: "oldest", Updates: make(chan Event, 10)}
+	if !manager.Resume(oldest, "10") {
+		t.Errorf("Expected the kept events to be replayed")
+	}
+	events := queued(oldest)
+	if len(events) != EVENT_HISTORY || events[0].ID != 11 || events[len(events)-1].ID != EVENT_HISTORY+10 {
+		t.Errorf("Expected events 11 to %d, got %d events", EVENT_HISTORY+10, len(events))
+	}
+}
+
+// TestHistoryOnceWatched tests that events are only kept once anyone has subscribed
+func TestHistoryOnceWatched(t *testing.T) {
+	manager := NewSubscriberManager()
+	manager.NotifyAll([]byte(`{"action":"update"}`))
+	if len(manager.events.history.events) != 0 {
+		t.Errorf("Expected no events kept without subscribers, got %d", len(manager.events.history.events))
+	}
+
+	watch(manager)
+	manager.NotifyAll([]byte(`{"action":"update"}`))
+	late := &Subscriber{ID: "late", Updates: make(chan Event, 10)}
+	if manager.Resume(late, "0") {
+		t.Errorf("Expected events from before anyone subscribed not to be replayed")
+	}
+	resumed := &Subscriber{ID: "resumed", Updates: make(chan Event, 10)}
+	if !manager.Resume(resumed, "1") || len(queued(resumed)) != 1 {
+		t.Errorf("Expected the event after subscribing to be replayed")
+	}
+}
+
+// TestPublishUnlocked tests that a stalled subscriber does not hold the manager while it is sent an event
+func TestPublishUnlocked(t *testing.T) {
+	manager := NewSubscriberManager()
+	stalled := &Subscriber{ID: "stalled", Updates: make(chan Event)}
+	manager.AddSubscriber(stalled)
+	go manager.NotifyAll([]byte(`{"action":"update"}`))
+	time.Sleep(10 * time.Millisecond)
+
+	added := make(chan struct{})
+	go func() {
+		manager.AddSubscriber(&Subscriber{ID: "other", Updates: make(chan Event, 10)})
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Errorf("Expected to subscribe while a subscriber is stalled")
+	}
+}
+
+// TestNotifyTree tests that changes below a resource reach its recursive subscribers, with full paths
+func TestNotifyTree(t *testing.T) {
+	db := NewSubscriberManager()
+	doc := NewSubscriberManager()
+	coll := NewSubscriberManager()
+	nested := NewSubscriberManager()
+	db.Attach(nil, "/v1/db/")
+	doc.Attach(db, "doc")
+	coll.Attach(doc, "/coll/")
+	nested.Attach(coll, "nested")
+	if nested.Path() != "/v1/db/doc/coll/nested" {
+		t.Errorf("Expected the full path of the nested document, got %s", nested.Path())
+	}
+
+	inside := &Subscriber{ID: "inside", IntervalStart: "a", IntervalEnd: "m", Updates: make(chan Event, 10), Recursive: true}
+	outside := &Subscriber{ID: "outside", IntervalStart: "n", IntervalEnd: "z", Updates: make(chan Event, 10), Recursive: true}
+	plain := &Subscriber{ID: "plain", IntervalStart: "a", IntervalEnd: "z", Updates: make(chan Event, 10)}
+	atDoc := &Subscriber{ID: "atDoc", Updates: make(chan Event, 10), Recursive: true}
+	db.AddSubscriber(inside)
+	db.AddSubscriber(outside)
+	db.AddSubscriber(plain)
+	doc.AddSubscriber(atDoc)
+
+	nested.NotifyTree([]byte(`{"action":"update"}`), nil)
+	for _, s := range []*Subscriber{inside, atDoc} {
+		events := queued(s)
+		if len(events) != 1 || events[0].ID != 1 || events[0].Type != "update" ||
+			string(events[0].Data) != `{"action":"update","path":"/v1/db/doc/coll/nested"}` {
+			t.Errorf("%s expected the update with its full path, got %v", s.ID, events)
+		}
+	}
+	for _, s := range []*Subscriber{outside, plain} {
+		if events := queued(s); len(events) != 0 {
+			t.Errorf("%s expected nothing, got %v", s.ID, events)
+		}
+	}
+	if db.LastEventID() != 0 {
+		t.Errorf("Expected the events of plain subscribers not to be numbered, got %d", db.LastEventID())
+	}
+
+	// managers that never had recursive subscribers are skipped
+	if coll.treeEvents.seq != 0 || nested.treeEvents.seq != 0 {
+		t.Errorf("Expected no events numbered without recursive subscribers, got %d and %d", coll.treeEvents.seq, nested.treeEvents.seq)
+	}
+
+	// once detached, changes stay below
+	coll.Detach()
+	nested.NotifyTree([]byte(`{"action":"delete"}`), nil)
+	if events := queued(inside); len(events) != 0 {
+		t.Errorf("Expected nothing from a detached collection, got %v", events)
+	}
+}
@@ -0,0 +1,88 @@
+package subscribe
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+)
+
+// Attach the manager below the manager of the resource holding its resource, so that
+// recursive subscribers above hear about changes here. The name is the segment the
+// resource adds to the path of its parent: a document's name, or a collection's name
+// between slashes. A database has no parent, and its full path, such as "/v1/db/", as its name.
+func (m *SubscriberManager) Attach(parent *SubscriberManager, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.parent = parent
+	m.name = name
+}
+
+// Stop telling the managers above about changes, once the resource is removed.
+func (m *SubscriberManager) Detach() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.parent = nil
+	m.name = ""
+}
+
+// The full path of the manager's resource, as far as it is attached.
+func (m *SubscriberManager) Path() string {
+	m.mu.RLock()
+	parent, name := m.parent, m.name
+	m.mu.RUnlock()
+
+	if parent == nil {
+		return name
+	}
+	return parent.Path() + name
+}
+
+// Add the full path of the manager's resource to a message, which must be a JSON object.
+func (m *SubscriberManager) WithPath(msg []byte) []byte {
+	var message map[string]interface{}
+	err := json.Unmarshal(msg, &message)
+	if err != nil {
+		slog.Error("subscribe WithPath: message is not a JSON object", "error", err)
+		return msg
+	}
+
+	message["path"] = m.Path()
+	data, err := json.Marshal(message)
+	if err != nil {
+		slog.Error("subscribe WithPath: error marshalling message", "error", err)
+		return msg
+	}
+	return data
+}
+
+// Notify the recursive subscribers of this manager, and of every manager above it, of a
+// message about this manager's resource, such as its creation, change or deletion. The full
+// path of the resource is added to the message. The document is the resource, if it is one,
+// for the filters of the subscribers of the collection holding it; further up, subscribers
+// with filters do not hear about it. Managers that never had recursive subscribers are
+// skipped, so that writes far from any are cheap.
+func (m *SubscriberManager) NotifyTree(msg []byte, doc any) {
+	var data []byte
+
+	event := Event{all: true, tree: true}
+	for current := m; current != nil; {
+		if current.treeEvents.watched.Load() {
+			if data == nil {
+				data = m.WithPath(msg)
+			}
+			event.Data = data
+			current.publish(event)
+		}
+
+		current.mu.RLock()
+		parent, name := current.parent, current.name
+		current.mu.RUnlock()
+
+		// the subscribers of a collection hear about what is below the documents in their interval
+		event = Event{key: name, all: strings.Contains(name, "/"), tree: true}
+		if current == m {
+			event.doc = doc
+		}
+		current = parent
+	}
+}
@@ -0,0 +1,407 @@
+// Package websocket implements the WebSocket protocol of RFC 6455 on the standard
+// library: the opening handshake on both ends, message framing and fragmentation,
+// and the ping, pong and close control frames.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The opcodes of frames
+const (
+	OP_CONTINUATION = 0x0
+	OP_TEXT         = 0x1
+	OP_BINARY       = 0x2
+	OP_CLOSE        = 0x8
+	OP_PING         = 0x9
+	OP_PONG         = 0xA
+)
+
+// The status codes of close frames
+const (
+	CLOSE_NORMAL         = 1000 // The connection is done with
+	CLOSE_GOING_AWAY     = 1001 // The server is going down
+	CLOSE_PROTOCOL_ERROR = 1002 // A frame broke the protocol
+	CLOSE_INVALID_DATA   = 1007 // A text message was not UTF-8
+	CLOSE_TOO_BIG        = 1009 // A message was larger than MAX_MESSAGE_SIZE
+)
+
+// The largest message read, in bytes
+const MAX_MESSAGE_SIZE = 1 << 20
+
+// How long a frame may take to write by default, so that a peer that stops
+// reading cannot block the writers of the connection forever
+const WRITE_TIMEOUT = 10 * time.Second
+
+// Appended to the key of a handshake before hashing it, as RFC 6455 requires
+const ACCEPT_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Returned by ReadMessage once the connection is closed
+var ErrClosed = errors.New("websocket closed")
+
+// A Conn is a WebSocket connection. Messages may be written from many goroutines,
+// but only one goroutine may read.
+type Conn struct {
+	conn         net.Conn      // The underlying connection
+	reader       *bufio.Reader // Buffers reads from conn
+	client       bool          // Whether this end is the client, which masks its frames
+	readTimeout  time.Duration // How long to wait for each frame, or 0 to wait forever
+	writeTimeout time.Duration // How long each frame may take to write, or 0 to wait forever
+	closeSent    bool          // Whether a close frame was written
+	mu           sync.Mutex    // To protect access to closeSent and writes to conn
+}
+
+// Upgrade an HTTP request to a WebSocket connection, writing the handshake response.
+// If the request is not a valid handshake, a 400 error is written and an error returned.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	switch {
+	case r.Method != http.MethodGet:
+		err = errors.New("websocket handshake must be a GET")
+	case !hasToken(r.Header, "Connection", "upgrade") || !hasToken(r.Header, "Upgrade", "websocket"):
+		err = errors.New("not a websocket handshake")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		err = errors.New("unsupported websocket version")
+	case err != nil || len(decoded) != 16:
+		err = errors.New("invalid websocket key")
+	}
+	if err != nil {
+		slog.Info("websocket Upgrade: bad handshake", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		slog.Error("websocket Upgrade: connection cannot be hijacked")
+		http.Error(w, "websocket unsupported", http.StatusInternalServerError)
+		return nil, errors.New("websocket unsupported")
+	}
+	netConn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// nothing else may write the response once hijacked
+	netConn.SetDeadline(time.Time{})
+	buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	buffered.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	buffered.WriteString("Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n")
+	err = buffered.Flush()
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return &Conn{conn: netConn, reader: buffered.Reader, writeTimeout: WRITE_TIMEOUT}, nil
+}
+
+// Dial a WebSocket server at a "ws://" URL, sending the given headers with the handshake.
+func Dial(rawURL string, header http.Header) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+	netConn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{Method: http.MethodGet, URL: u, Host: u.Host, Header: make(http.Header)}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	err = req.Write(netConn)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		netConn.Close()
+		return nil, fmt.Errorf("websocket handshake failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return &Conn{conn: netConn, reader: reader, client: true, writeTimeout: WRITE_TIMEOUT}, nil
+}
+
+// Compute the Sec-WebSocket-Accept header answering a key.
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + ACCEPT_GUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Check whether a header holds a token in its comma separated list, ignoring case.
+func hasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Wait at most the given time for each frame, so that a peer that stops
+// answering pings is noticed. Zero waits forever.
+func (c *Conn) SetReadTimeout(timeout time.Duration) {
+	c.readTimeout = timeout
+}
+
+// Wait at most the given time for each frame to be written, so that a peer
+// that stops reading is noticed. Zero waits forever.
+func (c *Conn) SetWriteTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeTimeout = timeout
+}
+
+// Read the next text or binary message, joining its fragments. Pings are answered,
+// and a close frame is answered before returning ErrClosed. Protocol errors close the connection.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	opcode := -1
+	message := make([]byte, 0)
+	for {
+		fin, frameOp, payload, err := c.readFrame()
+		if err != nil {
+			var closeErr closeError
+			if errors.As(err, &closeErr) {
+				slog.Info("websocket ReadMessage: closing after bad frame", "error", err)
+				c.CloseWith(closeErr.code, closeErr.Error())
+				return 0, nil, err
+			}
+			c.conn.Close()
+			return 0, nil, err
+		}
+
+		switch frameOp {
+		case OP_PING:
+			err = c.WriteMessage(OP_PONG, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OP_PONG:
+			continue
+		case OP_CLOSE:
+			code := CLOSE_NORMAL
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.CloseWith(code, "")
+			return 0, nil, ErrClosed
+		case OP_TEXT, OP_BINARY:
+			if opcode != -1 {
+				return c.fail(CLOSE_PROTOCOL_ERROR, "new message before the last one finished")
+			}
+			opcode = frameOp
+		case OP_CONTINUATION:
+			if opcode == -1 {
+				return c.fail(CLOSE_PROTOCOL_ERROR, "continuation without a message")
+			}
+		default:
+			return c.fail(CLOSE_PROTOCOL_ERROR, fmt.Sprintf("unknown opcode %d", frameOp))
+		}
+
+		if len(message)+len(payload) > MAX_MESSAGE_SIZE {
+			return c.fail(CLOSE_TOO_BIG, "message too big")
+		}
+		message = append(message, payload...)
+		if fin {
+			if opcode == OP_TEXT && !utf8.Valid(message) {
+				return c.fail(CLOSE_INVALID_DATA, "text message is not UTF-8")
+			}
+			return opcode, message, nil
+		}
+	}
+}
+
+// A closeError is a protocol error, closing the connection with its code.
+type closeError struct {
+	code   int
+	reason string
+}
+
+func (e closeError) Error() string {
+	return e.reason
+}
+
+// Close the connection after a protocol error and return the error.
+func (c *Conn) fail(code int, reason string) (int, []byte, error) {
+	slog.Info("websocket ReadMessage: closing after bad message", "code", code, "reason", reason)
+	c.CloseWith(code, reason)
+	return 0, nil, closeError{code, reason}
+}
+
+// Read one frame, unmasking its payload.
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	if c.readTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+
+	var header [2]byte
+	_, err := io.ReadFull(c.reader, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0F)
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, closeError{CLOSE_PROTOCOL_ERROR, "reserved bits set"}
+	}
+	// clients must mask their frames, and servers must not
+	if masked == c.client {
+		return false, 0, nil, closeError{CLOSE_PROTOCOL_ERROR, "wrong masking"}
+	}
+	if opcode >= OP_CLOSE && (!fin || length > 125) {
+		return false, 0, nil, closeError{CLOSE_PROTOCOL_ERROR, "bad control frame"}
+	}
+
+	switch length {
+	case 126:
+		var extended [2]byte
+		_, err = io.ReadFull(c.reader, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		_, err = io.ReadFull(c.reader, extended[:])
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if length > MAX_MESSAGE_SIZE {
+		return false, 0, nil, closeError{CLOSE_TOO_BIG, "message too big"}
+	}
+
+	var mask [4]byte
+	if masked {
+		_, err = io.ReadFull(c.reader, mask[:])
+		if err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// Write a message in a single frame.
+func (c *Conn) WriteMessage(opcode int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	return c.writeFrame(opcode, data)
+}
+
+// Write a frame, masking it if this end is the client. The caller must hold the lock.
+func (c *Conn) writeFrame(opcode int, data []byte) error {
+	frame := make([]byte, 0, len(data)+14)
+	frame = append(frame, 0x80|byte(opcode))
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(data) <= 125:
+		frame = append(frame, maskBit|byte(len(data)))
+	case len(data) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(data)))
+	}
+
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		for i, b := range data {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, data...)
+	}
+
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Send a ping, which the peer must answer with a pong.
+func (c *Conn) Ping() error {
+	return c.WriteMessage(OP_PING, nil)
+}
+
+// Close the connection normally.
+func (c *Conn) Close() error {
+	return c.CloseWith(CLOSE_NORMAL, "")
+}
+
+// Send a close frame with the given status code and reason, if none was sent yet, and close the connection.
+// The close frame is skipped while another write is under way, since that write may be stuck on a peer
+// that stopped reading; closing the connection ends it.
+func (c *Conn) CloseWith(code int, reason string) error {
+	if c.mu.TryLock() {
+		if !c.closeSent {
+			c.closeSent = true
+			payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+			if len(reason) > 123 {
+				reason = reason[:123]
+			}
+			c.writeFrame(OP_CLOSE, append(payload, reason...))
+		}
+		c.mu.Unlock()
+	}
+	return c.conn.Close()
+}
@@ -0,0 +1,172 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start a server echoing every message it reads.
+func echoServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		for {
+			opcode, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(opcode, message)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Dial the server, failing the test on error.
+func dial(t *testing.T, server *httptest.Server) *Conn {
+	conn, err := Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Could not dial: %v", err)
+	}
+	conn.SetReadTimeout(5 * time.Second)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// test the accept key against the example in RFC 6455
+func TestAcceptKey(t *testing.T) {
+	expected := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if accepted := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); accepted != expected {
+		t.Errorf("Expected %s got %s", expected, accepted)
+	}
+}
+
+func TestBadHandshake(t *testing.T) {
+	server := echoServer(t)
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Could not get: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected %d for a plain GET, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	conn := dial(t, echoServer(t))
+	for _, message := range []string{"hello", strings.Repeat("x", 200), strings.Repeat("y", 70000)} {
+		err := conn.WriteMessage(OP_TEXT, []byte(message))
+		if err != nil {
+			t.Fatalf("Could not write: %v", err)
+		}
+		opcode, echoed, err := conn.ReadMessage()
+		if err != nil || opcode != OP_TEXT || string(echoed) != message {
+			t.Errorf("Expected a %d byte echo, got %d bytes, opcode %d, error %v", len(message), len(echoed), opcode, err)
+		}
+	}
+}
+
+// test fragmented messages, pings between fragments, and closing
+func TestFragmentsPingAndClose(t *testing.T) {
+	conn := dial(t, echoServer(t))
+	conn.mu.Lock()
+	conn.conn.Write(clientFrame(false, OP_TEXT, "hel"))
+	conn.conn.Write(clientFrame(true, OP_PING, "are you there"))
+	conn.conn.Write(clientFrame(true, OP_CONTINUATION, "lo"))
+	conn.mu.Unlock()
+
+	// the pong comes back first, and is skipped by ReadMessage, so read it by hand
+	fin, opcode, payload, err := conn.readFrame()
+	if err != nil || !fin || opcode != OP_PONG || string(payload) != "are you there" {
+		t.Errorf("Expected a pong, got opcode %d %q %v", opcode, payload, err)
+	}
+	opcode, message, err := conn.ReadMessage()
+	if err != nil || opcode != OP_TEXT || string(message) != "hello" {
+		t.Errorf("Expected the fragments joined, got %q %v", message, err)
+	}
+
+	err = conn.WriteMessage(OP_CLOSE, []byte{0x03, 0xE8})
+	if err != nil {
+		t.Fatalf("Could not write close: %v", err)
+	}
+	fin, opcode, payload, err = conn.readFrame()
+	if err != nil || opcode != OP_CLOSE || len(payload) < 2 || payload[0] != 0x03 || payload[1] != 0xE8 {
+		t.Errorf("Expected the close to be answered, got opcode %d %v %v", opcode, payload, err)
+	}
+}
+
+// test that unmasked frames from a client close the connection with a protocol error
+func TestUnmaskedFrame(t *testing.T) {
+	server := echoServer(t)
+	conn := dial(t, server)
+	conn.client = false
+	conn.WriteMessage(OP_TEXT, []byte("hello"))
+	conn.client = true
+
+	_, opcode, payload, err := conn.readFrame()
+	if err != nil || opcode != OP_CLOSE || len(payload) < 2 || int(payload[0])<<8|int(payload[1]) != CLOSE_PROTOCOL_ERROR {
+		t.Errorf("Expected a protocol error, got opcode %d %v %v", opcode, payload, err)
+	}
+}
+
+// Build a masked client frame.
+func clientFrame(fin bool, opcode int, payload string) []byte {
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{first, 0x80 | byte(len(payload))}, mask...)
+	for i := range payload {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+// test that a write to a peer that stops reading gives up after the write timeout
+func TestWriteTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &Conn{conn: server, reader: bufio.NewReader(server)}
+	conn.SetWriteTimeout(50 * time.Millisecond)
+
+	err := conn.WriteMessage(OP_TEXT, []byte("nobody reads this"))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
+
+// test that closing does not wait for a write stuck on a peer that stopped reading
+func TestCloseWhileWriting(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &Conn{conn: server, reader: bufio.NewReader(server)}
+
+	written := make(chan error)
+	go func() {
+		written <- conn.WriteMessage(OP_TEXT, []byte("nobody reads this"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error)
+	go func() {
+		closed <- conn.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close waited for the stuck write")
+	}
+	if err := <-written; err == nil {
+		t.Errorf("Expected the stuck write to fail")
+	}
+}